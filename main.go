@@ -1,9 +1,13 @@
 package main
 
 import (
+	"flag"
+
 	"MiniFileStore/pkg"
 )
 
 func main() {
-	pkg.Serve(":8080")
+	listen := flag.String("listen", "", "address to listen on, e.g. :8080; overrides "+pkg.ListenAddressEnv+" and server.listen of config.json")
+	flag.Parse()
+	pkg.Serve(*listen)
 }
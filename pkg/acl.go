@@ -0,0 +1,401 @@
+package pkg
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The permissions an ACL entry can grant on the stored files.
+const (
+	PermissionRead   = "read"
+	PermissionWrite  = "write"
+	PermissionDelete = "delete"
+)
+
+// ACLEntry grants permissions on stored files to a principal: "user:<subject>", "group:<name>" or
+// "*" for every authenticated caller. The entry covers the file File, or every file whose name
+// starts with Prefix; an entry with neither covers the whole store.
+type ACLEntry struct {
+	ID          string   `json:"id"`
+	Principal   string   `json:"principal"`
+	File        string   `json:"file,omitempty"`
+	Prefix      string   `json:"prefix,omitempty"`
+	Permissions []string `json:"permissions"`
+}
+
+// ACLResponse lists the entries of the ACL file.
+type ACLResponse struct {
+	Entries []ACLEntry `json:"entries"`
+}
+
+type aclFile struct {
+	Entries []ACLEntry `json:"entries"`
+}
+
+// accessControl holds the ACLs of the server, nil unless an ACL file is configured.
+var accessControl *aclStore
+
+var errACLEntryNotFound = errors.New("ACL entry does not exist")
+
+// aclStore keeps the ACL entries of the ACL file, read again whenever the file changed.
+type aclStore struct {
+	mu      sync.Mutex
+	path    string
+	modTime time.Time
+	entries []ACLEntry
+}
+
+func newACLStore(path string) *aclStore {
+	return &aclStore{path: path}
+}
+
+// refresh reads the ACL file if it changed since it was last read. The caller must hold the lock.
+func (s *aclStore) refresh() error {
+	stat, err := os.Stat(s.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		s.entries, s.modTime = nil, time.Time{}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if stat.ModTime().Equal(s.modTime) {
+		return nil
+	}
+	var file aclFile
+	err = loadJSON(s.path, &file)
+	if err != nil {
+		return fmt.Errorf("reading the ACL file: %w", err)
+	}
+	s.entries, s.modTime = file.Entries, stat.ModTime()
+	return nil
+}
+
+// save writes the ACL file. The caller must hold the lock.
+func (s *aclStore) save() error {
+	err := saveJSON(s.path, aclFile{Entries: s.entries})
+	if err != nil {
+		return err
+	}
+	if stat, err := os.Stat(s.path); err == nil {
+		s.modTime = stat.ModTime()
+	}
+	return nil
+}
+
+// list returns the current entries.
+func (s *aclStore) list() ([]ACLEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err := s.refresh()
+	if err != nil {
+		return nil, err
+	}
+	return append([]ACLEntry{}, s.entries...), nil
+}
+
+// add appends entry to the ACL file under a new id.
+func (s *aclStore) add(entry ACLEntry) (ACLEntry, error) {
+	entry.ID = newRequestID()[:16]
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err := s.refresh()
+	if err != nil {
+		return ACLEntry{}, err
+	}
+	s.entries = append(s.entries, entry)
+	return entry, s.save()
+}
+
+// remove deletes the entry with the given id.
+func (s *aclStore) remove(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err := s.refresh()
+	if err != nil {
+		return err
+	}
+	for i, entry := range s.entries {
+		if entry.ID == id {
+			s.entries = append(s.entries[:i:i], s.entries[i+1:]...)
+			return s.save()
+		}
+	}
+	return errACLEntryNotFound
+}
+
+// covers reports whether the entry applies to the file name.
+func (e ACLEntry) covers(name string) bool {
+	if e.File != "" {
+		return e.File == name
+	}
+	return strings.HasPrefix(name, e.Prefix)
+}
+
+// grants reports whether the entry gives permission to caller.
+func (e ACLEntry) grants(caller *Caller, permission string) bool {
+	if !containsString(e.Permissions, permission) {
+		return false
+	}
+	switch {
+	case e.Principal == "*":
+		return true
+	case strings.HasPrefix(e.Principal, "user:"):
+		return strings.TrimPrefix(e.Principal, "user:") == caller.Subject
+	case strings.HasPrefix(e.Principal, "group:"):
+		return containsString(caller.Groups, strings.TrimPrefix(e.Principal, "group:"))
+	}
+	return false
+}
+
+// fileAccess decides what the caller of a request may do with the stored files: callers holding
+// the admin scope and the owner of a file may do everything, everyone else needs an ACL entry.
+// A nil fileAccess allows everything, as when no ACL file is configured or authentication is off.
+type fileAccess struct {
+	caller  *Caller
+	entries []ACLEntry
+}
+
+// accessOf returns the file access of the caller of r, nil when access is not restricted.
+func accessOf(r *http.Request) (*fileAccess, error) {
+	caller := callerFrom(r.Context())
+	if accessControl == nil || caller == nil || caller.HasScope(ScopeAdmin) {
+		return nil, nil
+	}
+	entries, err := accessControl.list()
+	if err != nil {
+		return nil, err
+	}
+	return &fileAccess{caller: caller, entries: entries}, nil
+}
+
+// allows reports whether the caller may perform permission on the file described by details. Files
+// not stored yet are passed with their name only.
+func (a *fileAccess) allows(details FileDetails, permission string) bool {
+	if a == nil || (details.Owner != "" && details.Owner == a.caller.Subject) {
+		return true
+	}
+	for _, entry := range a.entries {
+		if entry.covers(details.Filename) && entry.grants(a.caller, permission) {
+			return true
+		}
+	}
+	return false
+}
+
+// fileSet is a set of stored file names; the nil set holds every file.
+type fileSet map[string]bool
+
+func (s fileSet) contains(name string) bool {
+	return s == nil || s[name]
+}
+
+// filter returns the entries of the set.
+func (s fileSet) filter(entries []FileDetails) []FileDetails {
+	if s == nil {
+		return entries
+	}
+	filtered := make([]FileDetails, 0, len(entries))
+	for _, entry := range entries {
+		if s[entry.Filename] {
+			filtered = append(filtered, entry)
+		}
+	}
+	return filtered
+}
+
+// readableFiles returns the files the caller of r may read, nil when it may read every file. It
+// responds with 500 and returns false if the records or ACLs cannot be read.
+func readableFiles(w http.ResponseWriter, r *http.Request) (fileSet, bool) {
+	access, err := accessOf(r)
+	if err == nil && access == nil {
+		return nil, true
+	}
+	var entries []FileDetails
+	if err == nil {
+		entries, err = getAllEntries()
+	}
+	if err != nil {
+		log.Println("Error reading the access control lists:", err)
+		respondError(w, http.StatusInternalServerError, ErrCodeInternal, "Error checking the permissions")
+		return nil, false
+	}
+	readable := make(fileSet)
+	for _, entry := range entries {
+		if access.allows(entry, PermissionRead) {
+			readable[entry.Filename] = true
+		}
+	}
+	return readable, true
+}
+
+// authorizeFile checks that the caller of r may perform permission on the file name, stored or
+// not. It responds with 403, or 500 if the check fails, and returns false otherwise.
+func authorizeFile(w http.ResponseWriter, r *http.Request, name string, permission string) bool {
+	access, err := accessOf(r)
+	if err == nil && access == nil {
+		return true
+	}
+	var record *FileDetails
+	if err == nil {
+		record, err = findByName(name)
+	}
+	if err != nil {
+		log.Println("Error checking the permissions:", err)
+		respondError(w, http.StatusInternalServerError, ErrCodeInternal, "Error checking the permissions")
+		return false
+	}
+	details := FileDetails{Filename: name}
+	if record != nil {
+		details = *record
+	}
+	if !access.allows(details, permission) {
+		log.Println(access.caller.Subject, "denied", permission, "on", name)
+		respondError(w, http.StatusForbidden, ErrCodeForbidden, fmt.Sprintf("No %s permission on %s", permission, name))
+		return false
+	}
+	return true
+}
+
+// restrictEntries drops the entries selected by a prefix that the caller of r may not read, and
+// responds with 403 if it may not read one of the explicitly requested names.
+func restrictEntries(w http.ResponseWriter, r *http.Request, entries []FileDetails, names []string) ([]FileDetails, bool) {
+	readable, ok := readableFiles(w, r)
+	if !ok || readable == nil {
+		return entries, ok
+	}
+	var denied []string
+	for _, name := range names {
+		if !readable[name] {
+			denied = append(denied, name)
+		}
+	}
+	if len(denied) > 0 {
+		respondErrorDetails(w, http.StatusForbidden, ErrCodeForbidden, "No read permission", denied)
+		return nil, false
+	}
+	return readable.filter(entries), true
+}
+
+// ownerOf returns the identity recorded as the owner of the files stored by r, "" without
+// authentication.
+func ownerOf(r *http.Request) string {
+	if caller := callerFrom(r.Context()); caller != nil {
+		return caller.Subject
+	}
+	return ""
+}
+
+// parsePermissions reads the repeated or comma-separated "permission" values.
+func parsePermissions(values []string) ([]string, error) {
+	var permissions []string
+	for _, value := range values {
+		for _, permission := range strings.Split(value, ",") {
+			permission = strings.TrimSpace(permission)
+			switch permission {
+			case "":
+				continue
+			case PermissionRead, PermissionWrite, PermissionDelete:
+				permissions = append(permissions, permission)
+			default:
+				return nil, fmt.Errorf("Invalid permission %q, expected read, write or delete", permission)
+			}
+		}
+	}
+	if len(permissions) == 0 {
+		return nil, errors.New("permission is required")
+	}
+	return permissions, nil
+}
+
+// aclHandler is the admin API of the ACLs: GET lists the entries, POST adds one granting the
+// "permission" values to "principal" on "file" or "prefix", DELETE removes the entry "id".
+func aclHandler(w http.ResponseWriter, r *http.Request) {
+	if accessControl == nil {
+		respondError(w, http.StatusNotFound, ErrCodeNotFound, "Access control lists are not configured")
+		return
+	}
+	err := r.ParseForm()
+	if err != nil {
+		log.Println("Error parsing the form:", err)
+		respondError(w, http.StatusBadRequest, ErrCodeInvalidRequest, "Error parsing the form")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		entries, err := accessControl.list()
+		if err != nil {
+			log.Println("Error listing the ACL entries:", err)
+			respondError(w, http.StatusInternalServerError, ErrCodeInternal, "Error reading the access control lists")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(ACLResponse{Entries: entries})
+		if err != nil {
+			log.Println("Error writing response:", err)
+		}
+
+	case http.MethodPost:
+		entry := ACLEntry{Principal: r.FormValue("principal"), File: r.FormValue("file"), Prefix: r.FormValue("prefix")}
+		err := validateRequiredField("principal", entry.Principal)
+		if err != nil {
+			respondError(w, http.StatusBadRequest, ErrCodeMissingField, err.Error())
+			return
+		}
+		if entry.Principal != "*" && !strings.HasPrefix(entry.Principal, "user:") && !strings.HasPrefix(entry.Principal, "group:") {
+			respondError(w, http.StatusBadRequest, ErrCodeInvalidRequest, "Invalid principal, expected user:<name>, group:<name> or *")
+			return
+		}
+		if entry.File != "" && entry.Prefix != "" {
+			respondError(w, http.StatusBadRequest, ErrCodeInvalidRequest, "Either file or prefix may be given, not both")
+			return
+		}
+		entry.Permissions, err = parsePermissions(r.Form["permission"])
+		if err != nil {
+			respondError(w, http.StatusBadRequest, ErrCodeInvalidRequest, err.Error())
+			return
+		}
+		entry, err = accessControl.add(entry)
+		if err != nil {
+			log.Println("Error adding the ACL entry:", err)
+			respondError(w, http.StatusInternalServerError, ErrCodeInternal, "Error adding the ACL entry")
+			return
+		}
+		log.Println("ACL entry", entry.ID, "added by", callerSubject(r))
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		err = json.NewEncoder(w).Encode(entry)
+		if err != nil {
+			log.Println("Error writing response:", err)
+		}
+
+	case http.MethodDelete:
+		id := r.FormValue("id")
+		err := validateRequiredField("id", id)
+		if err != nil {
+			respondError(w, http.StatusBadRequest, ErrCodeMissingField, err.Error())
+			return
+		}
+		err = accessControl.remove(id)
+		if errors.Is(err, errACLEntryNotFound) {
+			respondError(w, http.StatusNotFound, ErrCodeNotFound, err.Error())
+			return
+		}
+		if err != nil {
+			log.Println("Error removing the ACL entry:", err)
+			respondError(w, http.StatusInternalServerError, ErrCodeInternal, "Error removing the ACL entry")
+			return
+		}
+		log.Println("ACL entry", id, "removed by", callerSubject(r))
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
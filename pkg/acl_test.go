@@ -0,0 +1,308 @@
+package pkg
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// staticCallers authenticates the bearer tokens of the map as the given callers.
+type staticCallers map[string]*Caller
+
+func (c staticCallers) Authenticate(r *http.Request) (*Caller, error) {
+	return c[bearerToken(r)], nil
+}
+
+// aclSetup stores the search files plus a file owned by alice and enables ACLs granting the eng
+// group read access to the fox files and bob read and write access to dog.txt.
+func aclSetup(t *testing.T) func() {
+	teardown := searchSetup(t)
+	_, err := storeFile("alice/notes.txt", strings.NewReader("private notes"), StoreOptions{Owner: "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	previousACL, previousAuthenticators, previousAuditLog := accessControl, authenticators, auditLogPath
+	dir := t.TempDir()
+	accessControl = newACLStore(filepath.Join(dir, "acl.json"))
+	auditLogPath = filepath.Join(dir, "audit.log")
+	authenticators = []Authenticator{staticCallers{
+		"alice": {Subject: "alice", Scopes: []string{ScopeWrite}},
+		"bob":   {Subject: "bob", Scopes: []string{ScopeWrite}},
+		"carol": {Subject: "carol", Scopes: []string{ScopeRead}, Groups: []string{"eng"}},
+		"root":  {Subject: "root", Scopes: []string{ScopeAdmin}},
+	}}
+	for _, entry := range []ACLEntry{
+		{Principal: "group:eng", Prefix: "fox", Permissions: []string{PermissionRead}},
+		{Principal: "user:bob", File: "dog.txt", Permissions: []string{PermissionRead, PermissionWrite}},
+	} {
+		if _, err := accessControl.add(entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return func() {
+		accessControl, authenticators, auditLogPath = previousACL, previousAuthenticators, previousAuditLog
+		teardown()
+	}
+}
+
+func aclRequest(handler http.HandlerFunc, method, target, token, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+token)
+	rr := httptest.NewRecorder()
+	handler(rr, req)
+	return rr
+}
+
+func TestFileAccessAllows(t *testing.T) {
+	access := &fileAccess{
+		caller: &Caller{Subject: "carol", Groups: []string{"eng"}},
+		entries: []ACLEntry{
+			{Principal: "group:eng", Prefix: "reports/", Permissions: []string{PermissionRead}},
+			{Principal: "user:carol", File: "todo.txt", Permissions: []string{PermissionWrite}},
+			{Principal: "*", File: "public.txt", Permissions: []string{PermissionRead}},
+			{Principal: "user:dave", Permissions: []string{PermissionDelete}},
+		},
+	}
+	for _, test := range []struct {
+		details    FileDetails
+		permission string
+		allowed    bool
+	}{
+		{FileDetails{Filename: "reports/q1.txt"}, PermissionRead, true},
+		{FileDetails{Filename: "reports/q1.txt"}, PermissionWrite, false},
+		{FileDetails{Filename: "todo.txt"}, PermissionWrite, true},
+		{FileDetails{Filename: "todo.txt"}, PermissionRead, false},
+		{FileDetails{Filename: "public.txt"}, PermissionRead, true},
+		{FileDetails{Filename: "other.txt"}, PermissionDelete, false},
+		{FileDetails{Filename: "mine.txt", Owner: "carol"}, PermissionDelete, true},
+	} {
+		if allowed := access.allows(test.details, test.permission); allowed != test.allowed {
+			t.Errorf("%s %s: expected %v", test.permission, test.details.Filename, test.allowed)
+		}
+	}
+	if !(*fileAccess)(nil).allows(FileDetails{Filename: "any.txt"}, PermissionDelete) {
+		t.Error("Expected unrestricted access without ACLs")
+	}
+}
+
+func TestACLEnforcement(t *testing.T) {
+	teardown := aclSetup(t)
+	defer teardown()
+
+	list := requireScope(ScopeRead, listHandler)
+	for token, expected := range map[string]string{
+		"carol": "fox.txt",
+		"bob":   "dog.txt",
+		"alice": "alice/notes.txt",
+		"root":  "alice/notes.txt dog.txt fox.txt other.txt",
+	} {
+		var entries []FileDetails
+		rr := aclRequest(list, "GET", "/api/v1/list?sort=name", token, "")
+		if err := json.Unmarshal(rr.Body.Bytes(), &entries); err != nil {
+			t.Fatalf("%s: %v %s", token, err, rr.Body.String())
+		}
+		var names []string
+		for _, entry := range entries {
+			names = append(names, entry.Filename)
+		}
+		if strings.Join(names, " ") != expected {
+			t.Errorf("%s: expected to list %s, got %v", token, expected, names)
+		}
+	}
+
+	frequency := requireScope(ScopeRead, wordFrequencyHandler)
+	for _, source := range []string{"index", "scan"} {
+		rr := aclRequest(frequency, "GET", "/api/v1/frequency?noOfWords=100&mostFrequent=true&source="+source, "carol", "")
+		var result Frequencies
+		if err := json.Unmarshal(rr.Body.Bytes(), &result); err != nil {
+			t.Fatal(err)
+		}
+		if counts := frequencyMap(result); counts["fox"] != 2 || counts["sleeps"] != 0 || counts["notes"] != 0 {
+			t.Errorf("%s: expected only the fox counts, got %v", source, counts)
+		}
+	}
+
+	search := requireScope(ScopeRead, searchHandler)
+	rr := aclRequest(search, "GET", "/api/v1/search?q=lazy", "carol", "")
+	var found SearchResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &found); err != nil || found.Total != 1 || found.Results[0].Filename != "fox.txt" {
+		t.Errorf("Expected only fox.txt to be found, got %s", rr.Body.String())
+	}
+
+	files := requireMethodScope(filesV2Handler)
+	for _, test := range []struct {
+		method, name, token, body string
+		status                    int
+	}{
+		{"GET", "dog.txt", "carol", "", http.StatusForbidden},
+		{"GET", "dog.txt", "bob", "", http.StatusOK},
+		{"PUT", "dog.txt", "bob", "The dog is awake.", http.StatusOK},
+		{"DELETE", "dog.txt", "bob", "", http.StatusForbidden},
+		{"GET", "alice/notes.txt", "bob", "", http.StatusForbidden},
+		{"GET", "alice/notes.txt", "alice", "", http.StatusOK},
+		{"PUT", "alice/new.txt", "alice", "new notes", http.StatusForbidden},
+		{"PUT", "bob/../alice/new.txt", "bob", "new notes", http.StatusForbidden},
+		{"DELETE", "alice/notes.txt", "alice", "", http.StatusNoContent},
+		{"DELETE", "other.txt", "root", "", http.StatusNoContent},
+	} {
+		rr := aclRequest(files, test.method, FilesV2Prefix+test.name, test.token, test.body)
+		if rr.Code != test.status {
+			t.Errorf("%s %s as %s: expected %d, got %d %s", test.method, test.name, test.token, test.status, rr.Code, rr.Body.String())
+		}
+	}
+
+	// a prefix grant lets alice create files, which she then owns
+	_, err := accessControl.add(ACLEntry{Principal: "user:alice", Prefix: "alice/", Permissions: []string{PermissionWrite}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rr := aclRequest(files, "PUT", FilesV2Prefix+"alice/new.txt", "alice", "new notes"); rr.Code != http.StatusCreated {
+		t.Fatalf("Expected alice to store below her prefix, got %d", rr.Code)
+	}
+	record, err := findByName("alice/new.txt")
+	if err != nil || record == nil || record.Owner != "alice" {
+		t.Fatalf("Expected alice to own the new file, got %+v %v", record, err)
+	}
+	if rr := aclRequest(files, "DELETE", FilesV2Prefix+"alice/new.txt", "alice", ""); rr.Code != http.StatusNoContent {
+		t.Errorf("Expected the owner to delete the file, got %d", rr.Code)
+	}
+
+	// an unreadable file is answered like a missing one, or refused whether it exists or not
+	exists := requireScope(ScopeRead, existenceCheckHandler)
+	for _, name := range []string{"dog.txt", "missing.txt"} {
+		if rr := aclRequest(exists, "GET", "/api/v1/exists?name="+name, "carol", ""); rr.Code != http.StatusNotFound {
+			t.Errorf("Expected the existence of %s to be hidden from carol, got %d", name, rr.Code)
+		}
+		if rr := aclRequest(requireScope(ScopeRead, diffHandler), "GET", "/api/v1/diff?from=fox.txt&to="+name, "carol", ""); rr.Code != http.StatusForbidden {
+			t.Errorf("Expected the diff with %s to be refused to carol, got %d", name, rr.Code)
+		}
+	}
+	if rr := aclRequest(exists, "GET", "/api/v1/exists?name=fox.txt", "carol", ""); rr.Code != http.StatusOK {
+		t.Errorf("Expected carol to see a readable file, got %d", rr.Code)
+	}
+
+	zip := requireScope(ScopeRead, bulkDownloadHandler)
+	if rr := aclRequest(zip, "GET", "/api/v1/download/zip?filename=dog.txt", "carol", ""); rr.Code != http.StatusForbidden {
+		t.Errorf("Expected the zip of an unreadable file to be refused, got %d", rr.Code)
+	}
+}
+
+func TestACLAdminAPI(t *testing.T) {
+	teardown := aclSetup(t)
+	defer teardown()
+	acls := requireScope(ScopeAdmin, allowMethods(aclHandler, http.MethodGet, http.MethodPost, http.MethodDelete))
+
+	if rr := aclRequest(acls, "GET", "/api/v1/admin/acls", "bob", ""); rr.Code != http.StatusForbidden {
+		t.Fatalf("Expected only admins to manage ACLs, got %d", rr.Code)
+	}
+	for _, target := range []string{
+		"/api/v1/admin/acls?principal=bob&file=a.txt&permission=read",
+		"/api/v1/admin/acls?principal=user:bob&file=a.txt&permission=own",
+		"/api/v1/admin/acls?principal=user:bob&file=a.txt&prefix=a&permission=read",
+	} {
+		if rr := aclRequest(acls, "POST", target, "root", ""); rr.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected %d, got %d", target, http.StatusBadRequest, rr.Code)
+		}
+	}
+
+	rr := aclRequest(acls, "POST", "/api/v1/admin/acls?principal=*&prefix=public/&permission=read,write", "root", "")
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("Expected %d, got %d %s", http.StatusCreated, rr.Code, rr.Body.String())
+	}
+	var entry ACLEntry
+	if err := json.Unmarshal(rr.Body.Bytes(), &entry); err != nil || entry.ID == "" || len(entry.Permissions) != 2 {
+		t.Fatalf("Unexpected entry %s", rr.Body.String())
+	}
+
+	rr = aclRequest(acls, "GET", "/api/v1/admin/acls", "root", "")
+	var list ACLResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &list); err != nil || len(list.Entries) != 3 {
+		t.Errorf("Expected 3 entries, got %s", rr.Body.String())
+	}
+	if rr := aclRequest(acls, "DELETE", "/api/v1/admin/acls?id="+entry.ID, "root", ""); rr.Code != http.StatusNoContent {
+		t.Errorf("Expected %d, got %d", http.StatusNoContent, rr.Code)
+	}
+	if rr := aclRequest(acls, "DELETE", "/api/v1/admin/acls?id="+entry.ID, "root", ""); rr.Code != http.StatusNotFound {
+		t.Errorf("Expected %d, got %d", http.StatusNotFound, rr.Code)
+	}
+}
+
+// readAuditLog returns the records of the audit log.
+func readAuditLog(t *testing.T) []AuditRecord {
+	data, err := os.ReadFile(auditLogPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var records []AuditRecord
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		var record AuditRecord
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+func TestAuditRenamesAndShareUploads(t *testing.T) {
+	teardown := aclSetup(t)
+	defer teardown()
+
+	_, err := accessControl.add(ACLEntry{Principal: "user:alice", Prefix: "partner/", Permissions: []string{PermissionWrite}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = accessControl.add(ACLEntry{Principal: "user:alice", Prefix: "alice/", Permissions: []string{PermissionWrite}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := requireMethodScope(filesV2Handler)
+	if rr := aclRequest(files, "PATCH", FilesV2Prefix+"alice/notes.txt", "alice", `{"filename":"alice/todo.txt"}`); rr.Code != http.StatusOK {
+		t.Fatalf("Expected alice to rename her file, got %d %s", rr.Code, rr.Body.String())
+	}
+	var form bytes.Buffer
+	writer := multipart.NewWriter(&form)
+	for name, value := range map[string]string{"prevFilename": "dog.txt", "filename": "dog2.txt", "duplicate": "false"} {
+		if err := writer.WriteField(name, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest("POST", "/api/v1/update", &form)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	req.Header.Set("Authorization", "Bearer bob")
+	rr := httptest.NewRecorder()
+	requireScope(ScopeWrite, updateHandler)(rr, req)
+	if rr.Code != http.StatusForbidden {
+		t.Fatalf("Expected bob not to rename onto a name he may not write, got %d", rr.Code)
+	}
+	share := requireScope(ScopeRead, allowMethods(shareHandler, http.MethodPost))
+	link := mintShareLink(t, share, "alice", "filename=partner/report.txt&mode=upload")
+	if rr := useShareLink("PUT", link, "quarterly report"); rr.Code != http.StatusCreated {
+		t.Fatalf("Expected the upload to be stored, got %d %s", rr.Code, rr.Body.String())
+	}
+
+	records := readAuditLog(t)
+	if len(records) != 3 {
+		t.Fatalf("Expected the rename, the update and the upload to be audited, got %+v", records)
+	}
+	if record := records[0]; record.PreviousFilename != "alice/notes.txt" || record.Filename != "alice/todo.txt" || record.Status != http.StatusOK {
+		t.Errorf("Expected both names of the renamed file, got %+v", record)
+	}
+	if record := records[1]; record.PreviousFilename != "dog.txt" || record.Filename != "dog2.txt" || record.Status != http.StatusForbidden {
+		t.Errorf("Expected both names of the refused update, got %+v", record)
+	}
+	if record := records[2]; !strings.HasPrefix(record.Caller, "share:") || record.SharedBy != "alice" ||
+		record.Filename != "partner/report.txt" || record.Status != http.StatusCreated {
+		t.Errorf("Expected the share link upload to be audited, got %+v", record)
+	}
+}
@@ -0,0 +1,311 @@
+package pkg
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"path"
+)
+
+// defaultArchiveLimits are used for every limit that is not set in the config.
+var defaultArchiveLimits = ArchiveLimits{
+	MaxEntries:          1000,
+	MaxTotalSize:        1 << 30,
+	MaxCompressionRatio: 100,
+}
+
+// archiveRatioThreshold is the amount of uncompressed data below which the compression ratio is not
+// checked; small, very repetitive text files legitimately compress far better than any sane limit.
+const archiveRatioThreshold = 1 << 20
+
+var (
+	errArchiveEntries = errors.New("entry count limit exceeded")
+	errArchiveSize    = errors.New("total uncompressed size limit exceeded")
+	errArchiveRatio   = errors.New("compression ratio limit exceeded")
+)
+
+// SkippedEntry reports an archive entry that was not stored and why.
+type SkippedEntry struct {
+	Path   string `json:"path"`
+	Reason string `json:"reason"`
+}
+
+// ArchiveResponse is the JSON body returned by archiveStoreHandler.
+type ArchiveResponse struct {
+	Stored  []FileDetails  `json:"stored"`
+	Skipped []SkippedEntry `json:"skipped"`
+	// Aborted is set when a limit stopped the extraction; entries after that point were not read.
+	Aborted string `json:"aborted,omitempty"`
+}
+
+// archiveIngester stores the entries of one archive while keeping track of the limits.
+type archiveIngester struct {
+	limits   ArchiveLimits
+	prefix   string
+	entries  int
+	total    int64
+	response ArchiveResponse
+	// access decides which entries the caller may store, owner is recorded on them
+	access *fileAccess
+	owner  string
+}
+
+func (a *archiveIngester) skip(name string, reason string) {
+	a.response.Skipped = append(a.response.Skipped, SkippedEntry{Path: name, Reason: reason})
+}
+
+// ingest stores a single regular archive entry. ratioExceeded is called with the number of bytes of
+// the entry decompressed so far and is nil when the archive is not compressed. A non-nil return
+// value aborts the extraction.
+func (a *archiveIngester) ingest(name string, src io.Reader, ratioExceeded func(read int64) bool) error {
+	a.entries++
+	if a.entries > a.limits.MaxEntries {
+		return errArchiveEntries
+	}
+
+	fileName, err := cleanStoreName(path.Join(a.prefix, name))
+	if err != nil {
+		a.skip(name, err.Error())
+		return nil
+	}
+	if !a.access.allows(FileDetails{Filename: fileName}, PermissionWrite) {
+		a.skip(name, "no write permission")
+		return nil
+	}
+
+	var read int64
+	guarded := &guardedReader{r: src, guard: func(n int) error {
+		read += int64(n)
+		a.total += int64(n)
+		if a.total > a.limits.MaxTotalSize {
+			return errArchiveSize
+		}
+		if ratioExceeded != nil && ratioExceeded(read) {
+			return errArchiveRatio
+		}
+		return nil
+	}}
+
+	details, err := storeFile(fileName, guarded, StoreOptions{Owner: a.owner})
+	switch {
+	case errors.Is(err, errArchiveSize) || errors.Is(err, errArchiveRatio):
+		a.skip(name, err.Error())
+		return err
+	case errors.Is(err, ErrFileExists):
+		a.skip(name, "file already exists")
+	case err != nil:
+		a.skip(name, "error storing the entry")
+	default:
+		a.response.Stored = append(a.response.Stored, *details)
+	}
+	return nil
+}
+
+// exceedsRatio reports whether uncompressed bytes expanded from compressed bytes break the limit.
+func (a *archiveIngester) exceedsRatio(uncompressed int64, compressed int64) bool {
+	return uncompressed > archiveRatioThreshold &&
+		float64(uncompressed) > a.limits.MaxCompressionRatio*float64(compressed)
+}
+
+// guardedReader calls guard after every read so that limits are enforced on the data actually
+// decompressed rather than on the sizes claimed by the archive headers.
+type guardedReader struct {
+	r     io.Reader
+	guard func(n int) error
+}
+
+func (g *guardedReader) Read(p []byte) (int, error) {
+	n, err := g.r.Read(p)
+	if guardErr := g.guard(n); guardErr != nil {
+		return n, guardErr
+	}
+	return n, err
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// ingestZip stores every regular file of a zip archive.
+func (a *archiveIngester) ingestZip(r io.ReaderAt, size int64) error {
+	reader, err := zip.NewReader(r, size)
+	if err != nil {
+		return err
+	}
+	for _, f := range reader.File {
+		if f.FileInfo().IsDir() {
+			continue
+		}
+		if !f.Mode().IsRegular() {
+			a.skip(f.Name, "not a regular file")
+			continue
+		}
+		// reject entries whose headers already announce a bomb before decompressing anything
+		compressedSize := int64(f.CompressedSize64)
+		if a.exceedsRatio(int64(f.UncompressedSize64), compressedSize) {
+			a.skip(f.Name, errArchiveRatio.Error())
+			continue
+		}
+
+		rc, err := f.Open()
+		if err != nil {
+			log.Println("Error opening the archive entry:", err)
+			a.skip(f.Name, "error reading the entry")
+			continue
+		}
+		err = a.ingest(f.Name, rc, func(read int64) bool { return a.exceedsRatio(read, compressedSize) })
+		if closeErr := rc.Close(); closeErr != nil {
+			log.Println("Error closing the archive entry:", closeErr)
+		}
+		// a zip entry is compressed on its own, so a bad ratio only disqualifies that entry
+		if errors.Is(err, errArchiveRatio) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ingestTar stores every regular file of a tar stream. For a compressed stream, compressed reports
+// the compressed bytes consumed so far and the ratio is checked over the whole stream.
+func (a *archiveIngester) ingestTar(r io.Reader, compressed *countingReader) error {
+	var ratioExceeded func(read int64) bool
+	if compressed != nil {
+		ratioExceeded = func(int64) bool { return a.exceedsRatio(a.total, compressed.n) }
+	}
+
+	reader := tar.NewReader(r)
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		switch header.Typeflag {
+		case tar.TypeDir:
+			continue
+		case tar.TypeReg:
+		default:
+			a.skip(header.Name, "not a regular file")
+			continue
+		}
+
+		err = a.ingest(header.Name, reader, ratioExceeded)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// archiveStoreHandler accepts a zip, tar or tar.gz archive in the "file" part and stores each regular
+// entry as its own record, keeping the path of the entry (below the optional "prefix" field) as name.
+func archiveStoreHandler(w http.ResponseWriter, r *http.Request) {
+	// Parse the multipart form in the request
+	err := r.ParseMultipartForm(50 << 20) // limit your maxMemory here
+	if err != nil {
+		log.Println("Error parsing the form:", err)
+		respondError(w, http.StatusBadRequest, ErrCodeInvalidRequest, "Error parsing the form")
+		return
+	}
+
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		log.Println("Error retrieving the file:", err)
+		respondError(w, http.StatusBadRequest, ErrCodeMissingField, "No archive was uploaded")
+		return
+	}
+	defer CloseMultipartFile(file)
+
+	config, err := GetConfig()
+	if err != nil {
+		log.Println("Error getting the config:", err)
+		respondError(w, http.StatusInternalServerError, ErrCodeInternal, "Error getting the config")
+		return
+	}
+
+	access, err := accessOf(r)
+	if err != nil {
+		log.Println("Error reading the access control lists:", err)
+		respondError(w, http.StatusInternalServerError, ErrCodeInternal, "Error checking the permissions")
+		return
+	}
+
+	ingester := &archiveIngester{limits: withArchiveDefaults(config.Archive), prefix: r.FormValue("prefix"),
+		response: ArchiveResponse{Stored: []FileDetails{}, Skipped: []SkippedEntry{}},
+		access:   access, owner: ownerOf(r)}
+
+	magic := make([]byte, 262)
+	n, err := file.ReadAt(magic, 0)
+	if err != nil && err != io.EOF {
+		log.Println("Error reading the archive:", err)
+		respondError(w, http.StatusInternalServerError, ErrCodeInternal, "Error reading the archive")
+		return
+	}
+	magic = magic[:n]
+
+	switch {
+	case bytes.HasPrefix(magic, []byte("PK\x03\x04")) || bytes.HasPrefix(magic, []byte("PK\x05\x06")):
+		err = ingester.ingestZip(file, header.Size)
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		counter := &countingReader{r: file}
+		var gz *gzip.Reader
+		gz, err = gzip.NewReader(counter)
+		if err == nil {
+			err = ingester.ingestTar(gz, counter)
+		}
+	case len(magic) >= 262 && string(magic[257:262]) == "ustar":
+		err = ingester.ingestTar(file, nil)
+	default:
+		respondError(w, http.StatusUnsupportedMediaType, ErrCodeUnsupportedMediaType, "Unsupported archive format, expected zip, tar or tar.gz")
+		return
+	}
+
+	switch {
+	case errors.Is(err, errArchiveEntries) || errors.Is(err, errArchiveSize) || errors.Is(err, errArchiveRatio):
+		log.Println("Archive extraction aborted:", err)
+		ingester.response.Aborted = err.Error()
+	case err != nil:
+		// entries stored before a corrupt part of the archive are kept and reported
+		log.Println("Error reading the archive:", err)
+		ingester.response.Aborted = fmt.Sprintf("error reading the archive: %v", err)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(ingester.response)
+	if err != nil {
+		log.Println("Error encoding archive response to JSON:", err)
+	}
+}
+
+// withArchiveDefaults fills every unset limit with its default.
+func withArchiveDefaults(limits ArchiveLimits) ArchiveLimits {
+	if limits.MaxEntries <= 0 {
+		limits.MaxEntries = defaultArchiveLimits.MaxEntries
+	}
+	if limits.MaxTotalSize <= 0 {
+		limits.MaxTotalSize = defaultArchiveLimits.MaxTotalSize
+	}
+	if limits.MaxCompressionRatio <= 0 {
+		limits.MaxCompressionRatio = defaultArchiveLimits.MaxCompressionRatio
+	}
+	return limits
+}
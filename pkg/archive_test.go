@@ -0,0 +1,163 @@
+package pkg
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// newArchiveRequest wraps the given archive bytes in a multipart upload request.
+func newArchiveRequest(t *testing.T, archive []byte) *http.Request {
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	part, err := writer.CreateFormFile("file", "archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = part.Write(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = writer.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := http.NewRequest("POST", "/api/v1/store/archive", body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	return req
+}
+
+func serveArchive(t *testing.T, archive []byte) ArchiveResponse {
+	rr := httptest.NewRecorder()
+	archiveStoreHandler(rr, newArchiveRequest(t, archive))
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+
+	var response ArchiveResponse
+	err := json.Unmarshal(rr.Body.Bytes(), &response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return response
+}
+
+func TestArchiveStoreHandlerZip(t *testing.T) {
+	TestCleanCSV(t)
+	defer teardown()
+
+	buf := &bytes.Buffer{}
+	writer := zip.NewWriter(buf)
+	for name, content := range map[string]string{
+		"docs/a.txt":   "the quick brown fox",
+		"b.txt":        "jumps over the lazy dog",
+		"../evil.txt":  "escaping the store",
+		"docs/dup.txt": "the quick brown fox",
+	} {
+		f, err := writer.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = f.Write([]byte(content))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := writer.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	response := serveArchive(t, buf.Bytes())
+
+	if len(response.Stored) != 2 {
+		t.Errorf("Expected 2 stored entries, got %d: %+v", len(response.Stored), response.Stored)
+	}
+	// the escaping path and one of the two identical files are skipped
+	if len(response.Skipped) != 2 {
+		t.Errorf("Expected 2 skipped entries, got %d: %+v", len(response.Skipped), response.Skipped)
+	}
+	for _, details := range response.Stored {
+		if details.Filename == "docs/a.txt" && details.WordCount != 4 {
+			t.Errorf("Expected 4 words in docs/a.txt, got %d", details.WordCount)
+		}
+	}
+}
+
+func TestArchiveStoreHandlerTarGzBomb(t *testing.T) {
+	TestCleanCSV(t)
+	defer teardown()
+
+	buf := &bytes.Buffer{}
+	gz := gzip.NewWriter(buf)
+	writer := tar.NewWriter(gz)
+	entries := []struct {
+		name    string
+		content []byte
+	}{
+		{"small.txt", []byte("a small file")},
+		// zeros compress far beyond the default ratio limit
+		{"zeros.bin", make([]byte, 4<<20)},
+	}
+	for _, entry := range entries {
+		err := writer.WriteHeader(&tar.Header{Name: entry.name, Mode: 0644, Size: int64(len(entry.content)),
+			Typeflag: tar.TypeReg})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = writer.Write(entry.content)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := writer.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = gz.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	response := serveArchive(t, buf.Bytes())
+
+	if len(response.Stored) != 1 || response.Stored[0].Filename != "small.txt" {
+		t.Errorf("Expected only small.txt to be stored, got %+v", response.Stored)
+	}
+	if response.Aborted != errArchiveRatio.Error() {
+		t.Errorf("Expected the extraction to be aborted by the ratio limit, got %q", response.Aborted)
+	}
+	entry, err := findByName("zeros.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry != nil {
+		t.Errorf("Expected no record for the rejected entry")
+	}
+}
+
+func TestCleanStoreName(t *testing.T) {
+	for name, valid := range map[string]bool{
+		"a/b.txt":      true,
+		"a/../b.txt":   true,
+		"../b.txt":     false,
+		"/etc/passwd":  false,
+		"a\\..\\..\\b": false,
+		".":            false,
+	} {
+		_, err := cleanStoreName(name)
+		if (err == nil) != valid {
+			t.Errorf("cleanStoreName(%q) returned %v, expected valid=%v", name, err, valid)
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package pkg
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AuditRecord is a line of the audit log, written for every authenticated mutation and every upload
+// through a share link.
+type AuditRecord struct {
+	Time      time.Time `json:"time"`
+	RequestID string    `json:"request_id,omitempty"`
+	// Caller is the subject of the caller, or "share:<id>" for a share link.
+	Caller string   `json:"caller"`
+	Roles  []string `json:"roles,omitempty"`
+	// SharedBy is the subject that minted the share link used.
+	SharedBy string `json:"shared_by,omitempty"`
+	Method   string `json:"method"`
+	Path     string `json:"path"`
+	Filename string `json:"filename,omitempty"`
+	// PreviousFilename is the name a renamed file had before.
+	PreviousFilename string `json:"previous_filename,omitempty"`
+	Status           int    `json:"status"`
+}
+
+// auditLogPath is the configured audit log, audit.log in the record store when empty.
+var auditLogPath string
+
+var auditMutex sync.Mutex
+
+// statusRecorder remembers the status a handler responded with.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// Unwrap lets http.ResponseController reach the wrapped writer.
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// auditNote holds what a handler adds to the audit record of its request: the names of a renamed
+// file, which the request itself does not show in full.
+type auditNote struct {
+	previousFilename string
+	filename         string
+}
+
+type auditNoteKey struct{}
+
+// withAuditNote returns r with a note its handler can fill with noteRename.
+func withAuditNote(r *http.Request) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), auditNoteKey{}, &auditNote{}))
+}
+
+// noteRename records in the audit log of r that the file previous is renamed to filename.
+func noteRename(r *http.Request, previous, filename string) {
+	if note, ok := r.Context().Value(auditNoteKey{}).(*auditNote); ok {
+		note.previousFilename, note.filename = previous, filename
+	}
+}
+
+// recordMutation appends the caller, target and outcome of a mutating request to the audit log.
+// The request must have been through the handler, which parsed the form naming the file.
+func recordMutation(r *http.Request, status int) {
+	caller := callerFrom(r.Context())
+	if caller == nil {
+		return
+	}
+	record := newAuditRecord(r, status)
+	record.Caller, record.Roles = caller.Subject, caller.Roles
+	if strings.HasPrefix(r.URL.Path, FilesV2Prefix) {
+		record.Filename = strings.TrimPrefix(r.URL.Path, FilesV2Prefix)
+	} else if r.Form != nil {
+		record.Filename = r.Form.Get("filename")
+	}
+	if note, ok := r.Context().Value(auditNoteKey{}).(*auditNote); ok && note.previousFilename != note.filename {
+		record.PreviousFilename, record.Filename = note.previousFilename, note.filename
+	}
+	writeAuditRecord(record)
+}
+
+// recordShareUpload appends an upload through a share link to the audit log. The link is the
+// caller, on behalf of the subject that minted it.
+func recordShareUpload(r *http.Request, grant shareGrant, status int) {
+	record := newAuditRecord(r, status)
+	record.Caller, record.SharedBy, record.Filename = "share:"+grant.ID, grant.By, grant.Filename
+	writeAuditRecord(record)
+}
+
+func newAuditRecord(r *http.Request, status int) AuditRecord {
+	return AuditRecord{
+		Time:      time.Now().UTC(),
+		RequestID: r.Header.Get(RequestIDHeader),
+		Method:    r.Method,
+		Path:      r.URL.Path,
+		Status:    status,
+	}
+}
+
+func writeAuditRecord(record AuditRecord) {
+	if record.PreviousFilename != "" {
+		log.Println(record.Method, record.Path, record.PreviousFilename, "to", record.Filename, "by", record.Caller, "status", record.Status)
+	} else {
+		log.Println(record.Method, record.Path, record.Filename, "by", record.Caller, "status", record.Status)
+	}
+	err := appendAuditRecord(record)
+	if err != nil {
+		log.Println("Error writing the audit log:", err)
+	}
+}
+
+func appendAuditRecord(record AuditRecord) error {
+	path := auditLogPath
+	if path == "" {
+		var err error
+		path, err = RecordStorePath("audit.log")
+		if err != nil {
+			return err
+		}
+	}
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	auditMutex.Lock()
+	defer auditMutex.Unlock()
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer CloseFile(file)
+	_, err = file.Write(append(line, '\n'))
+	return err
+}
@@ -0,0 +1,167 @@
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// The scopes a caller can hold; each one includes the ones before it.
+const (
+	ScopeRead  = "read"
+	ScopeWrite = "write"
+	ScopeAdmin = "admin"
+)
+
+var scopeRank = map[string]int{ScopeRead: 1, ScopeWrite: 2, ScopeAdmin: 3}
+
+// Prefixes of the subjects of each authenticator, so that the identity a JWT or a certificate
+// claims can never be taken for an API token or for one another.
+const (
+	tokenSubjectPrefix = "token:"
+	jwtSubjectPrefix   = "jwt:"
+	certSubjectPrefix  = "cert:"
+)
+
+// Caller is the authenticated identity behind a request.
+type Caller struct {
+	// Subject identifies the caller in logs, records and ACL entries: "token:<id>", "jwt:<subject>"
+	// or "cert:<common name>".
+	Subject string
+	Scopes  []string
+	// Roles and Groups are the roles and groups claimed by a JWT.
+	Roles  []string
+	Groups []string
+}
+
+// HasScope reports whether the caller holds scope or a scope including it.
+func (c *Caller) HasScope(scope string) bool {
+	for _, held := range c.Scopes {
+		if scopeRank[held] >= scopeRank[scope] {
+			return true
+		}
+	}
+	return false
+}
+
+// Authenticator identifies the caller of a request. It returns a nil Caller and no error when the
+// request carries no credentials it knows about, and an error when they are known but not valid.
+type Authenticator interface {
+	Authenticate(r *http.Request) (*Caller, error)
+}
+
+// authenticators are tried in order on every protected request; authentication is disabled while
+// there are none, which keeps deployments without an auth configuration open as before.
+var authenticators []Authenticator
+
+// configureAuth sets up the authenticators enabled in the configuration.
+func configureAuth(config Config) {
+	authenticators = nil
+	if config.Auth.TokensFile != "" {
+		apiTokens = newTokenStore(config.Auth.TokensFile)
+		authenticators = append(authenticators, apiTokens)
+		log.Println("API token authentication enabled")
+	}
+	if config.Auth.JWT != nil {
+		authenticators = append(authenticators, newJWTAuthenticator(*config.Auth.JWT))
+		log.Println("JWT authentication enabled")
+	}
+	if config.TLS != nil && config.TLS.ClientCAFile != "" {
+		authenticators = append(authenticators, clientCertAuthenticator{config: *config.TLS})
+		log.Println("Client certificate authentication enabled")
+	}
+	auditLogPath = config.Auth.AuditLog
+	accessControl = nil
+	if config.Auth.ACLFile != "" {
+		accessControl = newACLStore(config.Auth.ACLFile)
+		log.Println("Access control lists enabled")
+	}
+	shareSecretPath = config.Auth.ShareSecretFile
+}
+
+type callerKey struct{}
+
+// callerFrom returns the caller stored in the context by requireScope, or nil when authentication
+// is disabled.
+func callerFrom(ctx context.Context) *Caller {
+	caller, _ := ctx.Value(callerKey{}).(*Caller)
+	return caller
+}
+
+// bearerToken returns the token of an "Authorization: Bearer" header, or "" if there is none.
+func bearerToken(r *http.Request) string {
+	scheme, token, found := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !found || !strings.EqualFold(scheme, "Bearer") {
+		return ""
+	}
+	return strings.TrimSpace(token)
+}
+
+// authenticate returns the caller identified by the first authenticator knowing its credentials.
+func authenticate(r *http.Request) (*Caller, error) {
+	for _, authenticator := range authenticators {
+		caller, err := authenticator.Authenticate(r)
+		if err != nil || caller != nil {
+			return caller, err
+		}
+	}
+	return nil, nil
+}
+
+// requireScope only lets requests of callers holding scope through to next, with the caller in the
+// request context. Missing or invalid credentials are answered with 401, a missing scope with 403.
+func requireScope(scope string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if len(authenticators) == 0 {
+			next(w, r)
+			return
+		}
+		if authThrottled(w, r) {
+			return
+		}
+		caller, err := authenticate(r)
+		if err != nil || caller == nil {
+			recordAuthFailure(r)
+		}
+		if err != nil {
+			log.Println("Authentication failed:", err)
+			w.Header().Set("WWW-Authenticate", `Bearer realm="MiniFileStore", error="invalid_token"`)
+			respondError(w, http.StatusUnauthorized, ErrCodeUnauthorized, "Invalid credentials")
+			return
+		}
+		if caller == nil {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="MiniFileStore"`)
+			respondError(w, http.StatusUnauthorized, ErrCodeUnauthorized, "Authentication required")
+			return
+		}
+		if !caller.HasScope(scope) {
+			w.Header().Set("WWW-Authenticate",
+				fmt.Sprintf(`Bearer realm="MiniFileStore", error="insufficient_scope", scope="%s"`, scope))
+			respondError(w, http.StatusForbidden, ErrCodeForbidden, fmt.Sprintf("The %s scope is required", scope))
+			return
+		}
+		req := r.WithContext(context.WithValue(r.Context(), callerKey{}, caller))
+		if scope == ScopeRead || r.Method == http.MethodGet || r.Method == http.MethodHead {
+			next(w, req)
+			return
+		}
+		req = withAuditNote(req)
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next(recorder, req)
+		recordMutation(req, recorder.status)
+	}
+}
+
+// requireMethodScope requires the read scope for GET and HEAD and the write scope otherwise.
+func requireMethodScope(next http.HandlerFunc) http.HandlerFunc {
+	read, write := requireScope(ScopeRead, next), requireScope(ScopeWrite, next)
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			read(w, r)
+			return
+		}
+		write(w, r)
+	}
+}
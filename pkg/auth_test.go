@@ -0,0 +1,166 @@
+package pkg
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// tokenAuthSetup enables API token authentication with a tokens file holding an admin token and a
+// read token, and returns both tokens.
+func tokenAuthSetup(t *testing.T) (string, string, func()) {
+	path := filepath.Join(t.TempDir(), "tokens.json")
+	expired := time.Now().Add(-time.Hour)
+	file := tokensFile{Tokens: []APIToken{
+		{ID: "admin", Hash: hashToken("admin-secret"), Scopes: []string{ScopeAdmin}},
+		{ID: "reader", Hash: hashToken("read-secret"), Scopes: []string{ScopeRead}},
+		{ID: "old", Hash: hashToken("old-secret"), Scopes: []string{ScopeAdmin}, ExpiresAt: &expired},
+	}}
+	err := saveJSON(path, file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	previousTokens, previousAuthenticators, previousAuditLog := apiTokens, authenticators, auditLogPath
+	apiTokens = newTokenStore(path)
+	authenticators = []Authenticator{apiTokens}
+	auditLogPath = filepath.Join(t.TempDir(), "audit.log")
+	return "admin-secret", "read-secret", func() {
+		apiTokens, authenticators, auditLogPath = previousTokens, previousAuthenticators, previousAuditLog
+	}
+}
+
+func authRequest(handler http.HandlerFunc, method, target, token string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rr := httptest.NewRecorder()
+	handler(rr, req)
+	return rr
+}
+
+func TestCallerHasScope(t *testing.T) {
+	caller := &Caller{Scopes: []string{ScopeWrite}}
+	if !caller.HasScope(ScopeRead) || !caller.HasScope(ScopeWrite) || caller.HasScope(ScopeAdmin) {
+		t.Error("Expected write to include read but not admin")
+	}
+	if (&Caller{Scopes: []string{"unknown"}}).HasScope(ScopeRead) {
+		t.Error("Expected an unknown scope to grant nothing")
+	}
+}
+
+func TestRequireScope(t *testing.T) {
+	admin, reader, teardown := tokenAuthSetup(t)
+	defer teardown()
+
+	var seen *Caller
+	ok := func(w http.ResponseWriter, r *http.Request) { seen = callerFrom(r.Context()) }
+	write := requireScope(ScopeWrite, ok)
+
+	for _, test := range []struct {
+		token  string
+		status int
+		code   string
+	}{
+		{"", http.StatusUnauthorized, ErrCodeUnauthorized},
+		{"wrong-secret", http.StatusUnauthorized, ErrCodeUnauthorized},
+		{"old-secret", http.StatusUnauthorized, ErrCodeUnauthorized},
+		{reader, http.StatusForbidden, ErrCodeForbidden},
+		{admin, http.StatusOK, ""},
+	} {
+		rr := authRequest(write, "POST", "/api/v1/store", test.token)
+		if rr.Code != test.status {
+			t.Errorf("%q: expected %d, got %d", test.token, test.status, rr.Code)
+			continue
+		}
+		if test.code == "" {
+			continue
+		}
+		var apiError APIError
+		if err := json.Unmarshal(rr.Body.Bytes(), &apiError); err != nil || apiError.Code != test.code {
+			t.Errorf("%q: expected the %s code, got %s", test.token, test.code, rr.Body.String())
+		}
+		if !strings.HasPrefix(rr.Header().Get("WWW-Authenticate"), "Bearer") {
+			t.Errorf("%q: expected a WWW-Authenticate header", test.token)
+		}
+	}
+	if seen == nil || seen.Subject != "token:admin" {
+		t.Errorf("Expected the caller in the request context, got %+v", seen)
+	}
+
+	files := requireMethodScope(ok)
+	if rr := authRequest(files, "GET", FilesV2Prefix+"a.txt", reader); rr.Code != http.StatusOK {
+		t.Errorf("Expected the read token to download, got %d", rr.Code)
+	}
+	if rr := authRequest(files, "DELETE", FilesV2Prefix+"a.txt", reader); rr.Code != http.StatusForbidden {
+		t.Errorf("Expected the read token not to delete, got %d", rr.Code)
+	}
+}
+
+func TestTokensAdminAPI(t *testing.T) {
+	admin, reader, teardown := tokenAuthSetup(t)
+	defer teardown()
+	tokens := requireScope(ScopeAdmin, allowMethods(tokensHandler, http.MethodGet, http.MethodPost, http.MethodDelete))
+
+	if rr := authRequest(tokens, "GET", "/api/v1/admin/tokens", reader); rr.Code != http.StatusForbidden {
+		t.Fatalf("Expected only admins to manage tokens, got %d", rr.Code)
+	}
+
+	rr := authRequest(tokens, "POST", "/api/v1/admin/tokens?name=ci&scope=read,write&ttl=1h", admin)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("Expected %d, got %d %s", http.StatusCreated, rr.Code, rr.Body.String())
+	}
+	var issued IssuedToken
+	err := json.Unmarshal(rr.Body.Bytes(), &issued)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if issued.Token == "" || issued.Name != "ci" || len(issued.Scopes) != 2 || issued.ExpiresAt == nil {
+		t.Fatalf("Unexpected token: %+v", issued)
+	}
+	stored, err := os.ReadFile(apiTokens.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(stored), issued.Token) || !strings.Contains(string(stored), hashToken(issued.Token)) {
+		t.Error("Expected only the hash of the token at rest")
+	}
+
+	write := requireScope(ScopeWrite, func(http.ResponseWriter, *http.Request) {})
+	if rr := authRequest(write, "POST", "/api/v1/store", issued.Token); rr.Code != http.StatusOK {
+		t.Errorf("Expected the issued token to be accepted, got %d", rr.Code)
+	}
+
+	rr = authRequest(tokens, "GET", "/api/v1/admin/tokens", admin)
+	var list TokensResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &list); err != nil || len(list.Tokens) != 4 {
+		t.Errorf("Expected 4 tokens, got %s", rr.Body.String())
+	}
+	if strings.Contains(rr.Body.String(), "hash") {
+		t.Error("Expected no hashes in the listing")
+	}
+
+	if rr := authRequest(tokens, "DELETE", "/api/v1/admin/tokens?id="+issued.ID, admin); rr.Code != http.StatusNoContent {
+		t.Fatalf("Expected %d, got %d", http.StatusNoContent, rr.Code)
+	}
+	if rr := authRequest(write, "POST", "/api/v1/store", issued.Token); rr.Code != http.StatusUnauthorized {
+		t.Errorf("Expected the revoked token to be rejected, got %d", rr.Code)
+	}
+
+	for target, status := range map[string]int{
+		"/api/v1/admin/tokens?id=missing": http.StatusNotFound,
+		"/api/v1/admin/tokens":            http.StatusBadRequest,
+	} {
+		if rr := authRequest(tokens, "DELETE", target, admin); rr.Code != status {
+			t.Errorf("%s: expected %d, got %d", target, status, rr.Code)
+		}
+	}
+	if rr := authRequest(tokens, "POST", "/api/v1/admin/tokens?scope=root", admin); rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected an unknown scope to be rejected, got %d", rr.Code)
+	}
+}
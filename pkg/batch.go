@@ -0,0 +1,172 @@
+package pkg
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+const (
+	BatchStatusStored     = "stored"
+	BatchStatusDuplicate  = "duplicate"
+	BatchStatusError      = "error"
+	BatchStatusRolledBack = "rolled_back"
+	BatchStatusSkipped    = "skipped"
+)
+
+// BatchResult describes the outcome of a single file of a batch upload.
+type BatchResult struct {
+	Filename string       `json:"filename"`
+	Status   string       `json:"status"`
+	Error    string       `json:"error,omitempty"`
+	Details  *FileDetails `json:"details,omitempty"`
+}
+
+// BatchResponse is the JSON body returned by batchStoreHandler.
+type BatchResponse struct {
+	Atomic  bool          `json:"atomic"`
+	Results []BatchResult `json:"results"`
+}
+
+// batchStoreHandler stores every "file" part of a multipart request.
+// The name of each file is taken from the "filename" field at the same position, falling back to
+// the name sent with the part itself, and must stay inside the file store. The store options, such
+// as keywords and normalizeEncoding, apply to every file. With atomic=true the batch is all-or-nothing: if any file
+// is not stored (error or duplicate) every file stored by this request is removed again and the
+// files after it are skipped. The batch then fails with 409, or with 500 if the server failed.
+func batchStoreHandler(w http.ResponseWriter, r *http.Request) {
+	// Parse the multipart form in the request
+	err := r.ParseMultipartForm(50 << 20) // limit your maxMemory here
+	if err != nil {
+		log.Println("Error parsing the form:", err)
+		respondError(w, http.StatusBadRequest, ErrCodeInvalidRequest, "Error parsing the form")
+		return
+	}
+
+	atomic := false
+	if value := r.FormValue("atomic"); value != "" {
+		atomic, err = strconv.ParseBool(value)
+		if err != nil {
+			log.Println("Error parsing atomic value:", err)
+			respondError(w, http.StatusBadRequest, ErrCodeInvalidRequest, "Invalid atomic value")
+			return
+		}
+	}
+
+	headers := r.MultipartForm.File["file"]
+	if len(headers) == 0 {
+		log.Println("No file was uploaded")
+		respondError(w, http.StatusBadRequest, ErrCodeMissingField, "No file was uploaded")
+		return
+	}
+	names := r.MultipartForm.Value["filename"]
+	opts, ok := requestStoreOptions(w, r, r.Form)
+	if !ok {
+		return
+	}
+	access, err := accessOf(r)
+	if err != nil {
+		log.Println("Error reading the access control lists:", err)
+		respondError(w, http.StatusInternalServerError, ErrCodeInternal, "Error checking the permissions")
+		return
+	}
+
+	response := BatchResponse{Atomic: atomic, Results: make([]BatchResult, 0, len(headers))}
+	failed, internal := false, false
+	for i, header := range headers {
+		result := BatchResult{Filename: batchFilename(header.Filename, names, i)}
+		// no point in storing the rest of an atomic batch that is going to be rolled back
+		if atomic && failed {
+			result.Status = BatchStatusSkipped
+			response.Results = append(response.Results, result)
+			continue
+		}
+
+		if err := validateRequiredField("filename", result.Filename); err != nil {
+			result.Status, result.Error = BatchStatusError, err.Error()
+			response.Results = append(response.Results, result)
+			failed = true
+			continue
+		}
+		cleaned, err := cleanStoreName(result.Filename)
+		if err != nil {
+			result.Status, result.Error = BatchStatusError, err.Error()
+			response.Results = append(response.Results, result)
+			failed = true
+			continue
+		}
+		result.Filename = cleaned
+		if !access.allows(FileDetails{Filename: result.Filename}, PermissionWrite) {
+			result.Status, result.Error = BatchStatusError, "No write permission"
+			response.Results = append(response.Results, result)
+			failed = true
+			continue
+		}
+
+		file, err := header.Open()
+		if err != nil {
+			log.Println("Error opening the uploaded file:", err)
+			result.Status, result.Error = BatchStatusError, "Error retrieving the file"
+			response.Results = append(response.Results, result)
+			failed, internal = true, true
+			continue
+		}
+		details, err := storeFile(result.Filename, file, opts)
+		CloseMultipartFile(file)
+
+		switch {
+		case errors.Is(err, ErrFileExists):
+			result.Status, result.Error = BatchStatusDuplicate, "File already exists"
+			failed = true
+		case err != nil:
+			result.Status, result.Error = BatchStatusError, "Error storing the file"
+			failed, internal = true, true
+		default:
+			result.Status, result.Details = BatchStatusStored, details
+		}
+		response.Results = append(response.Results, result)
+	}
+
+	code := http.StatusOK
+	if atomic && failed {
+		rollbackBatch(response.Results)
+		code = http.StatusConflict
+		if internal {
+			code = http.StatusInternalServerError
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	err = json.NewEncoder(w).Encode(response)
+	if err != nil {
+		log.Println("Error encoding batch response to JSON:", err)
+	}
+}
+
+// batchFilename is the name of the i-th file of a batch: the "filename" field at the same position,
+// falling back to the name sent with the part itself.
+func batchFilename(partName string, names []string, i int) string {
+	if i < len(names) && names[i] != "" {
+		return names[i]
+	}
+	return partName
+}
+
+// rollbackBatch removes every file that was stored as part of a failed atomic batch and marks
+// its result accordingly. Files that cannot be removed keep their stored status.
+func rollbackBatch(results []BatchResult) {
+	for i := range results {
+		if results[i].Status != BatchStatusStored {
+			continue
+		}
+		err := removeStoredFile(results[i].Filename)
+		if err != nil {
+			log.Println("Error rolling back the file", results[i].Filename, err)
+			continue
+		}
+		results[i].Status, results[i].Details = BatchStatusRolledBack, nil
+	}
+}
@@ -0,0 +1,165 @@
+package pkg
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// newBatchRequest builds a multipart batch request carrying the given local files under the given names.
+func newBatchRequest(t *testing.T, atomic string, names []string, locations []string) *http.Request {
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+
+	for i, location := range locations {
+		err := writer.WriteField("filename", names[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		file, err := os.Open(location)
+		if err != nil {
+			t.Fatal(err)
+		}
+		part, err := writer.CreateFormFile("file", names[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = io.Copy(part, file)
+		CloseFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if atomic != "" {
+		err := writer.WriteField("atomic", atomic)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := writer.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := http.NewRequest("POST", "/api/v1/store/batch", body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	return req
+}
+
+func TestBatchStoreHandler(t *testing.T) {
+	teardown := fileStoreSetup(t)
+	defer teardown()
+
+	// testfile.txt is already stored by the setup, so only the second file is new
+	req := newBatchRequest(t, "", []string{"copy.txt", "second.txt"},
+		[]string{TestFileLocation, Test2FileLocation})
+	rr := httptest.NewRecorder()
+	batchStoreHandler(rr, req)
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+
+	var response BatchResponse
+	err := json.Unmarshal(rr.Body.Bytes(), &response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(response.Results) != 2 {
+		t.Fatalf("Expected 2 results, got %d", len(response.Results))
+	}
+	if response.Results[0].Status != BatchStatusDuplicate {
+		t.Errorf("Expected the first file to be a duplicate, got %s", response.Results[0].Status)
+	}
+	if response.Results[1].Status != BatchStatusStored || response.Results[1].Details == nil {
+		t.Errorf("Expected the second file to be stored, got %s", response.Results[1].Status)
+	}
+
+	entry, err := findByName("second.txt")
+	if err != nil || entry == nil {
+		t.Errorf("Expected a record for second.txt, got %v (%v)", entry, err)
+	}
+}
+
+func TestBatchStoreHandlerAtomicRollback(t *testing.T) {
+	teardown := fileStoreSetup(t)
+	defer teardown()
+
+	// the second file duplicates the one stored by the setup, so the whole batch must be rolled back
+	req := newBatchRequest(t, "true", []string{"second.txt", "copy.txt", "third.txt"},
+		[]string{Test2FileLocation, TestFileLocation, Test2FileLocation})
+	rr := httptest.NewRecorder()
+	batchStoreHandler(rr, req)
+
+	if status := rr.Code; status != http.StatusConflict {
+		t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusConflict)
+	}
+
+	var response BatchResponse
+	err := json.Unmarshal(rr.Body.Bytes(), &response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(response.Results) != 3 {
+		t.Fatalf("Expected a result for every file, got %+v", response.Results)
+	}
+	if response.Results[0].Status != BatchStatusRolledBack {
+		t.Errorf("Expected the first file to be rolled back, got %s", response.Results[0].Status)
+	}
+	if response.Results[2].Status != BatchStatusSkipped || response.Results[2].Filename != "third.txt" {
+		t.Errorf("Expected the third file to be skipped, got %+v", response.Results[2])
+	}
+
+	entry, err := findByName("second.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry != nil {
+		t.Errorf("Expected no record for second.txt after the rollback")
+	}
+	filePath, err := getFileStorePath("second.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filePath); !os.IsNotExist(err) {
+		t.Errorf("Expected second.txt to be removed from the file store")
+	}
+}
+
+func TestBatchStoreHandlerRejectsTraversal(t *testing.T) {
+	teardown := fileStoreSetup(t)
+	defer teardown()
+
+	req := newBatchRequest(t, "", []string{"../escaped.txt", "nested/../second.txt"},
+		[]string{Test2FileLocation, Test2FileLocation})
+	rr := httptest.NewRecorder()
+	batchStoreHandler(rr, req)
+
+	var response BatchResponse
+	err := json.Unmarshal(rr.Body.Bytes(), &response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(response.Results) != 2 || response.Results[0].Status != BatchStatusError {
+		t.Fatalf("Expected the escaping name to be rejected, got %+v", response.Results)
+	}
+	if response.Results[1].Status != BatchStatusStored || response.Results[1].Filename != "second.txt" {
+		t.Errorf("Expected the cleaned name to be stored, got %+v", response.Results[1])
+	}
+	dir, err := getFileStoreDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "..", "escaped.txt")); !os.IsNotExist(err) {
+		t.Errorf("Expected nothing to be written outside the file store, got %v", err)
+	}
+}
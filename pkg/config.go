@@ -6,8 +6,66 @@ import (
 )
 
 type Config struct {
-	FileStore   string `json:"file_store"`
-	RecordStore string `json:"record_store"`
+	FileStore   string        `json:"file_store"`
+	RecordStore string        `json:"record_store"`
+	Archive     ArchiveLimits `json:"archive"`
+	// FrequencyWorkers bounds the number of files counted concurrently by a full scan of the store;
+	// zero means one worker per CPU.
+	FrequencyWorkers int `json:"frequency_workers"`
+	// Tokenizer selects how text is split into words by every analytics path: whitespace, unicode
+	// (the default) or stemming.
+	Tokenizer string `json:"tokenizer"`
+	// Auth enables authentication; every endpoint but the API description is open without it.
+	Auth AuthConfig `json:"auth"`
+	// RateLimits throttles every client per endpoint class and bounds the concurrent uploads.
+	RateLimits RateLimitConfig `json:"rate_limits"`
+	// TrustProxy identifies clients by X-Forwarded-For, for servers behind a reverse proxy; only
+	// enable it when clients cannot reach the server directly.
+	TrustProxy bool `json:"trust_proxy"`
+	// TLS serves HTTPS, and with client CAs mutual TLS, instead of plain HTTP.
+	TLS *TLSConfig `json:"tls"`
+	// Server sets the listen address, the timeouts and the graceful shutdown of the HTTP server.
+	Server ServerConfig `json:"server"`
+}
+
+// AuthConfig lists the enabled ways for callers to authenticate.
+type AuthConfig struct {
+	// TokensFile is the JSON file holding the hashed API tokens, see tokenStore.
+	TokensFile string `json:"tokens_file"`
+	// JWT accepts bearer JWTs of an OIDC provider, see JWTConfig.
+	JWT *JWTConfig `json:"jwt"`
+	// AuditLog is the file every authenticated mutation is recorded in, audit.log in the record
+	// store when empty.
+	AuditLog string `json:"audit_log"`
+	// ACLFile is the JSON file of the ACL entries restricting what callers may do with each file,
+	// see aclStore; without it every caller may access every file its scopes allow.
+	ACLFile string `json:"acl_file"`
+	// ShareSecretFile holds the HMAC key signing the share links, shareKey in the record store when
+	// empty; it is created with a random key if it does not exist.
+	ShareSecretFile string `json:"share_secret_file"`
+}
+
+// RateLimitConfig maps the endpoint classes read, analytics, write and admin to the token bucket
+// every client gets for them; classes without an entry are not limited.
+type RateLimitConfig struct {
+	Classes map[string]RateLimit `json:"classes"`
+	// MaxConcurrentUploads bounds the uploads handled at once; zero means no bound.
+	MaxConcurrentUploads int `json:"max_concurrent_uploads"`
+}
+
+// RateLimit is a token bucket refilling at RequestsPerSecond and holding up to Burst requests, one
+// second's worth when zero.
+type RateLimit struct {
+	RequestsPerSecond float64 `json:"requests_per_second"`
+	Burst             int     `json:"burst"`
+}
+
+// ArchiveLimits bounds what a single uploaded archive may expand to. Zero values fall back to the
+// defaults in defaultArchiveLimits.
+type ArchiveLimits struct {
+	MaxEntries          int     `json:"max_entries"`
+	MaxTotalSize        int64   `json:"max_total_size"`
+	MaxCompressionRatio float64 `json:"max_compression_ratio"`
 }
 
 func GetConfig() (Config, error) {
@@ -0,0 +1,108 @@
+package pkg
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// sniffLength is the number of leading bytes http.DetectContentType looks at.
+const sniffLength = 512
+
+// textApplicationTypes are the application/* types holding text worth counting.
+var textApplicationTypes = map[string]bool{
+	"application/json":       true,
+	"application/xml":        true,
+	"application/javascript": true,
+	"application/x-ndjson":   true,
+	"application/x-yaml":     true,
+	"application/yaml":       true,
+	"application/sql":        true,
+}
+
+// sniffContentType detects the media type of the file at path from its first bytes, without
+// parameters such as the charset, e.g. "text/plain" or "image/png". UTF-16 text without byte order
+// mark looks binary to http.DetectContentType and is sniffed once decoded.
+func sniffContentType(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer CloseFile(file)
+
+	buffer := make([]byte, sniffLength)
+	n, err := io.ReadFull(file, buffer)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return "", err
+	}
+	contentType := http.DetectContentType(buffer[:n])
+	if encoding := detectEncoding(buffer[:n]); contentType == "application/octet-stream" &&
+		(encoding == EncodingUTF16LE || encoding == EncodingUTF16BE) {
+		decoded, err := io.ReadAll(newDecoder(bytes.NewReader(buffer[:n]), encoding))
+		if err == nil {
+			contentType = http.DetectContentType(decoded)
+		}
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return "application/octet-stream", nil
+	}
+	return mediaType, nil
+}
+
+// sniffStoredFile detects the media type of a stored file.
+func sniffStoredFile(filename string) (string, error) {
+	filePath, err := getFileStorePath(filename)
+	if err != nil {
+		return "", err
+	}
+	return sniffContentType(filePath)
+}
+
+// isTextContentType reports whether files of the media type are counted by the analytics. Records
+// stored before content types were detected have none and are treated as text, as they always were.
+func isTextContentType(contentType string) bool {
+	return contentType == "" || strings.HasPrefix(contentType, "text/") || textApplicationTypes[contentType] ||
+		strings.HasSuffix(contentType, "+json") || strings.HasSuffix(contentType, "+xml")
+}
+
+// isTextFile reports whether the file at path holds text; word counting, frequencies and the search
+// index skip every other file.
+func isTextFile(path string) (bool, error) {
+	contentType, err := sniffContentType(path)
+	if err != nil {
+		return false, err
+	}
+	return isTextContentType(contentType), nil
+}
+
+// matchesContentType reports whether the media type is accepted by one of the patterns, each an
+// exact type such as "text/csv" or a whole top-level type such as "text/*".
+func matchesContentType(contentType string, patterns []string) bool {
+	for _, pattern := range patterns {
+		if strings.HasSuffix(pattern, "/*") && strings.HasPrefix(contentType, strings.TrimSuffix(pattern, "*")) {
+			return true
+		}
+		if strings.EqualFold(pattern, contentType) {
+			return true
+		}
+	}
+	return false
+}
+
+// recordedContentType returns the content type of a record, sniffing the stored file for records
+// stored before content types were detected.
+func recordedContentType(details FileDetails) string {
+	if details.ContentType != "" {
+		return details.ContentType
+	}
+	contentType, err := sniffStoredFile(details.Filename)
+	if err != nil {
+		return ""
+	}
+	return contentType
+}
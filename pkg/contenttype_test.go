@@ -0,0 +1,82 @@
+package pkg
+
+import (
+	"context"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+const pngHeader = "\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR"
+
+func TestMatchesContentType(t *testing.T) {
+	for _, test := range []struct {
+		contentType string
+		patterns    []string
+		expected    bool
+	}{
+		{"text/plain", []string{"text/*"}, true},
+		{"text/html", []string{"text/plain", "text/html"}, true},
+		{"text/html", []string{"text/plain"}, false},
+		{"application/json", []string{"text/*"}, false},
+		{"", []string{"text/*"}, false},
+	} {
+		if result := matchesContentType(test.contentType, test.patterns); result != test.expected {
+			t.Errorf("%q %v: expected %v, got %v", test.contentType, test.patterns, test.expected, result)
+		}
+	}
+	if !isTextContentType("application/ld+json") || isTextContentType("image/png") {
+		t.Error("Unexpected text classification")
+	}
+}
+
+func TestBinaryFilesSkippedByAnalytics(t *testing.T) {
+	teardown := searchSetup(t)
+	defer teardown()
+	image, err := storeFile("image.png", strings.NewReader(pngHeader+" lazy lazy lazy IDAT"), StoreOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	page, err := storeFile("page.html", strings.NewReader("<!DOCTYPE html><p>lazy page</p>"), StoreOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if image.ContentType != "image/png" || image.WordCount != 0 {
+		t.Errorf("Expected an image without words, got %+v", image)
+	}
+	if page.ContentType != "text/html" || page.WordCount == 0 {
+		t.Errorf("Expected an HTML page with words, got %+v", page)
+	}
+	record, err := findByName("image.png")
+	if err != nil || record == nil || record.ContentType != "image/png" {
+		t.Fatalf("Expected the content type to be recorded, got %+v %v", record, err)
+	}
+
+	all := FrequencyQuery{NoOfWords: 100, MostFrequent: true}
+	if counts := frequencyMap(frequencyIndex.Query(all)); counts["lazy"] != 3 || counts["idat"] != 0 {
+		t.Errorf("Expected only the text files to be counted, got %v", counts)
+	}
+	if hits := runSearch(t, "idat"); len(hits) != 0 {
+		t.Errorf("Expected the image not to be indexed, got %v", hits)
+	}
+
+	values := url.Values{"noOfWords": {"100"}, "mostFrequent": {"true"}, "contentType": {"text/html"}}
+	q, err := parseFrequencyQuery(values)
+	if err != nil {
+		t.Fatal(err)
+	}
+	indexed := frequencyMap(frequencyIndex.Query(q))
+	scanned, err := scanWordFrequencies(context.Background(), q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if indexed["lazy"] != 1 || indexed["quick"] != 0 || len(indexed) != len(frequencyMap(scanned)) {
+		t.Errorf("Expected only the HTML page to be counted, got %v and %v", indexed, scanned)
+	}
+
+	values.Set("contentType", "text")
+	if _, err := parseFrequencyQuery(values); err == nil {
+		t.Error("Expected an invalid content type to be rejected")
+	}
+}
@@ -0,0 +1,390 @@
+package pkg
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+const (
+	defaultDiffContext = 3
+	maxDiffContext     = 1000
+	// maxDiffSize is the largest file that is diffed; both files are held in memory.
+	maxDiffSize = 4 << 20
+	// maxDiffEdits bounds the work of the diff algorithm; beyond it the differing middle part is
+	// reported as removed and added as a whole, which is still a correct, if not minimal, diff.
+	maxDiffEdits = 1000
+)
+
+var (
+	errDiffBinary   = errors.New("binary files cannot be diffed")
+	errDiffTooLarge = fmt.Errorf("files larger than %d bytes cannot be diffed", maxDiffSize)
+)
+
+// diffOp is one step of an edit script: kind is '=' for an element of both sequences, '-' for an
+// element only in a and '+' for an element only in b; a and b are the indices in each sequence.
+type diffOp struct {
+	kind byte
+	a, b int
+}
+
+// diffEdits returns an edit script turning a into b. The common prefix and suffix are matched first,
+// then the rest with Myers' O(ND) algorithm.
+func diffEdits(a, b []string) []diffOp {
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+
+	ops := make([]diffOp, 0, len(a)+len(b)-prefix-suffix)
+	for i := 0; i < prefix; i++ {
+		ops = append(ops, diffOp{'=', i, i})
+	}
+	for _, op := range myersDiff(a[prefix:len(a)-suffix], b[prefix:len(b)-suffix]) {
+		ops = append(ops, diffOp{op.kind, op.a + prefix, op.b + prefix})
+	}
+	for i := 0; i < suffix; i++ {
+		ops = append(ops, diffOp{'=', len(a) - suffix + i, len(b) - suffix + i})
+	}
+	return ops
+}
+
+// myersDiff finds a shortest edit script with Myers' algorithm, keeping the furthest reaching
+// x of every diagonal k = x - y for each number of edits d to walk the path back.
+func myersDiff(a, b []string) []diffOp {
+	n, m := len(a), len(b)
+	offset := n + m + 1
+	v := make([]int, 2*offset+1)
+	var trace [][]int
+
+	for d := 0; d <= n+m; d++ {
+		if d > maxDiffEdits {
+			return replaceAll(n, m)
+		}
+		// v before round d, for the diagonals -d-1..d+1
+		trace = append(trace, append([]int(nil), v[offset-d-1:offset+d+2]...))
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+				x = v[offset+k+1]
+			} else {
+				x = v[offset+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[offset+k] = x
+			if x >= n && y >= m {
+				return backtrackDiff(trace, n, m)
+			}
+		}
+	}
+	return replaceAll(n, m)
+}
+
+// backtrackDiff walks the trace of myersDiff back from (n, m) to (0, 0).
+func backtrackDiff(trace [][]int, n, m int) []diffOp {
+	var ops []diffOp
+	x, y := n, m
+	for d := len(trace) - 1; d >= 0; d-- {
+		v := func(k int) int { return trace[d][k+d+1] }
+		k := x - y
+		prevK := k - 1
+		if k == -d || (k != d && v(k-1) < v(k+1)) {
+			prevK = k + 1
+		}
+		prevX := v(prevK)
+		prevY := prevX - prevK
+		for x > prevX && y > prevY {
+			x--
+			y--
+			ops = append(ops, diffOp{'=', x, y})
+		}
+		if d > 0 {
+			if x == prevX {
+				ops = append(ops, diffOp{'+', x, prevY})
+			} else {
+				ops = append(ops, diffOp{'-', prevX, y})
+			}
+		}
+		x, y = prevX, prevY
+	}
+	for i, j := 0, len(ops)-1; i < j; i, j = i+1, j-1 {
+		ops[i], ops[j] = ops[j], ops[i]
+	}
+	return ops
+}
+
+// replaceAll is the edit script removing all n elements of a and adding all m elements of b.
+func replaceAll(n, m int) []diffOp {
+	ops := make([]diffOp, 0, n+m)
+	for i := 0; i < n; i++ {
+		ops = append(ops, diffOp{'-', i, 0})
+	}
+	for j := 0; j < m; j++ {
+		ops = append(ops, diffOp{'+', n, j})
+	}
+	return ops
+}
+
+// splitLines splits text after every newline, keeping the newlines so that a missing one at the end
+// of the file shows up in the diff.
+func splitLines(text string) []string {
+	lines := strings.SplitAfter(text, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// unifiedDiff returns the differences between a and b in the unified format with context lines
+// around every change, or "" if they are equal.
+func unifiedDiff(fromName, toName, a, b string, context int) string {
+	linesA, linesB := splitLines(a), splitLines(b)
+	ops := diffEdits(linesA, linesB)
+
+	var out strings.Builder
+	for start := 0; start < len(ops); {
+		// find the next change and extend the hunk while changes are less than 2*context apart
+		first := start
+		for first < len(ops) && ops[first].kind == '=' {
+			first++
+		}
+		if first == len(ops) {
+			break
+		}
+		last := first
+		for i := first + 1; i < len(ops) && i <= last+2*context+1; i++ {
+			if ops[i].kind != '=' {
+				last = i
+			}
+		}
+		from := max(first-context, start)
+		to := min(last+context+1, len(ops))
+
+		if out.Len() == 0 {
+			fmt.Fprintf(&out, "--- %s\n+++ %s\n", fromName, toName)
+		}
+		lengthA, lengthB := 0, 0
+		for _, op := range ops[from:to] {
+			if op.kind != '+' {
+				lengthA++
+			}
+			if op.kind != '-' {
+				lengthB++
+			}
+		}
+		fmt.Fprintf(&out, "@@ -%s +%s @@\n", hunkRange(ops[from].a, lengthA), hunkRange(ops[from].b, lengthB))
+		for _, op := range ops[from:to] {
+			var line string
+			switch op.kind {
+			case '=':
+				out.WriteByte(' ')
+				line = linesA[op.a]
+			case '-':
+				out.WriteByte('-')
+				line = linesA[op.a]
+			case '+':
+				out.WriteByte('+')
+				line = linesB[op.b]
+			}
+			out.WriteString(line)
+			if !strings.HasSuffix(line, "\n") {
+				out.WriteString("\n\\ No newline at end of file\n")
+			}
+		}
+		start = to
+	}
+	return out.String()
+}
+
+// hunkRange formats the start line and length of a hunk the way diff -u does.
+func hunkRange(start, length int) string {
+	switch length {
+	case 0:
+		return fmt.Sprintf("%d,0", start)
+	case 1:
+		return strconv.Itoa(start + 1)
+	}
+	return fmt.Sprintf("%d,%d", start+1, length)
+}
+
+// splitWords splits text into alternating runs of white space and of other characters, so that the
+// pieces put back together give the text again.
+func splitWords(text string) []string {
+	var words []string
+	start, space := 0, false
+	for i, r := range text {
+		if i > start && unicode.IsSpace(r) != space {
+			words = append(words, text[start:i])
+			start = i
+		}
+		space = unicode.IsSpace(r)
+	}
+	if start < len(text) {
+		words = append(words, text[start:])
+	}
+	return words
+}
+
+// wordDiff returns b with the words removed from a marked as [-...-] and the added ones as {+...+},
+// like git diff --word-diff=plain over the whole file.
+func wordDiff(a, b string) string {
+	wordsA, wordsB := splitWords(a), splitWords(b)
+	opening := map[byte]string{'-': "[-", '+': "{+"}
+	closing := map[byte]string{'-': "-]", '+': "+}"}
+	var out strings.Builder
+	var kind byte
+	for _, op := range diffEdits(wordsA, wordsB) {
+		if op.kind != kind {
+			out.WriteString(closing[kind])
+			out.WriteString(opening[op.kind])
+			kind = op.kind
+		}
+		if op.kind == '+' {
+			out.WriteString(wordsB[op.b])
+		} else {
+			out.WriteString(wordsA[op.a])
+		}
+	}
+	out.WriteString(closing[kind])
+	return out.String()
+}
+
+// readDiffable returns the content of a stored file decoded to UTF-8, or errDiffBinary or errDiffTooLarge.
+func readDiffable(filename string) (string, error) {
+	filePath, err := getFileStorePath(filename)
+	if err != nil {
+		return "", err
+	}
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return "", err
+	}
+	if info.Size() > maxDiffSize {
+		return "", errDiffTooLarge
+	}
+	text, err := isTextFile(filePath)
+	if err != nil {
+		return "", err
+	}
+	if !text {
+		return "", errDiffBinary
+	}
+	file, err := openDecoded(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer CloseFile(file)
+	content, err := io.ReadAll(file)
+	if err != nil {
+		return "", err
+	}
+	return string(content), nil
+}
+
+// respondDiffError answers the errors of readDiffable.
+func respondDiffError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, errDiffBinary):
+		respondError(w, http.StatusUnsupportedMediaType, ErrCodeUnsupportedMediaType, err.Error())
+	case errors.Is(err, errDiffTooLarge):
+		respondError(w, http.StatusUnprocessableEntity, ErrCodeInvalidRequest, err.Error())
+	default:
+		log.Println("Error reading the file to diff:", err)
+		respondError(w, http.StatusInternalServerError, ErrCodeInternal, "Error reading the file")
+	}
+}
+
+// diffHandler compares the stored files "from" and "to" and returns a unified diff (text/x-diff), or
+// with mode=word the "to" file with the changed words marked. Equal files give an empty body.
+func diffHandler(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		log.Println("Error parsing the form:", err)
+		respondError(w, http.StatusBadRequest, ErrCodeInvalidRequest, "Error parsing the form")
+		return
+	}
+
+	from, to := r.FormValue("from"), r.FormValue("to")
+	for _, field := range []string{"from", "to"} {
+		err = validateRequiredField(field, r.FormValue(field))
+		if err != nil {
+			respondError(w, http.StatusBadRequest, ErrCodeMissingField, err.Error())
+			return
+		}
+	}
+	mode := r.FormValue("mode")
+	if mode != "" && mode != "line" && mode != "word" {
+		respondError(w, http.StatusBadRequest, ErrCodeInvalidRequest, "Invalid mode value, expected line or word")
+		return
+	}
+	context := defaultDiffContext
+	if r.FormValue("context") != "" {
+		context, err = strconv.Atoi(r.FormValue("context"))
+		if err != nil || context < 0 || context > maxDiffContext {
+			respondError(w, http.StatusBadRequest, ErrCodeInvalidRequest,
+				fmt.Sprintf("Invalid context value, expected 0 to %d", maxDiffContext))
+			return
+		}
+	}
+
+	// authorized before the lookup, so that the answer does not tell whether an unreadable file exists
+	if !authorizeFile(w, r, from, PermissionRead) || !authorizeFile(w, r, to, PermissionRead) {
+		return
+	}
+	var missing []string
+	for _, name := range []string{from, to} {
+		record, err := findByName(name)
+		if err != nil {
+			log.Println("Error executing findByName:", err)
+			respondError(w, http.StatusInternalServerError, ErrCodeInternal, "Error in finding record by name")
+			return
+		}
+		if record == nil {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) > 0 {
+		respondErrorDetails(w, http.StatusNotFound, ErrCodeNotFound, "record does not exist", missing)
+		return
+	}
+
+	a, err := readDiffable(from)
+	if err != nil {
+		respondDiffError(w, err)
+		return
+	}
+	b, err := readDiffable(to)
+	if err != nil {
+		respondDiffError(w, err)
+		return
+	}
+
+	var result string
+	if mode == "word" {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		if a != b {
+			result = wordDiff(a, b)
+		}
+	} else {
+		w.Header().Set("Content-Type", "text/x-diff; charset=utf-8")
+		result = unifiedDiff("a/"+from, "b/"+to, a, b, context)
+	}
+	_, err = w.Write([]byte(result))
+	if err != nil {
+		log.Println("Error writing response:", err)
+	}
+}
@@ -0,0 +1,159 @@
+package pkg
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestUnifiedDiff(t *testing.T) {
+	a := "one\ntwo\nthree\nfour\nfive\nsix\nseven\neight\nnine\nten\n"
+	b := "one\n2\nthree\nfour\nfive\nsix\nseven\neight\nnine\nten\neleven"
+	expected := `--- a/old.txt
++++ b/new.txt
+@@ -1,5 +1,5 @@
+ one
+-two
++2
+ three
+ four
+ five
+@@ -8,3 +8,4 @@
+ eight
+ nine
+ ten
++eleven
+\ No newline at end of file
+`
+	if result := unifiedDiff("a/old.txt", "b/new.txt", a, b, 3); result != expected {
+		t.Errorf("Expected\n%s\ngot\n%s", expected, result)
+	}
+	if result := unifiedDiff("a", "b", a, a, 3); result != "" {
+		t.Errorf("Expected no diff for equal content, got %q", result)
+	}
+	if result := unifiedDiff("a", "b", "", "new\n", 3); result != "--- a\n+++ b\n@@ -0,0 +1 @@\n+new\n" {
+		t.Errorf("Unexpected diff against an empty file: %q", result)
+	}
+}
+
+func TestDiffEdits(t *testing.T) {
+	a := strings.Split("a b c a b b a", " ")
+	b := strings.Split("c b a b a c", " ")
+	ops := diffEdits(a, b)
+	edits := 0
+	var fromA, fromB []string
+	for _, op := range ops {
+		switch op.kind {
+		case '=':
+			if a[op.a] != b[op.b] {
+				t.Fatalf("Unequal elements matched: %+v", op)
+			}
+			fromA, fromB = append(fromA, a[op.a]), append(fromB, b[op.b])
+		case '-':
+			edits++
+			fromA = append(fromA, a[op.a])
+		case '+':
+			edits++
+			fromB = append(fromB, b[op.b])
+		}
+	}
+	// the example of Myers' paper has a shortest edit script of 5
+	if edits != 5 || strings.Join(fromA, " ") != strings.Join(a, " ") || strings.Join(fromB, " ") != strings.Join(b, " ") {
+		t.Errorf("Unexpected edit script: %+v", ops)
+	}
+}
+
+func TestWordDiff(t *testing.T) {
+	result := wordDiff("The quick brown fox\njumps", "The slow brown fox\njumps high")
+	expected := "The [-quick-]{+slow+} brown fox\njumps{+ high+}"
+	if result != expected {
+		t.Errorf("Expected %q, got %q", expected, result)
+	}
+}
+
+func TestDiffHandler(t *testing.T) {
+	teardown := searchSetup(t)
+	defer teardown()
+	_, err := storeFile("image.bin", strings.NewReader("PNG\x00\x01"), StoreOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	diffHandler(rr, httptest.NewRequest("GET", "/api/v1/diff?from=fox.txt&to=dog.txt&mode=word", nil))
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+	if !strings.Contains(rr.Body.String(), "{+sleeps.") {
+		t.Errorf("Expected the added words to be marked, got %q", rr.Body.String())
+	}
+
+	rr = httptest.NewRecorder()
+	diffHandler(rr, httptest.NewRequest("GET", "/api/v1/diff?from=fox.txt&to=dog.txt", nil))
+	if !strings.HasPrefix(rr.Body.String(), "--- a/fox.txt\n+++ b/dog.txt\n@@ -1,2 +1 @@\n") {
+		t.Errorf("Unexpected unified diff: %q", rr.Body.String())
+	}
+
+	for target, status := range map[string]int{
+		"/api/v1/diff?from=fox.txt":                       http.StatusBadRequest,
+		"/api/v1/diff?from=fox.txt&to=dog.txt&mode=char":  http.StatusBadRequest,
+		"/api/v1/diff?from=fox.txt&to=dog.txt&context=-1": http.StatusBadRequest,
+		"/api/v1/diff?from=fox.txt&to=missing.txt":        http.StatusNotFound,
+		"/api/v1/diff?from=fox.txt&to=image.bin":          http.StatusUnsupportedMediaType,
+	} {
+		rr := httptest.NewRecorder()
+		diffHandler(rr, httptest.NewRequest("GET", target, nil))
+		if rr.Code != status {
+			t.Errorf("%s: expected %d, got %d", target, status, rr.Code)
+		}
+	}
+}
+
+func TestUpdateHandlerDiff(t *testing.T) {
+	teardown := searchSetup(t)
+	defer teardown()
+
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	for field, value := range map[string]string{"prevFilename": "dog.txt", "filename": "dog.txt",
+		"duplicate": "false", "diff": "true"} {
+		err := writer.WriteField(field, value)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	part, err := writer.CreateFormFile("file", "dog.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = part.Write([]byte("The lazy dog sleeps.\nThe dog is brown.\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = writer.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest("POST", "/api/v1/update", body)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	rr := httptest.NewRecorder()
+	updateHandler(rr, req)
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+	expected := `--- a/dog.txt
++++ b/dog.txt
+@@ -1 +1,2 @@
+-The lazy dog sleeps. The dog is brown.
+\ No newline at end of file
++The lazy dog sleeps.
++The dog is brown.
+`
+	if rr.Body.String() != expected {
+		t.Errorf("Expected\n%s\ngot\n%s", expected, rr.Body.String())
+	}
+}
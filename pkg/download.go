@@ -0,0 +1,194 @@
+package pkg
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// ManifestName is the name of the entry carrying the FileDetails of every file in a bulk download.
+// If a selected file has that name, the manifest is prefixed with underscores until it is unique, and
+// the name used is sent in the ManifestHeader.
+const ManifestName = "manifest.json"
+
+// ManifestHeader names the response header carrying the name of the manifest entry.
+const ManifestHeader = "X-Manifest-Name"
+
+// selectEntries returns the records named in names plus every record whose name starts with prefix.
+// The second return value lists the requested names that have no record.
+func selectEntries(names []string, prefix string) ([]FileDetails, []string, error) {
+	entries, err := getAllEntries()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	byName := make(map[string]FileDetails, len(entries))
+	for _, entry := range entries {
+		byName[entry.Filename] = entry
+	}
+
+	selected := make([]FileDetails, 0)
+	seen := make(map[string]bool)
+	var missing []string
+	for _, name := range names {
+		entry, ok := byName[name]
+		if !ok {
+			missing = append(missing, name)
+			continue
+		}
+		if !seen[name] {
+			seen[name] = true
+			selected = append(selected, entry)
+		}
+	}
+	if prefix != "" {
+		for _, entry := range entries {
+			if strings.HasPrefix(entry.Filename, prefix) && !seen[entry.Filename] {
+				seen[entry.Filename] = true
+				selected = append(selected, entry)
+			}
+		}
+	}
+	return selected, missing, nil
+}
+
+// bulkDownloadHandler streams a zip archive of the files selected by the repeated "filename" values
+// and/or the listing filters (prefix, glob, hash_prefix and the size and word count ranges), in the
+// order of the "sort" and "order" values. The archive is written straight to the response, nothing
+// is staged on disk. Its first entry is a manifest holding the FileDetails of every file.
+func bulkDownloadHandler(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		log.Println("Error parsing the form:", err)
+		respondError(w, http.StatusBadRequest, ErrCodeInvalidRequest, "Error parsing the form")
+		return
+	}
+
+	names := r.Form["filename"]
+	query, err := parseListQuery(r.Form, 0)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, ErrCodeInvalidRequest, err.Error())
+		return
+	}
+	if len(names) == 0 && !query.filtered() {
+		respondError(w, http.StatusBadRequest, ErrCodeMissingField, "either filename or a filter is required")
+		return
+	}
+
+	selected, missing, err := selectEntries(names, "")
+	if err != nil {
+		log.Println("Error getting all entries:", err)
+		respondError(w, http.StatusInternalServerError, ErrCodeInternal, "Error getting all entries")
+		return
+	}
+	// once streaming has started the status can no longer change, so validate everything up front
+	if len(missing) > 0 {
+		respondErrorDetails(w, http.StatusNotFound, ErrCodeNotFound, "record does not exist", missing)
+		return
+	}
+	selected, ok := restrictEntries(w, r, selected, names)
+	if !ok {
+		return
+	}
+	if query.filtered() {
+		page, ok := queryEntries(w, r, r.Form, 0)
+		if !ok {
+			return
+		}
+		seen := make(map[string]bool, len(selected))
+		for _, entry := range selected {
+			seen[entry.Filename] = true
+		}
+		for _, entry := range page.Items {
+			if !seen[entry.Filename] {
+				selected = append(selected, entry)
+			}
+		}
+	}
+	if len(selected) == 0 {
+		respondError(w, http.StatusNotFound, ErrCodeNotFound, "no record matches the filters")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", `attachment; filename="files.zip"`)
+	w.Header().Set(ManifestHeader, manifestName(selected))
+
+	err = writeZip(w, selected)
+	if err != nil {
+		// the headers are already sent, the client sees a truncated archive
+		log.Println("Error streaming the zip archive:", err)
+	}
+}
+
+// manifestName is the name of the manifest entry of an archive of entries: ManifestName, prefixed
+// with underscores until no file has that name.
+func manifestName(entries []FileDetails) string {
+	taken := make(map[string]bool, len(entries))
+	for _, entry := range entries {
+		taken[entry.Filename] = true
+	}
+	name := ManifestName
+	for taken[name] {
+		name = "_" + name
+	}
+	return name
+}
+
+// writeZip writes the manifest followed by the content of every given file as a zip archive to w.
+func writeZip(w io.Writer, entries []FileDetails) error {
+	archive := zip.NewWriter(w)
+
+	manifest, err := archive.Create(manifestName(entries))
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(manifest)
+	encoder.SetIndent("", "  ")
+	err = encoder.Encode(entries)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		err = addFileToZip(archive, entry.Filename)
+		if err != nil {
+			return err
+		}
+	}
+	return archive.Close()
+}
+
+func addFileToZip(archive *zip.Writer, filename string) error {
+	filePath, err := getFileStorePath(filename)
+	if err != nil {
+		return err
+	}
+	file, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer CloseFile(file)
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	header, err := zip.FileInfoHeader(info)
+	if err != nil {
+		return err
+	}
+	header.Name = filename
+	header.Method = zip.Deflate
+
+	dst, err := archive.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, file)
+	return err
+}
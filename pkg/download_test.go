@@ -0,0 +1,124 @@
+package pkg
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestBulkDownloadHandler(t *testing.T) {
+	teardown := fileStoreSetup(t)
+	defer teardown()
+
+	req, err := http.NewRequest("GET", "/api/v1/download/zip?"+url.Values{"filename": {TestFileName}}.Encode(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	bulkDownloadHandler(rr, req)
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+
+	reader, err := zip.NewReader(bytes.NewReader(rr.Body.Bytes()), int64(rr.Body.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reader.File) != 2 || reader.File[0].Name != ManifestName || reader.File[1].Name != TestFileName {
+		t.Fatalf("Unexpected archive entries: %v", reader.File)
+	}
+
+	manifest, err := reader.File[0].Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var entries []FileDetails
+	err = json.NewDecoder(manifest).Decode(&entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Filename != TestFileName {
+		t.Errorf("Unexpected manifest: %+v", entries)
+	}
+
+	content, err := reader.File[1].Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if int64(len(data)) != entries[0].FileSize {
+		t.Errorf("Expected %d bytes, got %d", entries[0].FileSize, len(data))
+	}
+}
+
+func TestBulkDownloadHandlerMissingFile(t *testing.T) {
+	teardown := fileStoreSetup(t)
+	defer teardown()
+
+	req, err := http.NewRequest("GET", "/api/v1/download/zip?filename=invalid.txt&prefix=test", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	bulkDownloadHandler(rr, req)
+
+	if status := rr.Code; status != http.StatusNotFound {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusNotFound)
+	}
+}
+
+func TestBulkDownloadHandlerFilters(t *testing.T) {
+	teardown := searchSetup(t)
+	defer teardown()
+	if _, err := storeFile(ManifestName, strings.NewReader(`{"not":"the manifest"}`), StoreOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	values := url.Values{"glob": {"*.txt"}, "min_words": {"9"}, "filename": {ManifestName}}
+	req, err := http.NewRequest("GET", "/api/v1/download/zip?"+values.Encode(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	bulkDownloadHandler(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v: %s", rr.Code, http.StatusOK, rr.Body)
+	}
+	if name := rr.Header().Get(ManifestHeader); name != "_"+ManifestName {
+		t.Errorf("Expected the manifest to be renamed, got %s", name)
+	}
+
+	reader, err := zip.NewReader(bytes.NewReader(rr.Body.Bytes()), int64(rr.Body.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, file := range reader.File {
+		names = append(names, file.Name)
+	}
+	// the named file first, then the filtered ones; dog.txt and other.txt have only 8 words
+	expected := []string{"_" + ManifestName, ManifestName, "fox.txt"}
+	if strings.Join(names, ",") != strings.Join(expected, ",") {
+		t.Errorf("Expected the entries %v, got %v", expected, names)
+	}
+
+	req, err = http.NewRequest("GET", "/api/v1/download/zip?min_size=x", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr = httptest.NewRecorder()
+	bulkDownloadHandler(rr, req)
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected an invalid filter to be refused, got %v", rr.Code)
+	}
+}
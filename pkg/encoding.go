@@ -0,0 +1,300 @@
+package pkg
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// The character encodings recorded for text files.
+const (
+	EncodingUTF8    = "utf-8"
+	EncodingUTF16LE = "utf-16le"
+	EncodingUTF16BE = "utf-16be"
+	EncodingLatin1  = "iso-8859-1"
+)
+
+const (
+	// encodingSniffLength is the number of leading bytes the encoding of a file is detected from.
+	encodingSniffLength = 64 << 10
+	// minUTF16Units is the number of code units needed to recognise UTF-16 without byte order mark.
+	minUTF16Units = 4
+)
+
+var (
+	bomUTF8    = []byte{0xEF, 0xBB, 0xBF}
+	bomUTF16LE = []byte{0xFF, 0xFE}
+	bomUTF16BE = []byte{0xFE, 0xFF}
+)
+
+// detectEncoding guesses the encoding of text from its first bytes: a byte order mark decides,
+// otherwise UTF-16 is recognised by the zero bytes of its ASCII characters, then anything that is
+// not valid UTF-8 is taken for Latin-1.
+func detectEncoding(sample []byte) string {
+	switch {
+	case bytes.HasPrefix(sample, bomUTF8):
+		return EncodingUTF8
+	case bytes.HasPrefix(sample, bomUTF16LE):
+		return EncodingUTF16LE
+	case bytes.HasPrefix(sample, bomUTF16BE):
+		return EncodingUTF16BE
+	}
+
+	pairs, evenZeros, oddZeros := len(sample)/2, 0, 0
+	for i := 0; i+1 < len(sample); i += 2 {
+		if sample[i] == 0 {
+			evenZeros++
+		}
+		if sample[i+1] == 0 {
+			oddZeros++
+		}
+	}
+	// at least 40% of the code units have a zero byte on one side and hardly any on the other; a few
+	// bytes are too little to tell
+	if pairs >= minUTF16Units && oddZeros*10 >= pairs*4 && evenZeros*10 < pairs {
+		return EncodingUTF16LE
+	}
+	if pairs >= minUTF16Units && evenZeros*10 >= pairs*4 && oddZeros*10 < pairs {
+		return EncodingUTF16BE
+	}
+
+	// a sample cut from a longer file may end in the middle of a character
+	end := len(sample)
+	for i := end - 1; end == encodingSniffLength && i >= end-utf8.UTFMax; i-- {
+		if utf8.RuneStart(sample[i]) {
+			if !utf8.FullRune(sample[i:]) {
+				end = i
+			}
+			break
+		}
+	}
+	if utf8.Valid(sample[:end]) {
+		return EncodingUTF8
+	}
+	return EncodingLatin1
+}
+
+// sniffEncoding detects the encoding of the file at path.
+func sniffEncoding(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer CloseFile(file)
+
+	sample, err := io.ReadAll(io.LimitReader(file, encodingSniffLength))
+	if err != nil {
+		return "", err
+	}
+	return detectEncoding(sample), nil
+}
+
+// decodingReader converts text read with decode to UTF-8.
+type decodingReader struct {
+	src     *bufio.Reader
+	decode  func(src *bufio.Reader) (rune, error)
+	pending []byte
+}
+
+func (d *decodingReader) Read(p []byte) (int, error) {
+	n := 0
+	for n < len(p) {
+		if len(d.pending) > 0 {
+			copied := copy(p[n:], d.pending)
+			d.pending = d.pending[copied:]
+			n += copied
+			continue
+		}
+		r, err := d.decode(d.src)
+		if err != nil {
+			if n > 0 {
+				return n, nil
+			}
+			return 0, err
+		}
+		d.pending = utf8.AppendRune(d.pending[:0], r)
+	}
+	return n, nil
+}
+
+func decodeLatin1(src *bufio.Reader) (rune, error) {
+	b, err := src.ReadByte()
+	return rune(b), err
+}
+
+func utf16Decoder(order binary.ByteOrder) func(src *bufio.Reader) (rune, error) {
+	unit := func(src *bufio.Reader) (uint16, error) {
+		var buffer [2]byte
+		_, err := io.ReadFull(src, buffer[:])
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			// a dangling odd byte at the end is dropped
+			err = io.EOF
+		}
+		return order.Uint16(buffer[:]), err
+	}
+	return func(src *bufio.Reader) (rune, error) {
+		first, err := unit(src)
+		if err != nil {
+			return 0, err
+		}
+		if !utf16.IsSurrogate(rune(first)) {
+			return rune(first), nil
+		}
+		second, err := unit(src)
+		if err != nil {
+			return utf8.RuneError, nil
+		}
+		return utf16.DecodeRune(rune(first), rune(second)), nil
+	}
+}
+
+// newDecoder returns a reader of the text of r, in the given encoding, as UTF-8 without byte order mark.
+func newDecoder(r io.Reader, encoding string) io.Reader {
+	src := bufio.NewReader(r)
+	skipPrefix := func(prefix []byte) {
+		if start, _ := src.Peek(len(prefix)); bytes.Equal(start, prefix) {
+			_, _ = src.Discard(len(prefix))
+		}
+	}
+	switch encoding {
+	case EncodingUTF16LE:
+		skipPrefix(bomUTF16LE)
+		return &decodingReader{src: src, decode: utf16Decoder(binary.LittleEndian)}
+	case EncodingUTF16BE:
+		skipPrefix(bomUTF16BE)
+		return &decodingReader{src: src, decode: utf16Decoder(binary.BigEndian)}
+	case EncodingLatin1:
+		return &decodingReader{src: src, decode: decodeLatin1}
+	}
+	skipPrefix(bomUTF8)
+	return src
+}
+
+// decodedFile is an open file whose content is read as UTF-8.
+type decodedFile struct {
+	io.Reader
+	file     *os.File
+	Encoding string
+}
+
+func (f *decodedFile) Close() error {
+	return f.file.Close()
+}
+
+// openDecoded opens the file at path for reading its text as UTF-8, whatever its detected encoding.
+func openDecoded(path string) (*decodedFile, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	src := bufio.NewReaderSize(file, encodingSniffLength)
+	sample, err := src.Peek(encodingSniffLength)
+	if err != nil && !errors.Is(err, io.EOF) {
+		CloseFile(file)
+		return nil, err
+	}
+	encoding := detectEncoding(sample)
+	return &decodedFile{Reader: newDecoder(src, encoding), file: file, Encoding: encoding}, nil
+}
+
+// normalizedCopyPath returns the path of the UTF-8 copy kept of a stored file.
+func normalizedCopyPath(filename string) (string, error) {
+	return RecordStorePath(filepath.Join("utf8", filename))
+}
+
+// writeNormalizedCopy stores the text of a stored file converted to UTF-8 next to the records.
+func writeNormalizedCopy(filename string) error {
+	filePath, err := getFileStorePath(filename)
+	if err != nil {
+		return err
+	}
+	copyPath, err := normalizedCopyPath(filename)
+	if err != nil {
+		return err
+	}
+	src, err := openDecoded(filePath)
+	if err != nil {
+		return err
+	}
+	defer CloseFile(src)
+
+	err = os.MkdirAll(filepath.Dir(copyPath), 0755)
+	if err != nil {
+		return err
+	}
+	dst, err := os.Create(copyPath)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, src)
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// normalizedCopies removes and renames the UTF-8 copies along with the records they belong to.
+type normalizedCopies struct{}
+
+func init() {
+	registerRecordListener(normalizedCopies{})
+}
+
+func (normalizedCopies) remove(filename string) {
+	copyPath, err := normalizedCopyPath(filename)
+	if err != nil {
+		return
+	}
+	err = os.Remove(copyPath)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Println("Error removing the UTF-8 copy of", filename, err)
+	}
+}
+
+// RecordStored drops the copy of a replaced file; storing with normalization writes a new one.
+func (c normalizedCopies) RecordStored(details FileDetails) {
+	c.remove(details.Filename)
+}
+
+func (c normalizedCopies) RecordDeleted(filename string) {
+	c.remove(filename)
+}
+
+func (normalizedCopies) RecordRenamed(oldName string, details FileDetails) {
+	oldPath, err := normalizedCopyPath(oldName)
+	if err != nil {
+		return
+	}
+	newPath, err := normalizedCopyPath(details.Filename)
+	if err != nil || oldPath == newPath {
+		return
+	}
+	if _, err := os.Stat(oldPath); err != nil {
+		return
+	}
+	err = os.MkdirAll(filepath.Dir(newPath), 0755)
+	if err == nil {
+		err = os.Rename(oldPath, newPath)
+	}
+	if err != nil {
+		log.Println("Error renaming the UTF-8 copy of", oldName, err)
+	}
+}
+
+func (normalizedCopies) RecordsCleared() {
+	dir, err := RecordStorePath("utf8")
+	if err != nil {
+		return
+	}
+	err = os.RemoveAll(dir)
+	if err != nil {
+		log.Println("Error removing the UTF-8 copies:", err)
+	}
+}
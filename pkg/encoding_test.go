@@ -0,0 +1,127 @@
+package pkg
+
+import (
+	"encoding/binary"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"unicode/utf16"
+)
+
+// encodeUTF16 returns text in UTF-16 of the given byte order, without byte order mark.
+func encodeUTF16(text string, order binary.ByteOrder) string {
+	units := utf16.Encode([]rune(text))
+	encoded := make([]byte, 2*len(units))
+	for i, unit := range units {
+		order.PutUint16(encoded[2*i:], unit)
+	}
+	return string(encoded)
+}
+
+func TestDetectEncoding(t *testing.T) {
+	for _, test := range []struct {
+		sample   string
+		expected string
+	}{
+		{"plain ascii", EncodingUTF8},
+		{"\xEF\xBB\xBFwith bom", EncodingUTF8},
+		{"caf\xc3\xa9", EncodingUTF8},
+		{strings.Repeat("x", encodingSniffLength-1) + "\xc3", EncodingUTF8},
+		{"ends with a broken \xc3", EncodingLatin1},
+		{"caf\xe9 cr\xe8me", EncodingLatin1},
+		{"\xFF\xFEh\x00i\x00", EncodingUTF16LE},
+		{"\xFE\xFF\x00h\x00i", EncodingUTF16BE},
+		{encodeUTF16("no byte order mark", binary.LittleEndian), EncodingUTF16LE},
+		{encodeUTF16("no byte order mark", binary.BigEndian), EncodingUTF16BE},
+		{"PNG\x00\x01", EncodingUTF8},
+	} {
+		if result := detectEncoding([]byte(test.sample)); result != test.expected {
+			t.Errorf("%q: expected %s, got %s", test.sample, test.expected, result)
+		}
+	}
+}
+
+func TestEncodedFilesAnalytics(t *testing.T) {
+	teardown := searchSetup(t)
+	defer teardown()
+
+	files := []struct {
+		name, content, encoding string
+	}{
+		{"windows.txt", "\xFF\xFE" + encodeUTF16("Grüße aus Köln, lazy Köln", binary.LittleEndian), EncodingUTF16LE},
+		{"partner.txt", encodeUTF16("Köln and more Köln", binary.BigEndian), EncodingUTF16BE},
+		{"latin.txt", "caf\xe9 au lait, K\xf6ln", EncodingLatin1},
+	}
+	for _, file := range files {
+		details, err := storeFile(file.name, strings.NewReader(file.content), StoreOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if details.Encoding != file.encoding || details.ContentType != "text/plain" {
+			t.Errorf("%s: expected text/plain in %s, got %+v", file.name, file.encoding, details)
+		}
+	}
+
+	record, err := findByName("windows.txt")
+	if err != nil || record == nil || record.Encoding != EncodingUTF16LE || record.WordCount != 5 {
+		t.Fatalf("Expected the encoding and the word count to be recorded, got %+v %v", record, err)
+	}
+	counts := frequencyMap(frequencyIndex.Query(FrequencyQuery{NoOfWords: 100, MostFrequent: true}))
+	if counts["köln"] != 5 || counts["café"] != 1 || counts["grüße"] != 1 {
+		t.Errorf("Expected the decoded words to be counted, got %v", counts)
+	}
+	if hits := runSearch(t, "köln"); hits["windows.txt"] != 2 || hits["partner.txt"] != 2 || hits["latin.txt"] != 1 {
+		t.Errorf("Expected the decoded words to be searchable, got %v", hits)
+	}
+}
+
+func TestNormalizedCopy(t *testing.T) {
+	teardown := searchSetup(t)
+	defer teardown()
+
+	content := encodeUTF16("Grüße aus Köln", binary.LittleEndian)
+	_, err := storeFile("windows.txt", strings.NewReader(content), StoreOptions{NormalizeEncoding: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	copyPath, err := normalizedCopyPath("windows.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	normalized, err := os.ReadFile(copyPath)
+	if err != nil || string(normalized) != "Grüße aus Köln" {
+		t.Fatalf("Expected a UTF-8 copy, got %q %v", normalized, err)
+	}
+
+	rr := httptest.NewRecorder()
+	filesV2Handler(rr, httptest.NewRequest("GET", FilesV2Prefix+"windows.txt?encoding=utf-8", nil))
+	if rr.Body.String() != "Grüße aus Köln" || rr.Header().Get("Content-Type") != "text/plain; charset=utf-8" {
+		t.Errorf("Expected the UTF-8 copy, got %q %q", rr.Body.String(), rr.Header().Get("Content-Type"))
+	}
+	rr = httptest.NewRecorder()
+	filesV2Handler(rr, httptest.NewRequest("GET", FilesV2Prefix+"windows.txt", nil))
+	if rr.Body.String() != content || rr.Header().Get("X-File-Encoding") != EncodingUTF16LE {
+		t.Errorf("Expected the stored content, got %q", rr.Body.String())
+	}
+
+	err = removeStoredFile("windows.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(copyPath); !os.IsNotExist(err) {
+		t.Errorf("Expected the copy to be removed with the record, got %v", err)
+	}
+
+	// without a copy the text is converted while it is sent
+	_, err = storeFile("partner.txt", strings.NewReader("caf\xe9"), StoreOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr = httptest.NewRecorder()
+	filesV2Handler(rr, httptest.NewRequest("GET", FilesV2Prefix+"partner.txt?encoding=utf-8", nil))
+	if rr.Code != http.StatusOK || rr.Body.String() != "café" {
+		t.Errorf("Expected the converted text, got %d %q", rr.Code, rr.Body.String())
+	}
+}
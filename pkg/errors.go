@@ -0,0 +1,77 @@
+package pkg
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+)
+
+// Machine-readable error codes carried by every error response. They are part of the API contract
+// documented in api-specs.yaml, so existing codes must never change meaning.
+const (
+	ErrCodeInvalidRequest       = "invalid_request"
+	ErrCodeMissingField         = "missing_field"
+	ErrCodeNotFound             = "not_found"
+	ErrCodeAlreadyExists        = "already_exists"
+	ErrCodeMethodNotAllowed     = "method_not_allowed"
+	ErrCodeUnsupportedMediaType = "unsupported_media_type"
+	ErrCodeUnauthorized         = "unauthorized"
+	ErrCodeForbidden            = "forbidden"
+	ErrCodeRateLimited          = "rate_limited"
+	ErrCodeInternal             = "internal_error"
+)
+
+// RequestIDHeader carries the id of a request; it is echoed in error responses as request_id.
+const RequestIDHeader = "X-Request-ID"
+
+// APIError is the JSON envelope of every error response.
+type APIError struct {
+	Code      string      `json:"code"`
+	Message   string      `json:"message"`
+	Details   interface{} `json:"details,omitempty"`
+	RequestID string      `json:"request_id,omitempty"`
+}
+
+// respondError writes an APIError with the given status, code and message.
+func respondError(w http.ResponseWriter, status int, code string, message string) {
+	respondErrorDetails(w, status, code, message, nil)
+}
+
+// respondErrorDetails writes an APIError carrying additional details, e.g. the names that were not found.
+// The request id is taken from the response headers set by withRequestID.
+func respondErrorDetails(w http.ResponseWriter, status int, code string, message string, details interface{}) {
+	apiError := APIError{Code: code, Message: message, Details: details, RequestID: w.Header().Get(RequestIDHeader)}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	err := json.NewEncoder(w).Encode(apiError)
+	if err != nil {
+		log.Println("Error encoding the error response:", err)
+	}
+}
+
+// withRequestID makes sure every request carries an id, reusing the one sent by the client or a
+// proxy, and returns it in the response headers so that it can be correlated with the logs.
+func withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(RequestIDHeader)
+		if id == "" || len(id) > 128 {
+			id = newRequestID()
+			r.Header.Set(RequestIDHeader, id)
+		}
+		w.Header().Set(RequestIDHeader, id)
+		next.ServeHTTP(w, r)
+	})
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		log.Println("Error generating a request id:", err)
+	}
+	return hex.EncodeToString(b)
+}
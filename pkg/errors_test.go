@@ -0,0 +1,50 @@
+package pkg
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRespondErrorWithRequestID(t *testing.T) {
+	handler := withRequestID(http.HandlerFunc(storeHandler))
+
+	// a body that is not multipart must be rejected as a client error
+	req := httptest.NewRequest("POST", "/api/v1/store", strings.NewReader("not a form"))
+	req.Header.Set(RequestIDHeader, "test-request")
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusBadRequest {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusBadRequest)
+	}
+	if contentType := rr.Header().Get("Content-Type"); contentType != "application/json" {
+		t.Errorf("Unexpected content type: %s", contentType)
+	}
+
+	var apiError APIError
+	err := json.Unmarshal(rr.Body.Bytes(), &apiError)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if apiError.Code != ErrCodeInvalidRequest || apiError.RequestID != "test-request" {
+		t.Errorf("Unexpected error envelope: %+v", apiError)
+	}
+}
+
+func TestWithRequestIDGeneratesID(t *testing.T) {
+	var seen string
+	handler := withRequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = r.Header.Get(RequestIDHeader)
+	}))
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", "/api/v1/list", nil))
+
+	if seen == "" || rr.Header().Get(RequestIDHeader) != seen {
+		t.Errorf("Expected a generated request id in the request and response, got %q and %q",
+			seen, rr.Header().Get(RequestIDHeader))
+	}
+}
@@ -0,0 +1,250 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"log"
+	"sync"
+)
+
+var FrequencyIndexLocation string = func() string {
+	path, err := RecordStorePath("frequencyIndex.json")
+	if err != nil {
+		log.Fatal(err)
+	}
+	return path
+}()
+
+// frequencyIndex holds the word counts of every stored file and their totals, so that frequency
+// queries no longer re-read the whole store. It follows the record store through the RecordListener
+// hooks and is persisted next to the CSV records.
+var frequencyIndex = &FrequencyIndex{}
+
+func init() {
+	frequencyIndex.saver = newDeferredSave(FrequencyIndexLocation, frequencyIndex, &frequencyIndex.mu)
+	registerRecordListener(frequencyIndex)
+}
+
+// FrequencyIndex keeps per-file word counts, computed once at ingest time, and the store-wide totals.
+type FrequencyIndex struct {
+	mu     sync.RWMutex
+	loaded bool
+	saver  *deferredSave
+
+	// Files maps filename -> word -> count.
+	Files map[string]map[string]int `json:"files"`
+	// Totals maps word -> count over every file; it is adjusted with each file added or removed.
+	Totals map[string]int `json:"totals"`
+	// Documents maps word -> number of files containing it, adjusted like Totals.
+	Documents map[string]int `json:"documents"`
+	// Tokenizer is the name of the tokenizer the counts were computed with.
+	Tokenizer string `json:"tokenizer"`
+}
+
+// scanWordFrequencies bypasses the index and recounts the files of the store covered by the query
+// with the configured number of workers.
+func scanWordFrequencies(ctx context.Context, q FrequencyQuery) (Frequencies, error) {
+	config, err := GetConfig()
+	if err != nil {
+		return nil, err
+	}
+	match, err := q.fileMatcher()
+	if err != nil {
+		return nil, err
+	}
+	wordCounts, err := countWordsMatching(ctx, config.FileStore, config.FrequencyWorkers, match)
+	if err != nil {
+		return nil, err
+	}
+	return q.apply(wordCounts), nil
+}
+
+// countTermsInFile counts the words of a stored file the way CountWordsFrequencyParallel does.
+func countTermsInFile(filename string) (map[string]int, error) {
+	filePath, err := getFileStorePath(filename)
+	if err != nil {
+		return nil, err
+	}
+	counts := make(map[string]int)
+	err = countFileWords(context.Background(), filePath, configuredTokenizer(), counts)
+	return counts, err
+}
+
+// storedContentTypes maps every stored file to its recorded content type.
+func storedContentTypes() map[string]string {
+	entries, err := getAllEntries()
+	if err != nil {
+		log.Println("Error getting all entries for their content types:", err)
+	}
+	contentTypes := make(map[string]string, len(entries))
+	for _, entry := range entries {
+		contentTypes[entry.Filename] = recordedContentType(entry)
+	}
+	return contentTypes
+}
+
+// ensureLoaded loads the persisted index, or rebuilds it from the stored files if there is none or
+// if it was built with another tokenizer than the configured one. The caller must hold the write lock.
+func (idx *FrequencyIndex) ensureLoaded() {
+	tokenizer := configuredTokenizer().Name()
+	if idx.loaded && idx.Tokenizer == tokenizer {
+		return
+	}
+	reload := !idx.loaded
+	idx.loaded = true
+	idx.reset()
+
+	if reload {
+		err := loadJSON(FrequencyIndexLocation, idx)
+		if err == nil && idx.Tokenizer == tokenizer {
+			if idx.Documents == nil {
+				// persisted before the document counts were kept
+				idx.countDocuments()
+			}
+			return
+		}
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			log.Println("Error reading the frequency index, rebuilding it:", err)
+		}
+	}
+
+	idx.reset()
+	idx.Tokenizer = tokenizer
+	entries, err := getAllEntries()
+	if err != nil {
+		log.Println("Error getting all entries to rebuild the frequency index:", err)
+		return
+	}
+	for _, entry := range entries {
+		idx.add(entry.Filename)
+	}
+	idx.save()
+}
+
+func (idx *FrequencyIndex) reset() {
+	idx.Files = make(map[string]map[string]int)
+	idx.Totals = make(map[string]int)
+	idx.Documents = make(map[string]int)
+}
+
+// countDocuments recomputes the document counts from the per-file counts. The caller must hold the
+// write lock.
+func (idx *FrequencyIndex) countDocuments() {
+	idx.Documents = make(map[string]int)
+	for _, counts := range idx.Files {
+		for word := range counts {
+			idx.Documents[word]++
+		}
+	}
+}
+
+// add (re-)counts a stored file and adds its counts to the totals. The caller must hold the write lock.
+func (idx *FrequencyIndex) add(filename string) {
+	counts, err := countTermsInFile(filename)
+	if err != nil {
+		log.Println("Error counting the words of the file", filename, err)
+		return
+	}
+	idx.remove(filename)
+
+	idx.Files[filename] = counts
+	for word, count := range counts {
+		idx.Totals[word] += count
+		idx.Documents[word]++
+	}
+}
+
+// remove subtracts the counts of a file from the totals. The caller must hold the write lock.
+func (idx *FrequencyIndex) remove(filename string) {
+	for word, count := range idx.Files[filename] {
+		idx.Totals[word] -= count
+		if idx.Totals[word] <= 0 {
+			delete(idx.Totals, word)
+		}
+		idx.Documents[word]--
+		if idx.Documents[word] <= 0 {
+			delete(idx.Documents, word)
+		}
+	}
+	delete(idx.Files, filename)
+}
+
+// save persists the index in the background. The caller must hold the write lock.
+func (idx *FrequencyIndex) save() {
+	idx.saver.schedule()
+}
+
+// Frequencies returns the no most or least frequent words over the whole store.
+func (idx *FrequencyIndex) Frequencies(no int, mostFrequent bool) Frequencies {
+	return idx.Query(FrequencyQuery{NoOfWords: no, MostFrequent: mostFrequent})
+}
+
+// Query answers a frequency query from the store-wide totals, or from the per-file counts of the
+// selected files when the query is restricted to some of them.
+func (idx *FrequencyIndex) Query(q FrequencyQuery) Frequencies {
+	idx.mu.Lock()
+	idx.ensureLoaded()
+	idx.mu.Unlock()
+
+	// queries only read the index, so they run concurrently
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	if !q.restricted() {
+		return q.apply(idx.Totals)
+	}
+
+	var contentTypes map[string]string
+	if len(q.ContentTypes) > 0 {
+		contentTypes = storedContentTypes()
+	}
+	wordCounts := make(map[string]int)
+	for filename, counts := range idx.Files {
+		if !q.matchesFile(filename, contentTypes[filename]) {
+			continue
+		}
+		for word, count := range counts {
+			wordCounts[word] += count
+		}
+	}
+	return q.apply(wordCounts)
+}
+
+func (idx *FrequencyIndex) RecordStored(details FileDetails) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.ensureLoaded()
+	idx.add(details.Filename)
+	idx.save()
+}
+
+func (idx *FrequencyIndex) RecordDeleted(filename string) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.ensureLoaded()
+	idx.remove(filename)
+	idx.save()
+}
+
+func (idx *FrequencyIndex) RecordRenamed(oldName string, details FileDetails) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.ensureLoaded()
+	counts, ok := idx.Files[oldName]
+	if !ok || oldName == details.Filename {
+		return
+	}
+	// the content did not change, so the totals stay the same
+	idx.Files[details.Filename] = counts
+	delete(idx.Files, oldName)
+	idx.save()
+}
+
+func (idx *FrequencyIndex) RecordsCleared() {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.loaded = true
+	idx.reset()
+	idx.Tokenizer = configuredTokenizer().Name()
+	idx.save()
+}
@@ -0,0 +1,72 @@
+package pkg
+
+import (
+	"context"
+	"testing"
+)
+
+func TestFrequencyIndexMatchesFullScan(t *testing.T) {
+	teardown := fileStoreSetup(t)
+	defer teardown()
+
+	directory, err := getFileStoreDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	indexed := frequencyIndex.Frequencies(5, true)
+	scanned, err := CountWordsFrequencyParallel(context.Background(), directory, 5, true, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(indexed) != 5 || len(scanned) != 5 {
+		t.Fatalf("Expected 5 results, got %d and %d", len(indexed), len(scanned))
+	}
+	for i := range indexed {
+		if indexed[i].Count != scanned[i].Count {
+			t.Errorf("Index and full scan disagree: %v vs %v", indexed, scanned)
+			break
+		}
+	}
+}
+
+func TestFrequencyIndexFollowsUpdates(t *testing.T) {
+	teardown := fileStoreSetup(t)
+	defer teardown()
+
+	frequencyIndex.mu.RLock()
+	the := frequencyIndex.Totals["the"]
+	frequencyIndex.mu.RUnlock()
+	if the == 0 {
+		t.Fatalf("Expected the test file to contain the word 'the'")
+	}
+
+	record, err := findByName(TestFileName)
+	if err != nil || record == nil {
+		t.Fatalf("Expected a record for %s: %v", TestFileName, err)
+	}
+	err = ManageFileUpdate(true, "copy.txt", *record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	frequencyIndex.mu.RLock()
+	doubled := frequencyIndex.Totals["the"]
+	documents := frequencyIndex.Documents["the"]
+	frequencyIndex.mu.RUnlock()
+	if doubled != 2*the || documents != 2 {
+		t.Errorf("Expected %d in 2 files after duplicating the file, got %d in %d", 2*the, doubled, documents)
+	}
+
+	err = removeStoredFile(TestFileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	frequencyIndex.mu.RLock()
+	remaining := frequencyIndex.Totals["the"]
+	documents = frequencyIndex.Documents["the"]
+	_, stale := frequencyIndex.Files[TestFileName]
+	frequencyIndex.mu.RUnlock()
+	if remaining != the || documents != 1 || stale {
+		t.Errorf("Expected %d after deleting the original, got %d (stale entry: %v)", the, remaining, stale)
+	}
+}
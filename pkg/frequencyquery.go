@@ -0,0 +1,287 @@
+package pkg
+
+import (
+	"errors"
+	"fmt"
+	"mime"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// englishStopwords is the built-in list selected with stopwords=english.
+var englishStopwords = []string{
+	"a", "about", "after", "all", "also", "an", "and", "any", "are", "as", "at", "be", "because",
+	"been", "but", "by", "can", "could", "did", "do", "does", "for", "from", "had", "has", "have",
+	"he", "her", "his", "how", "i", "if", "in", "into", "is", "it", "its", "me", "my", "no", "not",
+	"of", "on", "or", "our", "she", "so", "than", "that", "the", "their", "them", "then", "there",
+	"these", "they", "this", "to", "up", "was", "we", "were", "what", "when", "which", "who", "will",
+	"with", "would", "you", "your",
+}
+
+// FrequencyQuery holds the options of a word frequency request. Words are first normalized, then
+// dropped if they are stopwords, shorter than MinLength or rejected by the include/exclude
+// patterns; the remaining counts are sorted and a page of NoOfWords is returned from Offset.
+type FrequencyQuery struct {
+	NoOfWords    int
+	MostFrequent bool
+	Offset       int
+
+	// StripPunctuation trims leading and trailing punctuation and symbols, so "end." counts as "end".
+	StripPunctuation bool
+	// NormalizeUnicode drops combining marks and folds full-width forms to their ASCII equivalent.
+	NormalizeUnicode bool
+	MinLength        int
+	Stopwords        map[string]bool
+	Include          *regexp.Regexp
+	Exclude          *regexp.Regexp
+
+	// Filenames and Prefix restrict the counts to a subset of the stored files.
+	Filenames []string
+	Prefix    string
+	// ContentTypes restricts the counts to files of the given media types, e.g. "text/csv" or
+	// "text/*". Files that do not hold text are never counted.
+	ContentTypes []string
+	// Readable restricts the counts to the files the caller may read; nil covers every file.
+	Readable fileSet
+}
+
+// parseFrequencyQuery reads the frequency options from the request form values.
+func parseFrequencyQuery(values url.Values) (FrequencyQuery, error) {
+	var q FrequencyQuery
+	var err error
+
+	q.NoOfWords, err = strconv.Atoi(values.Get("noOfWords"))
+	if err != nil || q.NoOfWords < 0 {
+		return q, errors.New("Invalid noOfWords value")
+	}
+	q.MostFrequent, err = strconv.ParseBool(values.Get("mostFrequent"))
+	if err != nil {
+		return q, errors.New("Invalid mostFrequent value")
+	}
+	if q.Offset, err = parseNonNegative(values, "offset"); err != nil {
+		return q, err
+	}
+	if q.MinLength, err = parseNonNegative(values, "minLength"); err != nil {
+		return q, err
+	}
+	for _, name := range []string{"stripPunctuation", "normalizeUnicode"} {
+		if values.Get(name) == "" {
+			continue
+		}
+		enabled, err := strconv.ParseBool(values.Get(name))
+		if err != nil {
+			return q, fmt.Errorf("Invalid %s value", name)
+		}
+		if name == "stripPunctuation" {
+			q.StripPunctuation = enabled
+		} else {
+			q.NormalizeUnicode = enabled
+		}
+	}
+
+	for _, list := range values["stopwords"] {
+		for _, word := range strings.Split(list, ",") {
+			word = strings.ToLower(strings.TrimSpace(word))
+			if word == "" {
+				continue
+			}
+			if q.Stopwords == nil {
+				q.Stopwords = make(map[string]bool)
+			}
+			if word == "english" {
+				for _, stopword := range englishStopwords {
+					q.Stopwords[stopword] = true
+				}
+				continue
+			}
+			q.Stopwords[word] = true
+		}
+	}
+
+	if pattern := values.Get("include"); pattern != "" {
+		if q.Include, err = regexp.Compile(pattern); err != nil {
+			return q, errors.New("Invalid include pattern")
+		}
+	}
+	if pattern := values.Get("exclude"); pattern != "" {
+		if q.Exclude, err = regexp.Compile(pattern); err != nil {
+			return q, errors.New("Invalid exclude pattern")
+		}
+	}
+
+	for _, contentType := range values["contentType"] {
+		contentType = strings.ToLower(strings.TrimSpace(contentType))
+		if _, _, err := mime.ParseMediaType(contentType); err != nil || !strings.Contains(contentType, "/") {
+			return q, errors.New("Invalid contentType value")
+		}
+		q.ContentTypes = append(q.ContentTypes, contentType)
+	}
+
+	q.Filenames = values["filename"]
+	q.Prefix = values.Get("prefix")
+	return q, nil
+}
+
+func parseNonNegative(values url.Values, name string) (int, error) {
+	if values.Get(name) == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(values.Get(name))
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("Invalid %s value", name)
+	}
+	return n, nil
+}
+
+// restricted reports whether the query only covers a subset of the stored files.
+func (q FrequencyQuery) restricted() bool {
+	return len(q.Filenames) > 0 || q.Prefix != "" || len(q.ContentTypes) > 0 || q.Readable != nil
+}
+
+// fileMatcher returns a match function for countInDirectory accepting the recorded files covered
+// by the query; files without a record, such as the temporary files of uploads in progress, are
+// skipped. Content types are only looked up when the query is restricted to some types.
+func (q FrequencyQuery) fileMatcher() (func(path string) bool, error) {
+	entries, err := getAllEntries()
+	if err != nil {
+		return nil, err
+	}
+	recorded := make(map[string]FileDetails, len(entries))
+	for _, entry := range entries {
+		recorded[entry.Filename] = entry
+	}
+	return func(path string) bool {
+		entry, ok := recorded[path]
+		if !ok {
+			return false
+		}
+		contentType := ""
+		if len(q.ContentTypes) > 0 {
+			contentType = recordedContentType(entry)
+		}
+		return q.matchesFile(path, contentType)
+	}, nil
+}
+
+// matchesFile reports whether a stored file with the given content type is covered by the query.
+func (q FrequencyQuery) matchesFile(filename string, contentType string) bool {
+	if !q.Readable.contains(filename) {
+		return false
+	}
+	if len(q.ContentTypes) > 0 && !matchesContentType(contentType, q.ContentTypes) {
+		return false
+	}
+	if len(q.Filenames) == 0 && q.Prefix == "" {
+		return true
+	}
+	for _, name := range q.Filenames {
+		if name == filename {
+			return true
+		}
+	}
+	return q.Prefix != "" && strings.HasPrefix(filename, q.Prefix)
+}
+
+// normalize maps a counted word to the form it is reported under, or "" if nothing is left of it.
+func (q FrequencyQuery) normalize(word string) string {
+	if q.NormalizeUnicode {
+		word = normalizeUnicode(word)
+	}
+	if q.StripPunctuation {
+		word = strings.TrimFunc(word, func(r rune) bool {
+			return unicode.IsPunct(r) || unicode.IsSymbol(r)
+		})
+	}
+	return word
+}
+
+// normalizeUnicode removes combining marks, so that a decomposed "é" counts as "e", folds full-width
+// forms to ASCII and lower-cases the result. Precomposed letters are decomposed the same way with
+// precomposedLetters, as the standard library has no decomposition tables.
+func normalizeUnicode(word string) string {
+	var b strings.Builder
+	for _, r := range word {
+		switch {
+		case unicode.Is(unicode.Mn, r):
+			continue
+		case r >= 0xFF01 && r <= 0xFF5E:
+			r -= 0xFEE0
+		}
+		r = unicode.ToLower(r)
+		if base, ok := precomposedLetters[r]; ok {
+			r = base
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// precomposedLetters maps the lower-case letters of Latin-1 and Latin Extended-A that decompose
+// into a base letter and combining marks to that letter. Letters without a canonical
+// decomposition, such as "ø" or "ł", are kept.
+var precomposedLetters = func() map[rune]rune {
+	letters := make(map[rune]rune)
+	for base, precomposed := range map[rune]string{
+		'a': "àáâãäåāăą", 'c': "çćĉċč", 'd': "ď", 'e': "èéêëēĕėęě", 'g': "ĝğġģ", 'h': "ĥ",
+		'i': "ìíîïĩīĭį", 'j': "ĵ", 'k': "ķ", 'l': "ĺļľ", 'n': "ñńņň", 'o': "òóôõöōŏő", 'r': "ŕŗř",
+		's': "śŝşš", 't': "ţť", 'u': "ùúûüũūŭůűų", 'w': "ŵ", 'y': "ýÿŷ", 'z': "źżž",
+	} {
+		for _, letter := range precomposed {
+			letters[letter] = base
+		}
+	}
+	return letters
+}()
+
+// keep reports whether a normalized word passes the filters of the query.
+func (q FrequencyQuery) keep(word string) bool {
+	return q.keepWord(word) && q.matchesPatterns(word)
+}
+
+// keepWord reports whether a normalized word is neither a stopword nor too short.
+func (q FrequencyQuery) keepWord(word string) bool {
+	return word != "" && !q.Stopwords[word] && utf8.RuneCountInString(word) >= q.MinLength
+}
+
+// matchesPatterns reports whether text passes the include and exclude patterns.
+func (q FrequencyQuery) matchesPatterns(text string) bool {
+	if q.Include != nil && !q.Include.MatchString(text) {
+		return false
+	}
+	return q.Exclude == nil || !q.Exclude.MatchString(text)
+}
+
+// apply normalizes and filters the word counts and returns the requested page.
+func (q FrequencyQuery) apply(wordCounts map[string]int) Frequencies {
+	filtered := make(map[string]int, len(wordCounts))
+	for word, count := range wordCounts {
+		word = q.normalize(word)
+		if q.keep(word) {
+			filtered[word] += count
+		}
+	}
+	return selectFrequencies(filtered, q.NoOfWords, q.MostFrequent, q.Offset)
+}
+
+// selectFrequencies sorts the word counts and returns no words starting offset words from the most
+// or least frequent end. The page keeps the descending order in both cases.
+func selectFrequencies(wordCounts map[string]int, no int, mostFrequent bool, offset int) Frequencies {
+	// Convert the map into a slice for sorting
+	result := make(Frequencies, 0, len(wordCounts))
+	for word, count := range wordCounts {
+		result = append(result, Frequency{word, count})
+	}
+	sort.Sort(result)
+
+	start := min(offset, len(result))
+	end := min(start+no, len(result))
+	if mostFrequent {
+		return result[start:end]
+	}
+	return result[len(result)-end : len(result)-start]
+}
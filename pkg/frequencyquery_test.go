@@ -0,0 +1,179 @@
+package pkg
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func frequencyMap(result Frequencies) map[string]int {
+	counts := make(map[string]int)
+	for _, frequency := range result {
+		counts[frequency.Word] = frequency.Count
+	}
+	return counts
+}
+
+func TestSelectFrequenciesPages(t *testing.T) {
+	counts := map[string]int{"a": 5, "b": 4, "c": 3, "d": 2, "e": 1}
+
+	// fewer than 10 words used to be returned whole, whatever noOfWords was
+	if result := selectFrequencies(counts, 2, true, 0); len(result) != 2 || result[0].Word != "a" {
+		t.Errorf("Expected the top 2 words, got %v", result)
+	}
+	if result := selectFrequencies(counts, 2, true, 1); len(result) != 2 || result[0].Word != "b" {
+		t.Errorf("Expected b and c from offset 1, got %v", result)
+	}
+	if result := selectFrequencies(counts, 2, false, 0); len(result) != 2 || result[0].Word != "d" || result[1].Word != "e" {
+		t.Errorf("Expected d and e as the least frequent, got %v", result)
+	}
+	if result := selectFrequencies(counts, 2, false, 4); len(result) != 1 || result[0].Word != "a" {
+		t.Errorf("Expected only a at offset 4, got %v", result)
+	}
+	if result := selectFrequencies(counts, 2, true, 10); len(result) != 0 {
+		t.Errorf("Expected an empty page past the end, got %v", result)
+	}
+}
+
+func TestNormalizeUnicodeForms(t *testing.T) {
+	for _, word := range []string{"Caf\u00e9", "cafe\u0301", "ＣＡＦＥ", "CAF\u00c9"} {
+		if normalized := normalizeUnicode(word); normalized != "cafe" {
+			t.Errorf("Expected %q to be normalized to cafe, got %q", word, normalized)
+		}
+	}
+	if normalized := normalizeUnicode("\u0142\u00f8d\u017a"); normalized != "\u0142\u00f8dz" {
+		t.Errorf("Expected letters without a decomposition to be kept, got %q", normalized)
+	}
+
+	q, err := parseFrequencyQuery(url.Values{"noOfWords": {"5"}, "mostFrequent": {"true"}, "normalizeUnicode": {"true"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := frequencyMap(q.apply(map[string]int{"na\u00efve": 2, "nai\u0308ve": 3}))
+	if len(result) != 1 || result["naive"] != 5 {
+		t.Errorf("Expected the precomposed and decomposed forms to be counted together, got %v", result)
+	}
+}
+
+func TestFrequencyQueryFilters(t *testing.T) {
+	counts := map[string]int{"end.": 2, "end": 1, "(end)": 1, "the": 7, "a": 3, "ｆｏｘ": 1, "fox": 1,
+		"café": 1, "cafe": 1, "jumps": 2}
+
+	for query, expected := range map[string]map[string]int{
+		"noOfWords=20&mostFrequent=true&stripPunctuation=true": {"end": 4, "the": 7, "a": 3, "ｆｏｘ": 1,
+			"fox": 1, "café": 1, "cafe": 1, "jumps": 2},
+		"noOfWords=20&mostFrequent=true&normalizeUnicode=true&stopwords=english": {"end.": 2, "end": 1,
+			"(end)": 1, "fox": 2, "cafe": 2, "jumps": 2},
+		"noOfWords=20&mostFrequent=true&stripPunctuation=true&minLength=4":                  {"café": 1, "cafe": 1, "jumps": 2},
+		"noOfWords=20&mostFrequent=true&stopwords=the,jumps&stopwords=a&include=^[a-z]%2B$": {"end": 1, "fox": 1, "cafe": 1},
+		"noOfWords=20&mostFrequent=true&stripPunctuation=true&exclude=e":                    {"a": 3, "ｆｏｘ": 1, "fox": 1, "jumps": 2},
+	} {
+		values, err := url.ParseQuery(query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		q, err := parseFrequencyQuery(values)
+		if err != nil {
+			t.Fatalf("%s: %v", query, err)
+		}
+		result := frequencyMap(q.apply(counts))
+		if len(result) != len(expected) {
+			t.Errorf("%s: expected %v, got %v", query, expected, result)
+			continue
+		}
+		for word, count := range expected {
+			if result[word] != count {
+				t.Errorf("%s: expected %v, got %v", query, expected, result)
+				break
+			}
+		}
+	}
+
+	for _, query := range []string{"", "noOfWords=1", "noOfWords=-1&mostFrequent=true",
+		"noOfWords=1&mostFrequent=true&offset=x", "noOfWords=1&mostFrequent=true&minLength=-2",
+		"noOfWords=1&mostFrequent=true&include=(", "noOfWords=1&mostFrequent=true&stripPunctuation=maybe"} {
+		values, _ := url.ParseQuery(query)
+		if _, err := parseFrequencyQuery(values); err == nil {
+			t.Errorf("%q: expected an error", query)
+		}
+	}
+}
+
+func TestFrequencyQueryFileSubset(t *testing.T) {
+	teardown := searchSetup(t)
+	defer teardown()
+
+	q := FrequencyQuery{NoOfWords: 50, MostFrequent: true, StripPunctuation: true, Filenames: []string{"dog.txt"}}
+	indexed := frequencyMap(frequencyIndex.Query(q))
+	if indexed["dog"] != 2 || indexed["fox"] != 0 || indexed["the"] != 2 {
+		t.Errorf("Expected only the words of dog.txt, got %v", indexed)
+	}
+	scanned, err := scanWordFrequencies(context.Background(), q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(frequencyMap(scanned)) != len(indexed) {
+		t.Errorf("Index and scan disagree: %v vs %v", indexed, scanned)
+	}
+
+	q = FrequencyQuery{NoOfWords: 50, MostFrequent: true, Prefix: "o"}
+	if result := frequencyMap(frequencyIndex.Query(q)); result["nothing"] != 1 || result["dog"] != 0 {
+		t.Errorf("Expected only the words of other.txt, got %v", result)
+	}
+}
+
+func TestScanWordFrequenciesSkipsUnrecordedFiles(t *testing.T) {
+	teardown := searchSetup(t)
+	defer teardown()
+	dir, err := getFileStoreDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, ".upload-12345"), []byte("halfway uploaded"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	scanned, err := scanWordFrequencies(context.Background(), FrequencyQuery{NoOfWords: 50, MostFrequent: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if counts := frequencyMap(scanned); counts["halfway"] != 0 || counts["fox"] == 0 {
+		t.Errorf("Expected only the recorded files to be counted, got %v", counts)
+	}
+}
+
+func TestWordFrequencyHandlerOptions(t *testing.T) {
+	teardown := searchSetup(t)
+	defer teardown()
+
+	query := url.Values{"noOfWords": {"1"}, "mostFrequent": {"true"}, "stripPunctuation": {"true"},
+		"stopwords": {"english"}, "prefix": {"dog"}}
+	req := httptest.NewRequest("GET", "/api/v1/frequency?"+query.Encode(), nil)
+	rr := httptest.NewRecorder()
+	wordFrequencyHandler(rr, req)
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+	var result Frequencies
+	err := json.Unmarshal(rr.Body.Bytes(), &result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result) != 1 || result[0].Word != "dog" || result[0].Count != 2 {
+		t.Errorf("Expected dog twice, got %v", result)
+	}
+
+	req = httptest.NewRequest("GET", "/api/v1/frequency?noOfWords=1&mostFrequent=true&exclude=(", nil)
+	rr = httptest.NewRecorder()
+	wordFrequencyHandler(rr, req)
+	if rr.Code != http.StatusBadRequest || !strings.Contains(rr.Body.String(), ErrCodeInvalidRequest) {
+		t.Errorf("Expected an invalid_request error, got %d %s", rr.Code, rr.Body.String())
+	}
+}
@@ -0,0 +1,258 @@
+package pkg
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultGrepMaxMatches = 1000
+	maxGrepMaxMatches     = 10000
+	maxGrepContext        = 10
+	defaultGrepTimeout    = 10 * time.Second
+	maxGrepTimeout        = 60 * time.Second
+)
+
+// GrepMatch is a line matching the pattern, streamed as one JSON line of type "match".
+type GrepMatch struct {
+	Type     string   `json:"type"`
+	Filename string   `json:"filename"`
+	Line     int      `json:"line"`
+	Text     string   `json:"text"`
+	Before   []string `json:"before,omitempty"`
+	After    []string `json:"after,omitempty"`
+}
+
+// GrepSummary ends the stream as a JSON line of type "summary". Truncated is set when the match
+// limit was reached and TimedOut when the time limit was.
+type GrepSummary struct {
+	Type      string   `json:"type"`
+	Files     int      `json:"files"`
+	Matches   int      `json:"matches"`
+	Truncated bool     `json:"truncated"`
+	TimedOut  bool     `json:"timed_out"`
+	Skipped   []string `json:"skipped,omitempty"`
+}
+
+// GrepQuery holds the options of a grep request.
+type GrepQuery struct {
+	Pattern    *regexp.Regexp
+	Context    int
+	MaxMatches int
+	Timeout    time.Duration
+}
+
+var errMatchLimit = errors.New("match limit reached")
+
+// parseGrepQuery reads the grep options from the request form values.
+func parseGrepQuery(r *http.Request) (GrepQuery, error) {
+	q := GrepQuery{MaxMatches: defaultGrepMaxMatches, Timeout: defaultGrepTimeout}
+
+	pattern := r.FormValue("pattern")
+	if pattern == "" {
+		return q, errors.New("pattern is required")
+	}
+	if ignoreCase, _ := strconv.ParseBool(r.FormValue("ignoreCase")); ignoreCase {
+		pattern = "(?i)" + pattern
+	}
+	var err error
+	q.Pattern, err = regexp.Compile(pattern)
+	if err != nil {
+		return q, fmt.Errorf("Invalid pattern: %v", err)
+	}
+
+	if value := r.FormValue("context"); value != "" {
+		q.Context, err = strconv.Atoi(value)
+		if err != nil || q.Context < 0 || q.Context > maxGrepContext {
+			return q, fmt.Errorf("Invalid context value, expected 0 to %d", maxGrepContext)
+		}
+	}
+	if value := r.FormValue("maxMatches"); value != "" {
+		q.MaxMatches, err = strconv.Atoi(value)
+		if err != nil || q.MaxMatches < 1 || q.MaxMatches > maxGrepMaxMatches {
+			return q, fmt.Errorf("Invalid maxMatches value, expected 1 to %d", maxGrepMaxMatches)
+		}
+	}
+	if value := r.FormValue("timeout"); value != "" {
+		q.Timeout, err = time.ParseDuration(value)
+		if err != nil || q.Timeout <= 0 || q.Timeout > maxGrepTimeout {
+			return q, fmt.Errorf("Invalid timeout value, expected a duration up to %s", maxGrepTimeout)
+		}
+	}
+	return q, nil
+}
+
+// grepFile calls emit with every match of q in the file at path, in line order, each with up to
+// q.Context lines before and after it. It stops with errMatchLimit when emit reports the limit, or
+// with the context error when ctx is done.
+func grepFile(ctx context.Context, filename string, path string, q GrepQuery, emit func(GrepMatch) error) error {
+	file, err := openDecoded(path)
+	if err != nil {
+		return err
+	}
+	defer CloseFile(file)
+
+	var before []string
+	var pending []*GrepMatch
+	flush := func(all bool) error {
+		for len(pending) > 0 && (all || len(pending[0].After) == q.Context) {
+			if err := emit(*pending[0]); err != nil {
+				return err
+			}
+			pending = pending[1:]
+		}
+		return nil
+	}
+
+	scanner := newLineScanner(file)
+	for scanner.Scan() {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		line, text := scanner.Line(), scanner.Text()
+
+		for _, match := range pending {
+			match.After = append(match.After, text)
+		}
+		if err := flush(false); err != nil {
+			return err
+		}
+
+		if q.Pattern.MatchString(text) {
+			match := &GrepMatch{Type: "match", Filename: filename, Line: line, Text: text}
+			if len(before) > 0 {
+				match.Before = append([]string(nil), before...)
+			}
+			pending = append(pending, match)
+			if err := flush(false); err != nil {
+				return err
+			}
+		}
+
+		if q.Context > 0 {
+			if len(before) == q.Context {
+				before = before[1:]
+			}
+			before = append(before, text)
+		}
+	}
+	if err := flush(true); err != nil {
+		return err
+	}
+	return scanner.Err()
+}
+
+// grepHandler runs a regular expression over every stored file, or those selected by the repeated
+// "filename" values, "prefix" and "glob", and streams the matching lines as JSON lines
+// (application/x-ndjson) followed by a summary. Binary files are skipped.
+func grepHandler(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		log.Println("Error parsing the form:", err)
+		respondError(w, http.StatusBadRequest, ErrCodeInvalidRequest, "Error parsing the form")
+		return
+	}
+
+	q, err := parseGrepQuery(r)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, ErrCodeInvalidRequest, err.Error())
+		return
+	}
+	glob := r.FormValue("glob")
+	if _, err := path.Match(glob, ""); err != nil {
+		respondError(w, http.StatusBadRequest, ErrCodeInvalidRequest, "Invalid glob pattern")
+		return
+	}
+
+	var selected []FileDetails
+	var missing []string
+	names, prefix := r.Form["filename"], r.FormValue("prefix")
+	if len(names) == 0 && prefix == "" {
+		selected, err = getAllEntries()
+	} else {
+		selected, missing, err = selectEntries(names, prefix)
+	}
+	if err != nil {
+		log.Println("Error getting all entries:", err)
+		respondError(w, http.StatusInternalServerError, ErrCodeInternal, "Error getting all entries")
+		return
+	}
+	// once streaming has started the status can no longer change, so validate everything up front
+	if len(missing) > 0 {
+		respondErrorDetails(w, http.StatusNotFound, ErrCodeNotFound, "record does not exist", missing)
+		return
+	}
+	selected, ok := restrictEntries(w, r, selected, names)
+	if !ok {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), q.Timeout)
+	defer cancel()
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	encoder := json.NewEncoder(w)
+	flusher, _ := w.(http.Flusher)
+	summary := GrepSummary{Type: "summary"}
+
+	emit := func(match GrepMatch) error {
+		if summary.Matches == q.MaxMatches {
+			return errMatchLimit
+		}
+		summary.Matches++
+		if err := encoder.Encode(match); err != nil {
+			return err
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		return nil
+	}
+
+	for _, entry := range selected {
+		if glob != "" {
+			if matched, _ := path.Match(glob, entry.Filename); !matched {
+				continue
+			}
+		}
+		filePath, err := getFileStorePath(entry.Filename)
+		if err != nil {
+			log.Println("Error finding the path of the file:", err)
+			summary.Skipped = append(summary.Skipped, entry.Filename)
+			continue
+		}
+		text, err := isTextFile(filePath)
+		if err != nil || !text {
+			summary.Skipped = append(summary.Skipped, entry.Filename)
+			continue
+		}
+
+		summary.Files++
+		err = grepFile(ctx, entry.Filename, filePath, q, emit)
+		if errors.Is(err, errMatchLimit) {
+			summary.Truncated = true
+			break
+		}
+		if ctx.Err() != nil {
+			summary.TimedOut = errors.Is(ctx.Err(), context.DeadlineExceeded)
+			break
+		}
+		if err != nil {
+			log.Println("Error searching the file", entry.Filename, err)
+			summary.Skipped = append(summary.Skipped, entry.Filename)
+		}
+	}
+
+	err = encoder.Encode(summary)
+	if err != nil {
+		log.Println("Error writing response:", err)
+	}
+}
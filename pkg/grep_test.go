@@ -0,0 +1,126 @@
+package pkg
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// runGrep calls the grep handler and decodes the streamed matches and summary.
+func runGrep(t *testing.T, values url.Values) ([]GrepMatch, GrepSummary, int) {
+	rr := httptest.NewRecorder()
+	grepHandler(rr, httptest.NewRequest("GET", "/api/v1/grep?"+values.Encode(), nil))
+	if rr.Code != http.StatusOK {
+		return nil, GrepSummary{}, rr.Code
+	}
+
+	var matches []GrepMatch
+	var summary GrepSummary
+	scanner := bufio.NewScanner(rr.Body)
+	for scanner.Scan() {
+		if strings.Contains(scanner.Text(), `"type":"summary"`) {
+			if err := json.Unmarshal(scanner.Bytes(), &summary); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		var match GrepMatch
+		if err := json.Unmarshal(scanner.Bytes(), &match); err != nil {
+			t.Fatal(err)
+		}
+		matches = append(matches, match)
+	}
+	return matches, summary, rr.Code
+}
+
+func TestGrepHandler(t *testing.T) {
+	teardown := searchSetup(t)
+	defer teardown()
+	_, err := storeFile("image.bin", strings.NewReader("PNG\x00\x01lazy"), StoreOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	matches, summary, _ := runGrep(t, url.Values{"pattern": {`lazy \w+`}})
+	if len(matches) != 2 || summary.Matches != 2 || summary.Files != 3 || summary.Truncated {
+		t.Fatalf("Unexpected result: %+v %+v", matches, summary)
+	}
+	if !reflect.DeepEqual(summary.Skipped, []string{"image.bin"}) {
+		t.Errorf("Expected the binary file to be skipped, got %v", summary.Skipped)
+	}
+	for _, match := range matches {
+		if match.Line != 1 || match.Type != "match" {
+			t.Errorf("Expected matches on the first line, got %+v", match)
+		}
+	}
+
+	matches, _, _ = runGrep(t, url.Values{"pattern": {"FOX IS"}, "ignoreCase": {"true"}, "context": {"1"},
+		"filename": {"fox.txt"}})
+	if len(matches) != 1 || matches[0].Line != 2 || len(matches[0].Before) != 1 || len(matches[0].After) != 0 {
+		t.Errorf("Expected one match with a line of context before, got %+v", matches)
+	}
+
+	matches, summary, _ = runGrep(t, url.Values{"pattern": {"."}, "maxMatches": {"2"}})
+	if len(matches) != 2 || !summary.Truncated {
+		t.Errorf("Expected the match limit to truncate the output, got %+v %+v", matches, summary)
+	}
+
+	matches, _, _ = runGrep(t, url.Values{"pattern": {"quick"}, "glob": {"o*.txt"}})
+	if len(matches) != 1 || matches[0].Filename != "other.txt" {
+		t.Errorf("Expected only other.txt, got %+v", matches)
+	}
+
+	for _, values := range []url.Values{{}, {"pattern": {"("}}, {"pattern": {"a"}, "context": {"11"}},
+		{"pattern": {"a"}, "timeout": {"2m"}}} {
+		if _, _, code := runGrep(t, values); code != http.StatusBadRequest {
+			t.Errorf("%v: expected %d, got %d", values, http.StatusBadRequest, code)
+		}
+	}
+	if _, _, code := runGrep(t, url.Values{"pattern": {"a"}, "filename": {"missing.txt"}}); code != http.StatusNotFound {
+		t.Errorf("Expected %d for a missing file, got %d", http.StatusNotFound, code)
+	}
+}
+
+func TestGrepFileContext(t *testing.T) {
+	teardown := searchSetup(t)
+	defer teardown()
+	_, err := storeFile("lines.txt", strings.NewReader("a\nmatch 1\nb\nmatch 2\nc\nd\ne\n"), StoreOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	filePath, err := getFileStorePath("lines.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var matches []GrepMatch
+	q := GrepQuery{Pattern: regexp.MustCompile("match"), Context: 2, MaxMatches: 10}
+	err = grepFile(context.Background(), "lines.txt", filePath, q, func(match GrepMatch) error {
+		matches = append(matches, match)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []GrepMatch{
+		{Type: "match", Filename: "lines.txt", Line: 2, Text: "match 1", Before: []string{"a"}, After: []string{"b", "match 2"}},
+		{Type: "match", Filename: "lines.txt", Line: 4, Text: "match 2", Before: []string{"match 1", "b"}, After: []string{"c", "d"}},
+	}
+	if !reflect.DeepEqual(matches, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, matches)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = grepFile(ctx, "lines.txt", filePath, q, func(GrepMatch) error { return nil })
+	if err != context.Canceled {
+		t.Errorf("Expected context.Canceled, got %v", err)
+	}
+}
@@ -1,20 +1,34 @@
 package pkg
 
 import (
-	"bufio"
+	"context"
 	"crypto/md5"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"mime/multipart"
 	"net/http"
+	"net/url"
 	"os"
+	"path"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
 )
 
+// ErrFileExists is returned by storeFile when a record with the same name or the same content hash
+// is already present in the store.
+var ErrFileExists = errors.New("file already exists")
+
+// storeMutex serializes the changes of the file store: the checks for an existing name or hash
+// together with the move of the file into or out of the store and the update of its record.
+var storeMutex sync.Mutex
+
 // CloseFile closes the given file and logs an error if one occurs.
-func CloseFile(file *os.File) {
+func CloseFile(file io.Closer) {
 	err := file.Close()
 	if err != nil {
 		log.Printf("Error closing file: %v", err)
@@ -30,13 +44,15 @@ func CloseMultipartFile(file multipart.File) {
 }
 
 // checkErrorAndRespond is a helper function that checks if an error occurred (err is not nil).
-// If an error occurred, it logs the message and responds with the given code and message.
-func checkErrorAndRespond(err error, message string, code int, w http.ResponseWriter) {
+// If an error occurred, it logs the message and responds with an APIError of the given status and code.
+// It reports whether an error response was written.
+func checkErrorAndRespond(err error, message string, status int, code string, w http.ResponseWriter) bool {
 	if err != nil {
 		log.Println(message, err)
-		http.Error(w, message, code)
-		return
+		respondError(w, status, code, message)
+		return true
 	}
+	return false
 }
 
 func validateRequiredField(fieldName, fieldValue string) error {
@@ -94,13 +110,29 @@ func RecordStorePath(filename string) (string, error) {
 	return filepath.Join(config.RecordStore, filename), nil
 }
 
+// ManageFileUpdate renames the file of previousFileDetails to newFileName, or stores a copy under
+// newFileName when duplicate is true. ErrFileExists is returned if newFileName is already stored.
 func ManageFileUpdate(duplicate bool, newFileName string, previousFileDetails FileDetails) error {
+	storeMutex.Lock()
+	defer storeMutex.Unlock()
+	existing, err := findByName(newFileName)
+	if err != nil {
+		log.Println("Error finding file name:", err)
+		return err
+	}
+	if existing != nil {
+		return ErrFileExists
+	}
 
 	newFileDetails := FileDetails{
-		Filename:  newFileName,
-		FileSize:  previousFileDetails.FileSize,
-		FileHash:  previousFileDetails.FileHash,
-		WordCount: previousFileDetails.WordCount,
+		Filename:    newFileName,
+		FileSize:    previousFileDetails.FileSize,
+		FileHash:    previousFileDetails.FileHash,
+		WordCount:   previousFileDetails.WordCount,
+		Tags:        previousFileDetails.Tags,
+		ContentType: previousFileDetails.ContentType,
+		Encoding:    previousFileDetails.Encoding,
+		Owner:       previousFileDetails.Owner,
 	}
 
 	// if duplicate is true, then duplicate an existing file with the newFileName
@@ -120,7 +152,7 @@ func ManageFileUpdate(duplicate bool, newFileName string, previousFileDetails Fi
 	}
 
 	// if duplicate is false, then update the existing file with the newFileName
-	err := UpdateFileName(previousFileDetails.Filename, newFileName)
+	err = UpdateFileName(previousFileDetails.Filename, newFileName)
 	if err != nil {
 		return err
 	}
@@ -143,6 +175,11 @@ func UpdateFileName(prevFilename string, newName string) error {
 		return err
 	}
 
+	err = os.MkdirAll(filepath.Dir(newFile), 0755)
+	if err != nil {
+		return err
+	}
+
 	// Rename the file to the new name
 	err = os.Rename(previousFile, newFile)
 	if err != nil {
@@ -235,6 +272,293 @@ func deleteFile(filename string) error {
 	return nil
 }
 
+// StoreOptions holds the optional processing applied to a file as it is stored.
+type StoreOptions struct {
+	// Keywords is the number of TF-IDF keywords recorded as tags of the file, none when zero.
+	Keywords int
+	// NormalizeEncoding keeps a UTF-8 copy of text files stored in another encoding.
+	NormalizeEncoding bool
+	// Owner is recorded as the owner of a new file; a replaced file keeps its owner.
+	Owner string
+	// Readable are the files the keywords are scored against, every indexed file when nil.
+	Readable fileSet
+}
+
+// parseStoreOptions reads the store options from the request form values.
+func parseStoreOptions(values url.Values) (StoreOptions, error) {
+	var opts StoreOptions
+	if values.Get("keywords") != "" {
+		keywords, err := strconv.Atoi(values.Get("keywords"))
+		if err != nil || keywords < 0 || keywords > maxKeywords {
+			return opts, fmt.Errorf("Invalid keywords value, expected 0 to %d", maxKeywords)
+		}
+		opts.Keywords = keywords
+	}
+	if values.Get("normalizeEncoding") != "" {
+		normalize, err := strconv.ParseBool(values.Get("normalizeEncoding"))
+		if err != nil {
+			return opts, errors.New("Invalid normalizeEncoding value")
+		}
+		opts.NormalizeEncoding = normalize
+	}
+	return opts, nil
+}
+
+// requestStoreOptions reads the store options of r from values. The caller of r is recorded as the
+// owner and its keywords are scored against the files it may read. It responds with an error and
+// returns false if the options are invalid or the permissions cannot be read.
+func requestStoreOptions(w http.ResponseWriter, r *http.Request, values url.Values) (StoreOptions, bool) {
+	opts, err := parseStoreOptions(values)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, ErrCodeInvalidRequest, err.Error())
+		return opts, false
+	}
+	opts.Owner = ownerOf(r)
+	if opts.Keywords > 0 {
+		var ok bool
+		opts.Readable, ok = readableFiles(w, r)
+		if !ok {
+			return opts, false
+		}
+	}
+	return opts, true
+}
+
+// storeFile writes the content of src to the file store under fileName, computes its MD5 hash and
+// word count and appends the resulting details to the CSV record store.
+// The content is first written to a temporary file inside the store directory, so a rejected upload
+// never overwrites an existing file. ErrFileExists is returned if the name or the hash is already known.
+func storeFile(fileName string, src io.Reader, opts StoreOptions) (*FileDetails, error) {
+	existing, err := findByName(fileName)
+	if err != nil {
+		log.Println("Error finding file name:", err)
+		return nil, err
+	}
+	if existing != nil {
+		return nil, ErrFileExists
+	}
+	return writeStoreFile(fileName, src, nil, opts)
+}
+
+// replaceFile replaces the content of an existing record in place, recomputing its hash, size and
+// word count. ErrFileExists is returned if the new content duplicates a different stored file.
+// The tags of the previous content are dropped unless opts asks for new keywords.
+func replaceFile(previous FileDetails, src io.Reader, opts StoreOptions) (*FileDetails, error) {
+	return writeStoreFile(previous.Filename, src, &previous, opts)
+}
+
+// replaceFileAs is replaceFile storing the new content under another name, which must not be
+// stored yet; the previous file and record are removed once the new ones are in place.
+func replaceFileAs(previous FileDetails, fileName string, src io.Reader, opts StoreOptions) (*FileDetails, error) {
+	return writeStoreFile(fileName, src, &previous, opts)
+}
+
+// writeStoreFile is the common part of storeFile, replaceFile and replaceFileAs. previous is the
+// record being replaced, or nil when a new record is created.
+func writeStoreFile(fileName string, src io.Reader, previous *FileDetails, opts StoreOptions) (*FileDetails, error) {
+	dir, err := getFileStoreDir()
+	if err != nil {
+		return nil, err
+	}
+	tmp, err := os.CreateTemp(dir, ".upload-*")
+	if err != nil {
+		log.Println("Error creating the temporary file:", err)
+		return nil, err
+	}
+	tmpPath := tmp.Name()
+	// the temporary file is renamed on success, so removing it afterwards is a no-op
+	defer os.Remove(tmpPath)
+
+	size, err := io.Copy(tmp, src)
+	CloseFile(tmp)
+	if err != nil {
+		log.Println("Error copying the file:", err)
+		return nil, err
+	}
+
+	md5Hash, err := ComputeMD5Hash(tmpPath)
+	if err != nil {
+		log.Println("Error computing the MD5 hash:", err)
+		return nil, err
+	}
+
+	storeMutex.Lock()
+	defer storeMutex.Unlock()
+	if previous == nil || previous.Filename != fileName {
+		existing, err := findByName(fileName)
+		if err != nil {
+			log.Println("Error finding file name:", err)
+			return nil, err
+		}
+		if existing != nil {
+			return nil, ErrFileExists
+		}
+	}
+	entry, err := findByHash(md5Hash)
+	if err != nil {
+		log.Println("Error finding file hash:", err)
+		return nil, err
+	}
+	if entry != nil && (previous == nil || entry.Filename != previous.Filename) {
+		return nil, ErrFileExists
+	}
+
+	filePath, err := getFileStorePath(fileName)
+	if err != nil {
+		return nil, err
+	}
+	// names may contain directories, e.g. paths preserved from an archive
+	err = os.MkdirAll(filepath.Dir(filePath), 0755)
+	if err != nil {
+		log.Println("Error creating the directory:", err)
+		return nil, err
+	}
+	// the previous content is kept aside until the new record is written, to restore it on failure
+	backupPath := ""
+	if previous != nil && previous.Filename == fileName {
+		backupPath = tmpPath + ".previous"
+		err = os.Rename(filePath, backupPath)
+		if err != nil {
+			log.Println("Error keeping the previous content:", err)
+			return nil, err
+		}
+		defer os.Remove(backupPath)
+	}
+	err = os.Rename(tmpPath, filePath)
+	if err != nil {
+		log.Println("Error moving the file into the store:", err)
+		restoreStoreFile(filePath, backupPath)
+		return nil, err
+	}
+
+	details, err := recordStoreFile(fileName, filePath, md5Hash, size, previous, opts)
+	if err != nil {
+		restoreStoreFile(filePath, backupPath)
+		return nil, err
+	}
+	// the copy is written after the record, whose listeners drop the copy of the previous content
+	if opts.NormalizeEncoding && details.Encoding != "" && details.Encoding != EncodingUTF8 {
+		err = writeNormalizedCopy(fileName)
+		if err != nil {
+			log.Println("Error writing the UTF-8 copy:", err)
+			return nil, err
+		}
+	}
+	return details, nil
+}
+
+// restoreStoreFile undoes the move of a new file into the store whose record could not be written,
+// putting back the previous content kept at backupPath, if any.
+func restoreStoreFile(filePath string, backupPath string) {
+	var err error
+	if backupPath != "" {
+		err = os.Rename(backupPath, filePath)
+	} else {
+		err = os.Remove(filePath)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		log.Println("Error restoring the file store:", err)
+	}
+}
+
+// recordStoreFile sniffs the details of a file moved into the store and writes its record.
+func recordStoreFile(fileName string, filePath string, md5Hash string, size int64, previous *FileDetails,
+	opts StoreOptions) (*FileDetails, error) {
+
+	contentType, err := sniffContentType(filePath)
+	if err != nil {
+		log.Println("Error detecting the content type:", err)
+		return nil, err
+	}
+	wordCount, err := countWordsInFile(fileName)
+	if err != nil {
+		log.Println("Error counting words in the file:", err)
+		return nil, err
+	}
+
+	details := FileDetails{Filename: fileName, FileSize: size, FileHash: md5Hash, WordCount: wordCount,
+		ContentType: contentType, Owner: opts.Owner}
+	if previous != nil {
+		details.Owner = previous.Owner
+	}
+	if isTextContentType(contentType) {
+		details.Encoding, err = sniffEncoding(filePath)
+		if err != nil {
+			log.Println("Error detecting the encoding:", err)
+			return nil, err
+		}
+	}
+	if opts.Keywords > 0 && isTextContentType(contentType) {
+		keywords, err := keywordsOfStoredFile(fileName, opts.Keywords, opts.Readable)
+		if err != nil {
+			log.Println("Error extracting the keywords:", err)
+			return nil, err
+		}
+		for _, keyword := range keywords {
+			details.Tags = append(details.Tags, keyword.Word)
+		}
+	}
+	if previous != nil {
+		err = modifyRecordAndFile(*previous, details)
+	} else {
+		err = storeInCSV(details)
+	}
+	if err != nil {
+		log.Println("Error storing file details:", err)
+		return nil, err
+	}
+	return &details, nil
+}
+
+// cleanStoreName normalises a slash separated path coming from a client or an archive into a name
+// relative to the file store. Absolute paths and paths escaping the store are rejected.
+func cleanStoreName(name string) (string, error) {
+	name = strings.ReplaceAll(name, "\\", "/")
+	if path.IsAbs(name) || filepath.IsAbs(name) {
+		return "", fmt.Errorf("absolute path %s is not allowed", name)
+	}
+	cleaned := path.Clean(name)
+	if cleaned == "." || cleaned == ".." || strings.HasPrefix(cleaned, "../") {
+		return "", fmt.Errorf("path %s is outside of the file store", name)
+	}
+	return cleaned, nil
+}
+
+// removeStoredFile deletes both the record and the stored file of the given name.
+func removeStoredFile(filename string) error {
+	storeMutex.Lock()
+	defer storeMutex.Unlock()
+	err := deleteFromCSV(filename)
+	if err != nil {
+		return err
+	}
+	return deleteFile(filename)
+}
+
+// saveJSON encodes v to path through a temporary file, so that a crash never leaves a truncated
+// file behind.
+func saveJSON(path string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	err = os.WriteFile(tmp, data, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// loadJSON decodes the content of path into v.
+func loadJSON(path string, v interface{}) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
 func countWordsInFile(fileLocation string) (int, error) {
 
 	filePath, err := getFileStorePath(fileLocation)
@@ -242,24 +566,22 @@ func countWordsInFile(fileLocation string) (int, error) {
 		log.Println("Error finding the path of the file:", err)
 		return 0, err
 	}
-	file, err := os.Open(filePath)
+	if text, err := isTextFile(filePath); err != nil || !text {
+		return 0, err
+	}
+	file, err := openDecoded(filePath)
 	if err != nil {
 		return 0, err
 	}
 	defer CloseFile(file)
 
-	scanner := bufio.NewScanner(file)
-	scanner.Split(bufio.ScanLines)
-
+	// Count the words the way the frequency and search indexes see them
 	wordCount := 0
-	for scanner.Scan() {
-		line := scanner.Text()
-		words := strings.Fields(line)
-		wordCount += len(words)
-	}
-
-	if err := scanner.Err(); err != nil {
-		log.Fatal(err)
+	err = scanTokens(context.Background(), file, configuredTokenizer(), func(string) {
+		wordCount++
+	})
+	if err != nil {
+		return 0, err
 	}
 
 	return wordCount, nil
@@ -1,6 +1,10 @@
 package pkg
 
 import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
 	"testing"
 )
 
@@ -18,6 +22,78 @@ func TestComputeMD5Hash(t *testing.T) {
 	}
 }
 
+func TestConcurrentStoreAndRemove(t *testing.T) {
+	teardown := searchSetup(t)
+	defer teardown()
+
+	// every goroutine stores two files and removes one of them again, while the others rewrite the CSV
+	var wg sync.WaitGroup
+	errs := make(chan error, 60)
+	for i := 0; i < 30; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for _, name := range []string{fmt.Sprintf("kept-%d.txt", i), fmt.Sprintf("removed-%d.txt", i)} {
+				if _, err := storeFile(name, strings.NewReader("content of "+name), StoreOptions{}); err != nil {
+					errs <- err
+				}
+			}
+			if err := removeStoredFile(fmt.Sprintf("removed-%d.txt", i)); err != nil {
+				errs <- err
+			}
+		}(i)
+	}
+	// the same name stored concurrently must be stored exactly once
+	stored := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, err := storeFile("contended.txt", strings.NewReader(fmt.Sprintf("version %d", i)), StoreOptions{})
+			stored <- err
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	close(stored)
+	for err := range errs {
+		t.Error(err)
+	}
+	winners := 0
+	for err := range stored {
+		if err == nil {
+			winners++
+		} else if !errors.Is(err, ErrFileExists) {
+			t.Error(err)
+		}
+	}
+	if winners != 1 {
+		t.Errorf("Expected contended.txt to be stored once, got %d", winners)
+	}
+
+	entries, err := getAllEntries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3+30+1 {
+		t.Errorf("Expected %d records, got %d", 3+30+1, len(entries))
+	}
+}
+
+func TestManageFileUpdateRejectsExistingName(t *testing.T) {
+	teardown := searchSetup(t)
+	defer teardown()
+	record, err := findByName("fox.txt")
+	if err != nil || record == nil {
+		t.Fatal(record, err)
+	}
+	for _, duplicate := range []bool{false, true} {
+		if err := ManageFileUpdate(duplicate, "dog.txt", *record); !errors.Is(err, ErrFileExists) {
+			t.Errorf("duplicate=%v: expected ErrFileExists, got %v", duplicate, err)
+		}
+	}
+}
+
 //func TestHandleFileDuplicationOrUpdate(t *testing.T) {
 //	// Prepare the previous file details
 //	previousFileDetails := FileDetails{
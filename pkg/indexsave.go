@@ -0,0 +1,81 @@
+package pkg
+
+import (
+	"errors"
+	"io/fs"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// indexSaveDelay is how long an index waits after a change before it is persisted, so that a batch
+// or a burst of uploads rewrites it once rather than once per file.
+var indexSaveDelay = 2 * time.Second
+
+// deferredSaves are the savers of every index, flushed when the server stops.
+var deferredSaves struct {
+	sync.Mutex
+	all []*deferredSave
+}
+
+// deferredSave persists an index in the background, away from the requests that changed it. The
+// persisted file is removed on the first change after a save, so that an index whose save a crash
+// prevented is rebuilt from the records on start instead of being loaded stale.
+type deferredSave struct {
+	path  string
+	index interface{}
+	// lock is the lock of the index, read-locked while it is encoded.
+	lock *sync.RWMutex
+
+	mu      sync.Mutex
+	pending *time.Timer
+}
+
+func newDeferredSave(path string, index interface{}, lock *sync.RWMutex) *deferredSave {
+	saver := &deferredSave{path: path, index: index, lock: lock}
+	deferredSaves.Lock()
+	deferredSaves.all = append(deferredSaves.all, saver)
+	deferredSaves.Unlock()
+	return saver
+}
+
+// schedule saves the index after indexSaveDelay unless a save is pending already. The caller must
+// hold the write lock of the index.
+func (d *deferredSave) schedule() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.pending != nil {
+		return
+	}
+	if err := os.Remove(d.path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		log.Println("Error removing the outdated index", d.path, err)
+	}
+	d.pending = time.AfterFunc(indexSaveDelay, d.save)
+}
+
+// save persists the index now if it changed since it was last saved.
+func (d *deferredSave) save() {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+	d.mu.Lock()
+	pending := d.pending
+	d.pending = nil
+	d.mu.Unlock()
+	if pending == nil {
+		return
+	}
+	pending.Stop()
+	if err := saveJSON(d.path, d.index); err != nil {
+		log.Println("Error saving the index", d.path, err)
+	}
+}
+
+// flushIndexes saves the indexes with pending changes, so that a restart does not rebuild them.
+func flushIndexes() {
+	deferredSaves.Lock()
+	defer deferredSaves.Unlock()
+	for _, saver := range deferredSaves.all {
+		saver.save()
+	}
+}
@@ -0,0 +1,55 @@
+package pkg
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDeferredSave(t *testing.T) {
+	previousDelay := indexSaveDelay
+	defer func() { indexSaveDelay = previousDelay }()
+	indexSaveDelay = time.Hour
+
+	path := filepath.Join(t.TempDir(), "index.json")
+	var lock sync.RWMutex
+	index := map[string]int{"fox": 1}
+	saver := &deferredSave{path: path, index: &index, lock: &lock}
+	saver.save()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("Expected an unchanged index not to be saved, got %v", err)
+	}
+
+	index["dog"] = 2
+	saver.schedule()
+	saver.schedule()
+	saver.save()
+	var saved map[string]int
+	if err := loadJSON(path, &saved); err != nil || saved["dog"] != 2 {
+		t.Fatalf("Expected the changed index to be saved, got %v %v", saved, err)
+	}
+
+	// the first change after a save removes the persisted index until it is saved again
+	index["cat"] = 3
+	saver.schedule()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("Expected the outdated index to be removed, got %v", err)
+	}
+
+	indexSaveDelay = 10 * time.Millisecond
+	saver.save()
+	index["owl"] = 4
+	saver.schedule()
+	deadline := time.Now().Add(time.Second)
+	for saved["owl"] != 4 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		lock.RLock()
+		_ = loadJSON(path, &saved)
+		lock.RUnlock()
+	}
+	if saved["owl"] != 4 {
+		t.Errorf("Expected the index to be saved in the background, got %v", saved)
+	}
+}
@@ -0,0 +1,515 @@
+package pkg
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultJWTLeeway    = 60 * time.Second
+	defaultJWKSRefresh  = 5 * time.Minute
+	minJWKSRefetch      = 30 * time.Second
+	jwksRequestTimeout  = 10 * time.Second
+	maxJWKSResponseSize = 1 << 20
+)
+
+// JWTConfig enables bearer JWTs signed by a key of a JWKS, as issued by an OIDC provider.
+type JWTConfig struct {
+	// JWKSFile or JWKSURL locates the key set; the file is read again when it changes, the URL is
+	// fetched again after JWKSRefreshSeconds and whenever a token names an unknown key, but not
+	// within 30 seconds of a failed fetch.
+	JWKSFile           string `json:"jwks_file"`
+	JWKSURL            string `json:"jwks_url"`
+	JWKSRefreshSeconds int    `json:"jwks_refresh_seconds"`
+	// Issuer and Audience, when set, must match the iss and aud claims.
+	Issuer   string `json:"issuer"`
+	Audience string `json:"audience"`
+	// SubjectClaim and RolesClaim name the claims holding the identity (default "sub") and the
+	// roles (default "roles") of the caller; nested claims are written with dots, e.g.
+	// "realm_access.roles".
+	SubjectClaim string `json:"subject_claim"`
+	RolesClaim   string `json:"roles_claim"`
+	// GroupsClaim names the claim holding the groups ACL entries can be granted to, default "groups".
+	GroupsClaim string `json:"groups_claim"`
+	// RoleScopes grants scopes to roles; the standard scope claim grants its scopes too.
+	RoleScopes map[string][]string `json:"role_scopes"`
+	// ImplicitRoleScopes lets a role named after a scope grant that scope without being listed in
+	// RoleScopes. It is off by default, as an identity provider may have such roles for other uses.
+	ImplicitRoleScopes bool `json:"implicit_role_scopes"`
+	// LeewaySeconds is the clock skew tolerated on exp and nbf, 60 seconds when zero.
+	LeewaySeconds int `json:"leeway_seconds"`
+}
+
+// jwtAuthenticator accepts bearer JWTs verified against a JWKS.
+type jwtAuthenticator struct {
+	config JWTConfig
+	keys   *jwksSource
+	now    func() time.Time
+}
+
+func newJWTAuthenticator(config JWTConfig) *jwtAuthenticator {
+	if config.SubjectClaim == "" {
+		config.SubjectClaim = "sub"
+	}
+	if config.RolesClaim == "" {
+		config.RolesClaim = "roles"
+	}
+	if config.GroupsClaim == "" {
+		config.GroupsClaim = "groups"
+	}
+	refresh := time.Duration(config.JWKSRefreshSeconds) * time.Second
+	if refresh <= 0 {
+		refresh = defaultJWKSRefresh
+	}
+	return &jwtAuthenticator{
+		config: config,
+		keys:   &jwksSource{file: config.JWKSFile, url: config.JWKSURL, refresh: refresh},
+		now:    time.Now,
+	}
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+// Authenticate verifies bearer tokens shaped like a JWT and leaves every other token to the other
+// authenticators.
+func (a *jwtAuthenticator) Authenticate(r *http.Request) (*Caller, error) {
+	token := bearerToken(r)
+	if strings.Count(token, ".") != 2 {
+		return nil, nil
+	}
+	claims, err := a.verify(token)
+	if err != nil {
+		return nil, err
+	}
+	return a.caller(claims)
+}
+
+// verify checks the signature and the registered claims of a token and returns its claims.
+func (a *jwtAuthenticator) verify(token string) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	var header jwtHeader
+	err := decodeJWTPart(parts[0], &header)
+	if err != nil {
+		return nil, fmt.Errorf("invalid JWT header: %w", err)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("invalid JWT signature encoding: %w", err)
+	}
+	keys, err := a.keys.lookup(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	verified := false
+	for _, key := range keys {
+		if key.Alg != "" && key.Alg != header.Alg {
+			continue
+		}
+		if verifyJWTSignature(header.Alg, key.key, []byte(parts[0]+"."+parts[1]), signature) == nil {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return nil, fmt.Errorf("JWT signature not verified with %s", header.Alg)
+	}
+
+	var claims map[string]interface{}
+	err = decodeJWTPart(parts[1], &claims)
+	if err != nil {
+		return nil, fmt.Errorf("invalid JWT claims: %w", err)
+	}
+	return claims, a.validateClaims(claims)
+}
+
+func decodeJWTPart(part string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// validateClaims checks the expiry, not-before, issuer and audience claims.
+func (a *jwtAuthenticator) validateClaims(claims map[string]interface{}) error {
+	leeway := time.Duration(a.config.LeewaySeconds) * time.Second
+	if leeway <= 0 {
+		leeway = defaultJWTLeeway
+	}
+	now := a.now()
+
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return errors.New("JWT without exp claim")
+	}
+	if now.After(time.Unix(int64(exp), 0).Add(leeway)) {
+		return errors.New("JWT expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(leeway).Before(time.Unix(int64(nbf), 0)) {
+		return errors.New("JWT not valid yet")
+	}
+	if a.config.Issuer != "" && claims["iss"] != a.config.Issuer {
+		return fmt.Errorf("JWT issued by %v", claims["iss"])
+	}
+	if a.config.Audience != "" && !containsString(claimStrings(claims["aud"]), a.config.Audience) {
+		return fmt.Errorf("JWT not meant for %s", a.config.Audience)
+	}
+	return nil
+}
+
+// caller maps the claims of a verified token to the caller identity, roles and scopes.
+func (a *jwtAuthenticator) caller(claims map[string]interface{}) (*Caller, error) {
+	subject, _ := claimValue(claims, a.config.SubjectClaim).(string)
+	if subject == "" {
+		return nil, fmt.Errorf("JWT without %s claim", a.config.SubjectClaim)
+	}
+	caller := &Caller{Subject: jwtSubjectPrefix + subject, Roles: claimStrings(claimValue(claims, a.config.RolesClaim)),
+		Groups: claimStrings(claimValue(claims, a.config.GroupsClaim))}
+
+	grant := func(scope string) {
+		if scopeRank[scope] > 0 && !containsString(caller.Scopes, scope) {
+			caller.Scopes = append(caller.Scopes, scope)
+		}
+	}
+	for _, scope := range append(claimStrings(claims["scope"]), claimStrings(claims["scp"])...) {
+		grant(scope)
+	}
+	for _, role := range caller.Roles {
+		if a.config.ImplicitRoleScopes {
+			grant(role)
+		}
+		for _, scope := range a.config.RoleScopes[role] {
+			grant(scope)
+		}
+	}
+	return caller, nil
+}
+
+// claimValue returns the claim at a dotted path, e.g. "realm_access.roles".
+func claimValue(claims map[string]interface{}, path string) interface{} {
+	var value interface{} = claims
+	for _, name := range strings.Split(path, ".") {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		value = object[name]
+	}
+	return value
+}
+
+// claimStrings reads a claim holding a list of strings, either as an array or space-separated.
+func claimStrings(value interface{}) []string {
+	switch value := value.(type) {
+	case string:
+		return strings.Fields(value)
+	case []interface{}:
+		var values []string
+		for _, item := range value {
+			if s, ok := item.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+	return nil
+}
+
+func containsString(values []string, wanted string) bool {
+	for _, value := range values {
+		if value == wanted {
+			return true
+		}
+	}
+	return false
+}
+
+// verifyJWTSignature verifies the signature of signed with key for the RS*, PS* and ES* algorithms.
+func verifyJWTSignature(alg string, key crypto.PublicKey, signed, signature []byte) error {
+	if len(alg) != 5 {
+		return fmt.Errorf("unsupported algorithm %q", alg)
+	}
+	var h hash.Hash
+	var hashID crypto.Hash
+	switch alg[2:] {
+	case "256":
+		h, hashID = sha256.New(), crypto.SHA256
+	case "384":
+		h, hashID = sha512.New384(), crypto.SHA384
+	case "512":
+		h, hashID = sha512.New(), crypto.SHA512
+	default:
+		return fmt.Errorf("unsupported algorithm %q", alg)
+	}
+	h.Write(signed)
+	digest := h.Sum(nil)
+
+	switch alg[:2] {
+	case "RS", "PS":
+		rsaKey, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return errors.New("algorithm does not match the key type")
+		}
+		if alg[:2] == "PS" {
+			return rsa.VerifyPSS(rsaKey, hashID, digest, signature, nil)
+		}
+		return rsa.VerifyPKCS1v15(rsaKey, hashID, digest, signature)
+	case "ES":
+		ecKey, ok := key.(*ecdsa.PublicKey)
+		if !ok {
+			return errors.New("algorithm does not match the key type")
+		}
+		size := (ecKey.Curve.Params().BitSize + 7) / 8
+		if len(signature) != 2*size {
+			return errors.New("invalid ECDSA signature length")
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		if !ecdsa.Verify(ecKey, digest, r, s) {
+			return errors.New("invalid ECDSA signature")
+		}
+		return nil
+	}
+	// "none" and the HMAC algorithms are never accepted
+	return fmt.Errorf("unsupported algorithm %q", alg)
+}
+
+// jsonWebKey is a public key of a JWKS (RFC 7517); RSA and EC keys are supported.
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+
+	key crypto.PublicKey
+}
+
+func decodeBigInt(value string) (*big.Int, error) {
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil || len(data) == 0 {
+		return nil, fmt.Errorf("invalid key parameter %q", value)
+	}
+	return new(big.Int).SetBytes(data), nil
+}
+
+// parse decodes the public key of the JWK.
+func (k *jsonWebKey) parse() error {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return err
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return err
+		}
+		if !e.IsInt64() || e.Int64() > 1<<31-1 {
+			return errors.New("invalid RSA exponent")
+		}
+		k.key = &rsa.PublicKey{N: n, E: int(e.Int64())}
+	case "EC":
+		curves := map[string]elliptic.Curve{"P-256": elliptic.P256(), "P-384": elliptic.P384(), "P-521": elliptic.P521()}
+		curve, ok := curves[k.Crv]
+		if !ok {
+			return fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return err
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return errors.New("EC point not on the curve")
+		}
+		k.key = &ecdsa.PublicKey{Curve: curve, X: x, Y: y}
+	default:
+		return fmt.Errorf("unsupported key type %q", k.Kty)
+	}
+	return nil
+}
+
+// jwksSource caches the signing keys of a JWKS file or URL.
+type jwksSource struct {
+	mu      sync.Mutex
+	file    string
+	url     string
+	refresh time.Duration
+	client  *http.Client
+
+	keys    []jsonWebKey
+	modTime time.Time
+	fetched time.Time
+	// fetchErr is the error of the last fetch; the URL is not fetched again before minJWKSRefetch
+	// has passed, so that an unreachable provider does not hold every request for a timeout.
+	fetchErr error
+	// fetching is closed once the fetch in flight completes, nil when none is.
+	fetching chan struct{}
+}
+
+// lookup returns the keys a token with the key id kid may be signed with: the key of that id, or
+// every key when the token names none. The URL is fetched without holding the lock: lookups that
+// find their key in the cached set are answered from it while it is refreshed, and only the others
+// wait for the fetch.
+func (s *jwksSource) lookup(kid string) ([]jsonWebKey, error) {
+	if s.file != "" {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if err := s.loadFile(); err != nil {
+			return nil, err
+		}
+		return matchingKey(s.matching(kid), kid)
+	}
+
+	for waited := false; ; waited = true {
+		s.mu.Lock()
+		keys := s.matching(kid)
+		backoff := s.fetchErr != nil && time.Since(s.fetched) < minJWKSRefetch
+		due := s.keys == nil || time.Since(s.fetched) >= s.refresh
+		// an unknown key id may be a rotated key, refetch unless that was just done
+		rotated := len(keys) == 0 && time.Since(s.fetched) > minJWKSRefetch
+		if waited || backoff || !due && !rotated {
+			loaded, err := s.keys != nil, s.fetchErr
+			s.mu.Unlock()
+			if !loaded && err != nil {
+				return nil, err
+			}
+			return matchingKey(keys, kid)
+		}
+		done := s.fetchKeys()
+		s.mu.Unlock()
+		if len(keys) > 0 {
+			return keys, nil
+		}
+		<-done
+	}
+}
+
+// matchingKey returns keys, or an error if no key matched kid.
+func matchingKey(keys []jsonWebKey, kid string) ([]jsonWebKey, error) {
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no JWKS key with id %q", kid)
+	}
+	return keys, nil
+}
+
+func (s *jwksSource) matching(kid string) []jsonWebKey {
+	var keys []jsonWebKey
+	for _, key := range s.keys {
+		if (kid == "" || key.Kid == kid) && key.Use != "enc" {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// loadFile reads the key set file if it changed. The caller must hold the lock.
+func (s *jwksSource) loadFile() error {
+	stat, err := os.Stat(s.file)
+	if err != nil {
+		return err
+	}
+	if stat.ModTime().Equal(s.modTime) {
+		return nil
+	}
+	data, err := os.ReadFile(s.file)
+	if err != nil {
+		return err
+	}
+	if err := s.parse(data); err != nil {
+		return err
+	}
+	s.modTime = stat.ModTime()
+	return nil
+}
+
+// fetchKeys starts fetching the key set from the URL unless a fetch is in flight already, and
+// returns a channel closed once it completes. Keys loaded before keep being used if the fetch fails.
+// The caller must hold the lock.
+func (s *jwksSource) fetchKeys() <-chan struct{} {
+	if s.fetching != nil {
+		return s.fetching
+	}
+	done := make(chan struct{})
+	s.fetching = done
+	go func() {
+		data, err := s.fetch()
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if err == nil {
+			err = s.parse(data)
+		}
+		s.fetched, s.fetchErr = time.Now(), nil
+		if err != nil {
+			s.fetchErr = fmt.Errorf("fetching the JWKS: %w", err)
+			log.Println("Error", s.fetchErr)
+		}
+		s.fetching = nil
+		close(done)
+	}()
+	return done
+}
+
+// parse replaces the keys with the usable keys of a key set. The caller must hold the lock.
+func (s *jwksSource) parse(data []byte) error {
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	err := json.Unmarshal(data, &set)
+	if err != nil {
+		return fmt.Errorf("invalid JWKS: %w", err)
+	}
+	keys := make([]jsonWebKey, 0, len(set.Keys))
+	for _, key := range set.Keys {
+		if err := key.parse(); err != nil {
+			continue
+		}
+		keys = append(keys, key)
+	}
+	s.keys = keys
+	return nil
+}
+
+func (s *jwksSource) fetch() ([]byte, error) {
+	client := s.client
+	if client == nil {
+		client = &http.Client{Timeout: jwksRequestTimeout}
+	}
+	response, err := client.Get(s.url)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", response.Status)
+	}
+	return io.ReadAll(io.LimitReader(response.Body, maxJWKSResponseSize))
+}
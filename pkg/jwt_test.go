@@ -0,0 +1,340 @@
+package pkg
+
+import (
+	"bufio"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// jwtTestKeys holds an RSA and an EC signing key, published in a JWKS as "rsa" and "ec".
+type jwtTestKeys struct {
+	rsa  *rsa.PrivateKey
+	ec   *ecdsa.PrivateKey
+	jwks []byte
+}
+
+func newJWTTestKeys(t *testing.T) jwtTestKeys {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encode := func(b []byte) string { return base64.RawURLEncoding.EncodeToString(b) }
+	jwks, err := json.Marshal(map[string]interface{}{"keys": []map[string]string{
+		{"kty": "RSA", "kid": "rsa", "use": "sig",
+			"n": encode(rsaKey.N.Bytes()), "e": encode(big.NewInt(int64(rsaKey.E)).Bytes())},
+		{"kty": "EC", "kid": "ec", "crv": "P-256",
+			"x": encode(ecKey.X.FillBytes(make([]byte, 32))), "y": encode(ecKey.Y.FillBytes(make([]byte, 32)))},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return jwtTestKeys{rsa: rsaKey, ec: ecKey, jwks: jwks}
+}
+
+// sign returns a JWT of claims signed with the key kid and the algorithm alg.
+func (k jwtTestKeys) sign(t *testing.T, alg, kid string, claims map[string]interface{}) string {
+	encode := func(v interface{}) string {
+		data, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(data)
+	}
+	signed := encode(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"}) + "." + encode(claims)
+	digest := sha256.Sum256([]byte(signed))
+
+	var signature []byte
+	var err error
+	switch alg {
+	case "RS256":
+		signature, err = rsa.SignPKCS1v15(rand.Reader, k.rsa, crypto.SHA256, digest[:])
+	case "PS256":
+		signature, err = rsa.SignPSS(rand.Reader, k.rsa, crypto.SHA256, digest[:], nil)
+	case "ES256":
+		var r, s *big.Int
+		r, s, err = ecdsa.Sign(rand.Reader, k.ec, digest[:])
+		if err == nil {
+			signature = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+		}
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func jwtClaims(overrides map[string]interface{}) map[string]interface{} {
+	claims := map[string]interface{}{
+		"iss": "https://idp.example", "aud": []string{"minifilestore"}, "sub": "alice",
+		"exp": time.Now().Add(time.Hour).Unix(), "roles": []string{"editor"},
+	}
+	for name, value := range overrides {
+		if value == nil {
+			delete(claims, name)
+			continue
+		}
+		claims[name] = value
+	}
+	return claims
+}
+
+func TestJWTAuthenticator(t *testing.T) {
+	keys := newJWTTestKeys(t)
+	jwksFile := filepath.Join(t.TempDir(), "jwks.json")
+	err := os.WriteFile(jwksFile, keys.jwks, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	authenticator := newJWTAuthenticator(JWTConfig{
+		JWKSFile: jwksFile, Issuer: "https://idp.example", Audience: "minifilestore",
+		RoleScopes: map[string][]string{"editor": {ScopeWrite}},
+	})
+
+	for _, test := range []struct {
+		name  string
+		token string
+		valid bool
+	}{
+		{"RS256", keys.sign(t, "RS256", "rsa", jwtClaims(nil)), true},
+		{"PS256", keys.sign(t, "PS256", "rsa", jwtClaims(nil)), true},
+		{"ES256", keys.sign(t, "ES256", "ec", jwtClaims(nil)), true},
+		{"no key id", keys.sign(t, "RS256", "", jwtClaims(nil)), true},
+		{"audience string", keys.sign(t, "RS256", "rsa", jwtClaims(map[string]interface{}{"aud": "minifilestore"})), true},
+		{"expired", keys.sign(t, "RS256", "rsa", jwtClaims(map[string]interface{}{"exp": time.Now().Add(-time.Hour).Unix()})), false},
+		{"no expiry", keys.sign(t, "RS256", "rsa", jwtClaims(map[string]interface{}{"exp": nil})), false},
+		{"not yet valid", keys.sign(t, "RS256", "rsa", jwtClaims(map[string]interface{}{"nbf": time.Now().Add(time.Hour).Unix()})), false},
+		{"other issuer", keys.sign(t, "RS256", "rsa", jwtClaims(map[string]interface{}{"iss": "https://evil.example"})), false},
+		{"other audience", keys.sign(t, "RS256", "rsa", jwtClaims(map[string]interface{}{"aud": "other"})), false},
+		{"no subject", keys.sign(t, "RS256", "rsa", jwtClaims(map[string]interface{}{"sub": nil})), false},
+		{"unknown key", keys.sign(t, "RS256", "missing", jwtClaims(nil)), false},
+		{"wrong key type", keys.sign(t, "ES256", "rsa", jwtClaims(nil)), false},
+		{"none", keys.sign(t, "none", "rsa", jwtClaims(nil)), false},
+	} {
+		req := httptest.NewRequest("GET", "/api/v1/list", nil)
+		req.Header.Set("Authorization", "Bearer "+test.token)
+		caller, err := authenticator.Authenticate(req)
+		if !test.valid {
+			if err == nil {
+				t.Errorf("%s: expected the token to be rejected", test.name)
+			}
+			continue
+		}
+		if err != nil || caller == nil {
+			t.Errorf("%s: expected the token to be accepted, got %v", test.name, err)
+			continue
+		}
+		if caller.Subject != "jwt:alice" || len(caller.Roles) != 1 || !caller.HasScope(ScopeWrite) || caller.HasScope(ScopeAdmin) {
+			t.Errorf("%s: unexpected caller %+v", test.name, caller)
+		}
+	}
+
+	tampered := keys.sign(t, "RS256", "rsa", jwtClaims(nil))
+	tampered = tampered[:len(tampered)-4] + "AAAA"
+	req := httptest.NewRequest("GET", "/api/v1/list", nil)
+	req.Header.Set("Authorization", "Bearer "+tampered)
+	if _, err := authenticator.Authenticate(req); err == nil {
+		t.Error("Expected a tampered signature to be rejected")
+	}
+	req.Header.Set("Authorization", "Bearer mfs_not-a-jwt")
+	if caller, err := authenticator.Authenticate(req); caller != nil || err != nil {
+		t.Error("Expected other tokens to be left to the other authenticators")
+	}
+}
+
+func TestJWTClaimMapping(t *testing.T) {
+	claims := map[string]interface{}{
+		"preferred_username": "bob",
+		"scope":              "openid read",
+		"realm_access":       map[string]interface{}{"roles": []interface{}{"admin", "auditor"}},
+	}
+	config := JWTConfig{SubjectClaim: "preferred_username", RolesClaim: "realm_access.roles"}
+	caller, err := newJWTAuthenticator(config).caller(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if caller.Subject != "jwt:bob" || len(caller.Roles) != 2 || len(caller.Scopes) != 1 || caller.HasScope(ScopeWrite) {
+		t.Errorf("Expected the admin role not to grant the admin scope by default, got %+v", caller)
+	}
+
+	config.ImplicitRoleScopes = true
+	caller, err = newJWTAuthenticator(config).caller(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(caller.Scopes) != 2 || !caller.HasScope(ScopeAdmin) {
+		t.Errorf("Expected the admin role to grant the admin scope, got %+v", caller)
+	}
+
+	// a subject looking like an API token stays a JWT subject
+	caller, err = newJWTAuthenticator(JWTConfig{}).caller(map[string]interface{}{"sub": "token:abc"})
+	if err != nil || caller.Subject != "jwt:token:abc" {
+		t.Errorf("Expected the subject to be namespaced, got %+v %v", caller, err)
+	}
+}
+
+func TestJWKSFromURL(t *testing.T) {
+	keys := newJWTTestKeys(t)
+	fetches := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches++
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(keys.jwks)
+	}))
+	defer server.Close()
+
+	previousAuthenticators, previousAuditLog := authenticators, auditLogPath
+	defer func() { authenticators, auditLogPath = previousAuthenticators, previousAuditLog }()
+	authenticators = []Authenticator{newJWTAuthenticator(JWTConfig{JWKSURL: server.URL, RolesClaim: "groups", ImplicitRoleScopes: true})}
+	auditLogPath = filepath.Join(t.TempDir(), "audit.log")
+
+	token := keys.sign(t, "ES256", "ec", jwtClaims(map[string]interface{}{"groups": "write"}))
+	write := requireScope(ScopeWrite, func(w http.ResponseWriter, r *http.Request) {
+		_ = r.ParseForm()
+		w.WriteHeader(http.StatusCreated)
+	})
+	for i := 0; i < 2; i++ {
+		if rr := authRequest(write, "POST", "/api/v1/store?filename=a.txt", token); rr.Code != http.StatusCreated {
+			t.Fatalf("Expected the JWT to be accepted, got %d %s", rr.Code, rr.Body.String())
+		}
+	}
+	if fetches != 1 {
+		t.Errorf("Expected the JWKS to be fetched once, got %d", fetches)
+	}
+	if rr := authRequest(write, "POST", "/api/v1/store", keys.sign(t, "ES256", "ec", jwtClaims(nil))); rr.Code != http.StatusForbidden {
+		t.Errorf("Expected a JWT without the write role to be refused, got %d", rr.Code)
+	}
+
+	file, err := os.Open(auditLogPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer CloseFile(file)
+	var records []AuditRecord
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var record AuditRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, record)
+	}
+	if len(records) != 2 {
+		t.Fatalf("Expected the two mutations to be audited, got %+v", records)
+	}
+	if record := records[0]; record.Caller != "jwt:alice" || record.Filename != "a.txt" || record.Status != http.StatusCreated || record.Method != "POST" {
+		t.Errorf("Unexpected audit record %+v", record)
+	}
+}
+
+func TestJWKSFetchFailureBacksOff(t *testing.T) {
+	keys := newJWTTestKeys(t)
+	fetches, down := 0, true
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches++
+		if down {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = w.Write(keys.jwks)
+	}))
+	defer server.Close()
+
+	source := &jwksSource{url: server.URL, refresh: time.Nanosecond}
+	for i := 0; i < 3; i++ {
+		if _, err := source.lookup("ec"); err == nil {
+			t.Fatal("Expected lookups to fail while the JWKS is unavailable")
+		}
+	}
+	if fetches != 1 {
+		t.Errorf("Expected the failed fetch not to be retried before %v, got %d fetches", minJWKSRefetch, fetches)
+	}
+
+	down = false
+	source.fetched = source.fetched.Add(-minJWKSRefetch)
+	if _, err := source.lookup("ec"); err != nil || fetches != 2 {
+		t.Fatalf("Expected the JWKS to be fetched again after the backoff, got %v after %d fetches", err, fetches)
+	}
+
+	// once loaded, the keys are kept while the provider is down again
+	down = true
+	if _, err := source.lookup("ec"); err != nil {
+		t.Errorf("Expected the loaded keys to be kept, got %v", err)
+	}
+	waitForJWKSFetch(source)
+	if fetches != 3 {
+		t.Errorf("Expected the keys to be refreshed, got %d fetches", fetches)
+	}
+	if _, err := source.lookup("ec"); err != nil || fetches != 3 {
+		t.Errorf("Expected no fetch during the backoff, got %v after %d fetches", err, fetches)
+	}
+}
+
+// waitForJWKSFetch waits for the fetch source has in flight, if any.
+func waitForJWKSFetch(source *jwksSource) {
+	source.mu.Lock()
+	done := source.fetching
+	source.mu.Unlock()
+	if done != nil {
+		<-done
+	}
+}
+
+func TestJWKSRefreshDoesNotBlockCachedKeys(t *testing.T) {
+	keys := newJWTTestKeys(t)
+	release := make(chan struct{})
+	blocking := make(chan bool, 1)
+	blocking <- false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if block := <-blocking; block {
+			<-release
+		}
+		blocking <- true
+		_, _ = w.Write(keys.jwks)
+	}))
+	defer server.Close()
+
+	source := &jwksSource{url: server.URL, refresh: time.Hour}
+	if _, err := source.lookup("ec"); err != nil {
+		t.Fatal(err)
+	}
+
+	// the refresh hangs, but the cached key is still served
+	source.mu.Lock()
+	source.fetched = source.fetched.Add(-2 * time.Hour)
+	source.mu.Unlock()
+	looked := make(chan error, 1)
+	go func() {
+		_, err := source.lookup("ec")
+		looked <- err
+	}()
+	select {
+	case err := <-looked:
+		if err != nil {
+			t.Errorf("Expected the cached key, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("Expected the lookup not to wait for the refresh")
+	}
+	if _, err := source.lookup("ec"); err != nil {
+		t.Errorf("Expected the cached key during the refresh, got %v", err)
+	}
+	close(release)
+	waitForJWKSFetch(source)
+}
@@ -0,0 +1,148 @@
+package pkg
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+)
+
+const (
+	defaultKeywords = 10
+	maxKeywords     = 100
+)
+
+// Keyword is a word of a file with its TF-IDF score.
+type Keyword struct {
+	Word  string  `json:"word"`
+	Score float64 `json:"score"`
+}
+
+// KeywordsResponse is the body returned by /api/v1/keywords.
+type KeywordsResponse struct {
+	Filename string    `json:"filename"`
+	Keywords []Keyword `json:"keywords"`
+}
+
+// topKeywords scores the word counts of filename by TF-IDF against the other files of the frequency
+// index that are in readable, every one when readable is nil, and returns the k best. The term
+// frequency is the share of the file's words, and the inverse document frequency is smoothed as
+// ln((1+n)/(1+df))+1, where n and df count the file itself, so a word that only this file contains
+// scores highest. Ties are ordered by word.
+func topKeywords(filename string, counts map[string]int, k int, readable fileSet) []Keyword {
+	frequencyIndex.mu.Lock()
+	frequencyIndex.ensureLoaded()
+	frequencyIndex.mu.Unlock()
+
+	frequencyIndex.mu.RLock()
+	defer frequencyIndex.mu.RUnlock()
+
+	// the document counts cover every indexed file, so take out the file itself and the files the
+	// caller may not read
+	hidden := make(map[string]int)
+	documents := len(frequencyIndex.Files) + 1
+	for other, otherCounts := range frequencyIndex.Files {
+		if other != filename && readable.contains(other) {
+			continue
+		}
+		documents--
+		smaller, larger := otherCounts, counts
+		if len(counts) < len(otherCounts) {
+			smaller, larger = counts, otherCounts
+		}
+		for word := range smaller {
+			if larger[word] > 0 {
+				hidden[word]++
+			}
+		}
+	}
+	total := 0
+	for _, count := range counts {
+		total += count
+	}
+
+	keywords := make([]Keyword, 0, len(counts))
+	for word, count := range counts {
+		df := 1 + frequencyIndex.Documents[word] - hidden[word]
+		idf := math.Log(float64(1+documents)/float64(1+df)) + 1
+		keywords = append(keywords, Keyword{word, float64(count) / float64(total) * idf})
+	}
+
+	sort.Slice(keywords, func(i, j int) bool {
+		if keywords[i].Score != keywords[j].Score {
+			return keywords[i].Score > keywords[j].Score
+		}
+		return keywords[i].Word < keywords[j].Word
+	})
+	return keywords[:min(k, len(keywords))]
+}
+
+// keywordsOfStoredFile returns the k best keywords of a stored file, which does not have to be in the
+// frequency index yet, scored against the files in readable.
+func keywordsOfStoredFile(filename string, k int, readable fileSet) ([]Keyword, error) {
+	counts, err := countTermsInFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return topKeywords(filename, counts, k, readable), nil
+}
+
+func keywordsHandler(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		log.Println("Error parsing the form:", err)
+		respondError(w, http.StatusBadRequest, ErrCodeInvalidRequest, "Error parsing the form")
+		return
+	}
+
+	fileName := r.FormValue("filename")
+	err = validateRequiredField("filename", fileName)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, ErrCodeMissingField, err.Error())
+		return
+	}
+	if !authorizeFile(w, r, fileName, PermissionRead) {
+		return
+	}
+
+	k := defaultKeywords
+	if r.FormValue("k") != "" {
+		k, err = strconv.Atoi(r.FormValue("k"))
+		if err != nil || k < 1 || k > maxKeywords {
+			respondError(w, http.StatusBadRequest, ErrCodeInvalidRequest,
+				fmt.Sprintf("Invalid k value, expected 1 to %d", maxKeywords))
+			return
+		}
+	}
+
+	record, err := findByName(fileName)
+	if err != nil {
+		log.Println("Error executing findByName:", err)
+		respondError(w, http.StatusInternalServerError, ErrCodeInternal, "Error in finding record by name")
+		return
+	}
+	if record == nil {
+		respondError(w, http.StatusNotFound, ErrCodeNotFound, "record does not exist")
+		return
+	}
+
+	readable, ok := readableFiles(w, r)
+	if !ok {
+		return
+	}
+	keywords, err := keywordsOfStoredFile(record.Filename, k, readable)
+	if err != nil {
+		log.Println("Error extracting the keywords:", err)
+		respondError(w, http.StatusInternalServerError, ErrCodeInternal, "Error extracting the keywords")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(KeywordsResponse{Filename: record.Filename, Keywords: keywords})
+	if err != nil {
+		log.Println("Error writing response:", err)
+	}
+}
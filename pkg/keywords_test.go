@@ -0,0 +1,122 @@
+package pkg
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestTopKeywords(t *testing.T) {
+	teardown := searchSetup(t)
+	defer teardown()
+
+	keywords, err := keywordsOfStoredFile("fox.txt", 3, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// fox and quick both occur twice in fox.txt, but quick is also in other.txt
+	if len(keywords) != 3 || keywords[0].Word != "fox" || keywords[0].Score <= keywords[1].Score {
+		t.Fatalf("Expected fox as the best keyword, got %v", keywords)
+	}
+
+	// without other.txt, quick is as rare as fox, and other.txt no longer counts as a document
+	keywords, err = keywordsOfStoredFile("fox.txt", 2, fileSet{"fox.txt": true, "dog.txt": true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keywords) != 2 || keywords[0].Word != "fox" || keywords[1].Word != "quick" ||
+		keywords[0].Score != keywords[1].Score {
+		t.Errorf("Expected fox and quick to score alike among the readable files, got %v", keywords)
+	}
+}
+
+func TestKeywordsHandler(t *testing.T) {
+	teardown := searchSetup(t)
+	defer teardown()
+
+	rr := httptest.NewRecorder()
+	keywordsHandler(rr, httptest.NewRequest("GET", "/api/v1/keywords?filename=dog.txt&k=2", nil))
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+	var response KeywordsResponse
+	err := json.Unmarshal(rr.Body.Bytes(), &response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.Filename != "dog.txt" || len(response.Keywords) != 2 || response.Keywords[0].Word != "dog" {
+		t.Errorf("Unexpected response: %+v", response)
+	}
+
+	for target, status := range map[string]int{
+		"/api/v1/keywords?filename=missing.txt": http.StatusNotFound,
+		"/api/v1/keywords":                      http.StatusBadRequest,
+		"/api/v1/keywords?filename=dog.txt&k=0": http.StatusBadRequest,
+	} {
+		rr := httptest.NewRecorder()
+		keywordsHandler(rr, httptest.NewRequest("GET", target, nil))
+		if rr.Code != status {
+			t.Errorf("%s: expected %d, got %d", target, status, rr.Code)
+		}
+	}
+}
+
+func TestStoreHandlerRecordsKeywordTags(t *testing.T) {
+	teardown := searchSetup(t)
+	defer teardown()
+
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	part, err := writer.CreateFormFile("file", "cats.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = part.Write([]byte("The cat chases the other cat and the dog."))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = writer.WriteField("filename", "cats.txt")
+	_ = writer.WriteField("keywords", "2")
+	err = writer.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest("POST", "/api/v1/store", body)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	rr := httptest.NewRecorder()
+	storeHandler(rr, req)
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v: %s", status, http.StatusOK, rr.Body.String())
+	}
+
+	record, err := findByName("cats.txt")
+	if err != nil || record == nil {
+		t.Fatalf("Expected a record for cats.txt: %v", err)
+	}
+	if len(record.Tags) != 2 || record.Tags[0] != "cat" {
+		t.Errorf("Expected the keywords as tags, got %v", record.Tags)
+	}
+}
+
+func TestRecordsWithoutOptionalColumns(t *testing.T) {
+	TestCleanCSV(t)
+	defer teardown()
+
+	err := os.WriteFile(CsvFileLocation, []byte("old.txt,10,abcd,2\nnew.txt,20,efgh,4,red green\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := getAllEntries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[0].Tags != nil || !reflect.DeepEqual(entries[1].Tags, []string{"red", "green"}) {
+		t.Errorf("Unexpected entries: %+v", entries)
+	}
+}
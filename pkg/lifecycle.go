@@ -0,0 +1,171 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// ListenAddressEnv names the environment variable overriding the listen address of the config.
+const ListenAddressEnv = "LISTEN_ADDRESS"
+
+const defaultListenAddress = ":8080"
+
+// Defaults of the ServerConfig timeouts. Reads and writes are bounded generously so that large
+// uploads and zip downloads still complete.
+const (
+	defaultReadHeaderTimeout = 10 * time.Second
+	defaultReadTimeout       = 5 * time.Minute
+	defaultWriteTimeout      = 5 * time.Minute
+	defaultIdleTimeout       = 2 * time.Minute
+	defaultShutdownTimeout   = 25 * time.Second
+)
+
+// ServerConfig sets the address and the timeouts of the HTTP server. Timeouts are in seconds; zero
+// selects the default and a negative value disables the timeout.
+type ServerConfig struct {
+	Listen                   string `json:"listen"`
+	ReadHeaderTimeoutSeconds int    `json:"read_header_timeout_seconds"`
+	ReadTimeoutSeconds       int    `json:"read_timeout_seconds"`
+	WriteTimeoutSeconds      int    `json:"write_timeout_seconds"`
+	IdleTimeoutSeconds       int    `json:"idle_timeout_seconds"`
+	// ShutdownTimeoutSeconds is how long a stopping server waits for the requests in progress.
+	ShutdownTimeoutSeconds int `json:"shutdown_timeout_seconds"`
+}
+
+// timeout converts a ServerConfig timeout to a duration.
+func timeout(seconds int, fallback time.Duration) time.Duration {
+	switch {
+	case seconds < 0:
+		return 0
+	case seconds == 0:
+		return fallback
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// listenAddress picks the address to listen on: the flag, else the environment, else the config.
+func listenAddress(flag string, config ServerConfig) string {
+	for _, address := range []string{flag, os.Getenv(ListenAddressEnv), config.Listen} {
+		if address != "" {
+			return address
+		}
+	}
+	return defaultListenAddress
+}
+
+// newHTTPServer returns a server for handler with the timeouts of the config.
+func newHTTPServer(address string, config ServerConfig, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              address,
+		Handler:           handler,
+		ReadHeaderTimeout: timeout(config.ReadHeaderTimeoutSeconds, defaultReadHeaderTimeout),
+		ReadTimeout:       timeout(config.ReadTimeoutSeconds, defaultReadTimeout),
+		WriteTimeout:      timeout(config.WriteTimeoutSeconds, defaultWriteTimeout),
+		IdleTimeout:       timeout(config.IdleTimeoutSeconds, defaultIdleTimeout),
+	}
+}
+
+// runServer serves on listener, with TLS if the server has a TLS config, until ctx is done. It then
+// stops accepting connections and waits up to shutdownTimeout for the requests in progress to
+// complete. The context of the requests still running after that is cancelled, which stops the
+// word count workers and scans they started, and their connections are closed; uploads cut short
+// this way never reach the store, as they are only moved there once complete. runServer returns
+// only once every handler has returned, so that a file moved into the store also gets its record.
+func runServer(ctx context.Context, server *http.Server, listener net.Listener, shutdownTimeout time.Duration) error {
+	base, cancelRequests := context.WithCancel(context.Background())
+	defer cancelRequests()
+	server.BaseContext = func(net.Listener) context.Context { return base }
+	var handlers inFlightHandlers
+	server.Handler = handlers.track(server.Handler)
+	defer handlers.wait()
+
+	served := make(chan error, 1)
+	go func() {
+		if server.TLSConfig != nil {
+			served <- server.ServeTLS(listener, "", "")
+		} else {
+			served <- server.Serve(listener)
+		}
+	}()
+
+	select {
+	case err := <-served:
+		return err
+	case <-ctx.Done():
+	}
+
+	log.Println("Shutting down, waiting up to", shutdownTimeout, "for the requests in progress")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		log.Println("Cancelling the requests still in progress:", err)
+		cancelRequests()
+		if err := server.Close(); err != nil {
+			log.Println("Error closing the connections:", err)
+		}
+	}
+	if err := <-served; !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// inFlightHandlers counts the handlers running, because http.Server.Close does not wait for them.
+type inFlightHandlers struct {
+	mu      sync.Mutex
+	running sync.WaitGroup
+	stopped bool
+}
+
+// track counts the calls of handler; once wait is called it refuses new requests instead.
+func (h *inFlightHandlers) track(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.mu.Lock()
+		if h.stopped {
+			h.mu.Unlock()
+			respondError(w, http.StatusServiceUnavailable, ErrCodeInternal, "The server is shutting down")
+			return
+		}
+		h.running.Add(1)
+		h.mu.Unlock()
+		defer h.running.Done()
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// wait returns once every handler started has returned.
+func (h *inFlightHandlers) wait() {
+	h.mu.Lock()
+	h.stopped = true
+	h.mu.Unlock()
+	h.running.Wait()
+}
+
+// removeStaleUploads removes the temporary files of uploads that were interrupted by a crash or a
+// killed process; they are only renamed into the store once complete.
+func removeStaleUploads() {
+	dir, err := getFileStoreDir()
+	if err != nil {
+		log.Println("Error getting the file store directory:", err)
+		return
+	}
+	stale, err := filepath.Glob(filepath.Join(dir, ".upload-*"))
+	if err != nil {
+		log.Println("Error looking for interrupted uploads:", err)
+		return
+	}
+	for _, path := range stale {
+		if err := os.Remove(path); err != nil {
+			log.Println("Error removing the interrupted upload", path, err)
+			continue
+		}
+		log.Println("Removed the interrupted upload", path)
+	}
+}
@@ -0,0 +1,155 @@
+package pkg
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestListenAddress(t *testing.T) {
+	config := ServerConfig{Listen: ":9000"}
+	t.Setenv(ListenAddressEnv, "")
+	if address := listenAddress("", ServerConfig{}); address != defaultListenAddress {
+		t.Errorf("Expected the default address, got %s", address)
+	}
+	if address := listenAddress("", config); address != ":9000" {
+		t.Errorf("Expected the address of the config, got %s", address)
+	}
+	t.Setenv(ListenAddressEnv, "127.0.0.1:9001")
+	if address := listenAddress("", config); address != "127.0.0.1:9001" {
+		t.Errorf("Expected the environment to override the config, got %s", address)
+	}
+	if address := listenAddress(":9002", config); address != ":9002" {
+		t.Errorf("Expected the flag to override the environment, got %s", address)
+	}
+}
+
+func TestNewHTTPServerTimeouts(t *testing.T) {
+	server := newHTTPServer(":8080", ServerConfig{ReadTimeoutSeconds: 30, WriteTimeoutSeconds: -1}, http.NotFoundHandler())
+	if server.ReadTimeout != 30*time.Second || server.WriteTimeout != 0 ||
+		server.ReadHeaderTimeout != defaultReadHeaderTimeout || server.IdleTimeout != defaultIdleTimeout {
+		t.Errorf("Unexpected timeouts %v %v %v %v", server.ReadTimeout, server.WriteTimeout, server.ReadHeaderTimeout, server.IdleTimeout)
+	}
+}
+
+// startTestServer runs handler with runServer until the returned stop function is called, which
+// returns the result of runServer.
+func startTestServer(t *testing.T, handler http.HandlerFunc, shutdownTimeout time.Duration) (string, func() error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	result := make(chan error, 1)
+	go func() {
+		result <- runServer(ctx, newHTTPServer(listener.Addr().String(), ServerConfig{}, handler), listener, shutdownTimeout)
+	}()
+	return "http://" + listener.Addr().String(), func() error {
+		cancel()
+		return <-result
+	}
+}
+
+func TestRunServerDrainsRequests(t *testing.T) {
+	started, release := make(chan struct{}), make(chan struct{})
+	url, stop := startTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		_, _ = io.WriteString(w, "stored")
+	}, time.Minute)
+
+	type response struct {
+		body string
+		err  error
+	}
+	responses := make(chan response, 1)
+	go func() {
+		resp, err := http.Post(url, "text/plain", nil)
+		if err != nil {
+			responses <- response{err: err}
+			return
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		responses <- response{string(body), err}
+	}()
+	<-started
+
+	stopped := make(chan error, 1)
+	go func() { stopped <- stop() }()
+	select {
+	case err := <-stopped:
+		t.Fatalf("Expected the server to wait for the upload in progress, stopped with %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	if _, err := http.Get(url); err == nil {
+		t.Error("Expected a stopping server to refuse new connections")
+	}
+
+	close(release)
+	if r := <-responses; r.err != nil || r.body != "stored" {
+		t.Errorf("Expected the upload in progress to complete, got %q %v", r.body, r.err)
+	}
+	if err := <-stopped; err != nil {
+		t.Errorf("Expected a clean shutdown, got %v", err)
+	}
+}
+
+func TestRunServerCancelsAfterTimeout(t *testing.T) {
+	started, cancelled, finished := make(chan struct{}), make(chan struct{}), make(chan struct{})
+	url, stop := startTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-r.Context().Done()
+		close(cancelled)
+		// a handler finishing a change of the store after its request was cancelled
+		time.Sleep(100 * time.Millisecond)
+		close(finished)
+	}, 50*time.Millisecond)
+
+	go func() {
+		resp, err := http.Get(url)
+		if err == nil {
+			resp.Body.Close()
+		}
+	}()
+	<-started
+	if err := stop(); err != nil {
+		t.Errorf("Expected the server to stop after the timeout, got %v", err)
+	}
+	select {
+	case <-cancelled:
+	default:
+		t.Error("Expected the context of the request to be cancelled")
+	}
+	select {
+	case <-finished:
+	default:
+		t.Error("Expected the server to wait for the cancelled handler to return")
+	}
+}
+
+func TestRemoveStaleUploads(t *testing.T) {
+	teardown := searchSetup(t)
+	defer teardown()
+	dir, err := getFileStoreDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale := filepath.Join(dir, ".upload-12345")
+	if err := os.WriteFile(stale, []byte("half an upl"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	removeStaleUploads()
+	if _, err := os.Stat(stale); !os.IsNotExist(err) {
+		t.Errorf("Expected the interrupted upload to be removed, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "fox.txt")); err != nil {
+		t.Errorf("Expected the stored files to be kept, got %v", err)
+	}
+}
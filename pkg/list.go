@@ -0,0 +1,242 @@
+package pkg
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	SortByName      = "name"
+	SortBySize      = "size"
+	SortByWordCount = "word_count"
+
+	// DefaultListLimit and MaxListLimit apply to the v2 collection; v1 only paginates when asked to.
+	DefaultListLimit = 100
+	MaxListLimit     = 1000
+)
+
+// ListQuery holds the pagination, sorting and filter parameters of a listing request.
+// Zero values disable the corresponding filter, except for MaxSize and MaxWords, which are -1 when
+// unbounded since zero is a valid bound.
+type ListQuery struct {
+	Limit      int
+	Cursor     string
+	SortBy     string
+	Descending bool
+
+	Prefix     string
+	Glob       string
+	HashPrefix string
+	MinSize    int64
+	MaxSize    int64
+	MinWords   int
+	MaxWords   int
+}
+
+// ListPage is one page of a listing; Total counts every entry matching the filters.
+type ListPage struct {
+	Items      []FileDetails `json:"items"`
+	Total      int           `json:"total"`
+	NextCursor string        `json:"next_cursor,omitempty"`
+}
+
+// listCursor marks the last entry of a page. It carries the sort order so that a cursor cannot be
+// replayed against a differently sorted listing.
+type listCursor struct {
+	SortBy     string `json:"s"`
+	Descending bool   `json:"d"`
+	Filename   string `json:"n"`
+	Size       int64  `json:"z"`
+	WordCount  int    `json:"w"`
+}
+
+// parseListQuery reads the listing parameters from the query or form values. defaultLimit is used
+// when no limit is given; zero means unlimited.
+func parseListQuery(values url.Values, defaultLimit int) (ListQuery, error) {
+	query := ListQuery{
+		Limit:      defaultLimit,
+		Cursor:     values.Get("cursor"),
+		SortBy:     SortByName,
+		Prefix:     values.Get("prefix"),
+		Glob:       values.Get("glob"),
+		HashPrefix: strings.ToLower(values.Get("hash_prefix")),
+		MaxSize:    -1,
+		MaxWords:   -1,
+	}
+
+	var err error
+	if value := values.Get("limit"); value != "" {
+		query.Limit, err = strconv.Atoi(value)
+		if err != nil || query.Limit < 1 || query.Limit > MaxListLimit {
+			return query, fmt.Errorf("limit must be between 1 and %d", MaxListLimit)
+		}
+	}
+
+	switch value := values.Get("sort"); value {
+	case "", SortByName, SortBySize, SortByWordCount:
+		if value != "" {
+			query.SortBy = value
+		}
+	default:
+		return query, fmt.Errorf("sort must be one of %s, %s or %s", SortByName, SortBySize, SortByWordCount)
+	}
+
+	switch values.Get("order") {
+	case "", "asc":
+	case "desc":
+		query.Descending = true
+	default:
+		return query, fmt.Errorf("order must be asc or desc")
+	}
+
+	if query.Glob != "" {
+		if _, err := path.Match(query.Glob, ""); err != nil {
+			return query, fmt.Errorf("invalid glob pattern %s", query.Glob)
+		}
+	}
+
+	for name, target := range map[string]*int64{"min_size": &query.MinSize, "max_size": &query.MaxSize} {
+		if value := values.Get(name); value != "" {
+			*target, err = strconv.ParseInt(value, 10, 64)
+			if err != nil || *target < 0 {
+				return query, fmt.Errorf("%s must be a non-negative integer", name)
+			}
+		}
+	}
+	for name, target := range map[string]*int{"min_words": &query.MinWords, "max_words": &query.MaxWords} {
+		if value := values.Get(name); value != "" {
+			*target, err = strconv.Atoi(value)
+			if err != nil || *target < 0 {
+				return query, fmt.Errorf("%s must be a non-negative integer", name)
+			}
+		}
+	}
+	if query.MaxSize >= 0 && query.MinSize > query.MaxSize {
+		return query, fmt.Errorf("min_size must not be greater than max_size")
+	}
+	if query.MaxWords >= 0 && query.MinWords > query.MaxWords {
+		return query, fmt.Errorf("min_words must not be greater than max_words")
+	}
+
+	return query, nil
+}
+
+// filtered reports whether the query has any filter, so that it does not match every entry.
+func (q ListQuery) filtered() bool {
+	return q.Prefix != "" || q.Glob != "" || q.HashPrefix != "" || q.MinSize > 0 || q.MaxSize >= 0 ||
+		q.MinWords > 0 || q.MaxWords >= 0
+}
+
+// matches reports whether entry passes every filter of the query.
+func (q ListQuery) matches(entry FileDetails) bool {
+	if q.Prefix != "" && !strings.HasPrefix(entry.Filename, q.Prefix) {
+		return false
+	}
+	if q.Glob != "" {
+		if ok, _ := path.Match(q.Glob, entry.Filename); !ok {
+			return false
+		}
+	}
+	if q.HashPrefix != "" && !strings.HasPrefix(entry.FileHash, q.HashPrefix) {
+		return false
+	}
+	if entry.FileSize < q.MinSize || q.MaxSize >= 0 && entry.FileSize > q.MaxSize {
+		return false
+	}
+	if entry.WordCount < q.MinWords || q.MaxWords >= 0 && entry.WordCount > q.MaxWords {
+		return false
+	}
+	return true
+}
+
+// less orders two entries by the sort field of the query, falling back to the name so that the
+// order, and therefore every cursor, is stable.
+func (q ListQuery) less(a listCursor, b listCursor) bool {
+	var cmp int
+	switch q.SortBy {
+	case SortBySize:
+		cmp = compareInt64(a.Size, b.Size)
+	case SortByWordCount:
+		cmp = compareInt64(int64(a.WordCount), int64(b.WordCount))
+	}
+	if cmp == 0 {
+		cmp = strings.Compare(a.Filename, b.Filename)
+	}
+	if q.Descending {
+		return cmp > 0
+	}
+	return cmp < 0
+}
+
+func compareInt64(a int64, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func (q ListQuery) cursorOf(entry FileDetails) listCursor {
+	return listCursor{SortBy: q.SortBy, Descending: q.Descending, Filename: entry.Filename,
+		Size: entry.FileSize, WordCount: entry.WordCount}
+}
+
+func encodeCursor(cursor listCursor) string {
+	data, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeCursor(value string) (listCursor, error) {
+	var cursor listCursor
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err == nil {
+		err = json.Unmarshal(data, &cursor)
+	}
+	if err != nil {
+		return cursor, fmt.Errorf("invalid cursor")
+	}
+	return cursor, nil
+}
+
+// apply filters, sorts and paginates the given entries.
+func (q ListQuery) apply(entries []FileDetails) (ListPage, error) {
+	matching := make([]FileDetails, 0, len(entries))
+	for _, entry := range entries {
+		if q.matches(entry) {
+			matching = append(matching, entry)
+		}
+	}
+	sort.Slice(matching, func(i, j int) bool {
+		return q.less(q.cursorOf(matching[i]), q.cursorOf(matching[j]))
+	})
+
+	page := ListPage{Total: len(matching)}
+	start := 0
+	if q.Cursor != "" {
+		cursor, err := decodeCursor(q.Cursor)
+		if err != nil {
+			return page, err
+		}
+		if cursor.SortBy != q.SortBy || cursor.Descending != q.Descending {
+			return page, fmt.Errorf("cursor does not belong to this sort order")
+		}
+		// the cursor is a position, not an index, so entries added or removed before it are harmless
+		start = sort.Search(len(matching), func(i int) bool { return q.less(cursor, q.cursorOf(matching[i])) })
+	}
+
+	end := len(matching)
+	if q.Limit > 0 && start+q.Limit < end {
+		end = start + q.Limit
+		page.NextCursor = encodeCursor(q.cursorOf(matching[end-1]))
+	}
+	page.Items = matching[start:end]
+	return page, nil
+}
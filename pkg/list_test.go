@@ -0,0 +1,128 @@
+package pkg
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+var listTestEntries = []FileDetails{
+	{Filename: "b.txt", FileSize: 300, FileHash: "bb01", WordCount: 30},
+	{Filename: "a.txt", FileSize: 100, FileHash: "aa01", WordCount: 10},
+	{Filename: "docs/c.md", FileSize: 200, FileHash: "cc01", WordCount: 20},
+	{Filename: "docs/d.txt", FileSize: 200, FileHash: "dd01", WordCount: 40},
+}
+
+func TestListQueryPagination(t *testing.T) {
+	query, err := parseListQuery(url.Values{"limit": {"1"}, "sort": {"size"}, "order": {"desc"}}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	for {
+		page, err := query.apply(listTestEntries)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if page.Total != len(listTestEntries) {
+			t.Errorf("Expected a total of %d, got %d", len(listTestEntries), page.Total)
+		}
+		for _, item := range page.Items {
+			names = append(names, item.Filename)
+		}
+		if page.NextCursor == "" {
+			break
+		}
+		query.Cursor = page.NextCursor
+	}
+
+	// equal sizes are ordered by name, in the requested direction
+	expected := []string{"b.txt", "docs/d.txt", "docs/c.md", "a.txt"}
+	if len(names) != len(expected) {
+		t.Fatalf("Expected %v, got %v", expected, names)
+	}
+	for i := range expected {
+		if names[i] != expected[i] {
+			t.Errorf("Expected %v, got %v", expected, names)
+			break
+		}
+	}
+}
+
+func TestListQueryFilters(t *testing.T) {
+	for raw, expected := range map[string]int{
+		"prefix=docs/":              2,
+		"glob=*.txt":                2,
+		"glob=docs/*.txt":           1,
+		"min_size=150&max_size=250": 2,
+		"min_words=25":              2,
+		"hash_prefix=AA":            1,
+		"max_size=0":                0,
+		"max_words=0":               0,
+		"min_size=200&max_size=200": 2,
+	} {
+		values, err := url.ParseQuery(raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		query, err := parseListQuery(values, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		page, err := query.apply(listTestEntries)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if page.Total != expected || len(page.Items) != expected {
+			t.Errorf("%s: expected %d entries, got %d (%d items)", raw, expected, page.Total, len(page.Items))
+		}
+	}
+}
+
+func TestListQueryInvalid(t *testing.T) {
+	for _, raw := range []string{"limit=0", "sort=hash", "order=up", "glob=[", "min_size=-1",
+		"min_size=300&max_size=200", "min_words=1&max_words=0"} {
+		values, err := url.ParseQuery(raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := parseListQuery(values, 0); err == nil {
+			t.Errorf("%s: expected an error", raw)
+		}
+	}
+
+	query, err := parseListQuery(url.Values{"cursor": {"garbage"}}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := query.apply(listTestEntries); err == nil {
+		t.Errorf("Expected an error for an invalid cursor")
+	}
+}
+
+func TestListFilesV2Handler(t *testing.T) {
+	teardown := csvSetup(t)
+	defer teardown()
+
+	req := httptest.NewRequest("GET", FilesV2Collection+"?limit=2&sort=word_count", nil)
+	rr := httptest.NewRecorder()
+	listFilesV2Handler(rr, req)
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+	var page ListPage
+	err := json.Unmarshal(rr.Body.Bytes(), &page)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if page.Total != 3 || len(page.Items) != 2 || page.NextCursor == "" {
+		t.Errorf("Unexpected page: %+v", page)
+	}
+	if page.Items[0].WordCount > page.Items[1].WordCount {
+		t.Errorf("Expected the items to be sorted by word count: %+v", page.Items)
+	}
+}
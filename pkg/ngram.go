@@ -0,0 +1,196 @@
+package pkg
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// NGramQuery asks for the frequencies of sequences of N consecutive words. It accepts the options
+// of a word frequency query: normalization applies to every word, an n-gram is dropped if any of its
+// words is a stopword or shorter than MinLength, and include/exclude match the whole n-gram.
+type NGramQuery struct {
+	FrequencyQuery
+	N int
+	// Sentences drops the n-grams that span a sentence boundary.
+	Sentences bool
+}
+
+// parseNGramQuery reads an n-gram query from the request form values; n defaults to 2.
+func parseNGramQuery(values url.Values) (NGramQuery, error) {
+	frequencyQuery, err := parseFrequencyQuery(values)
+	if err != nil {
+		return NGramQuery{}, err
+	}
+	q := NGramQuery{FrequencyQuery: frequencyQuery, N: 2}
+
+	if values.Get("n") != "" {
+		q.N, err = strconv.Atoi(values.Get("n"))
+		if err != nil || q.N < 2 || q.N > 3 {
+			return q, errors.New("Invalid n value, expected 2 or 3")
+		}
+	}
+	if values.Get("sentences") != "" {
+		q.Sentences, err = strconv.ParseBool(values.Get("sentences"))
+		if err != nil {
+			return q, errors.New("Invalid sentences value")
+		}
+	}
+	return q, nil
+}
+
+// scanNGramFrequencies counts the n-grams of the files of the store covered by the query. N-grams are
+// not indexed, so every selected file is read with the configured number of workers.
+func scanNGramFrequencies(ctx context.Context, q NGramQuery) (Frequencies, error) {
+	config, err := GetConfig()
+	if err != nil {
+		return nil, err
+	}
+	match, err := q.fileMatcher()
+	if err != nil {
+		return nil, err
+	}
+	tokenizer := configuredTokenizer()
+	counts, err := countInDirectory(ctx, config.FileStore, config.FrequencyWorkers, match,
+		func(ctx context.Context, path string, counts map[string]int) error {
+			return countFileNGrams(ctx, path, tokenizer, q, counts)
+		})
+	if err != nil {
+		return nil, err
+	}
+	return selectFrequencies(counts, q.NoOfWords, q.MostFrequent, q.Offset), nil
+}
+
+// countFileNGrams adds the n-grams of the file at path to counts, each as its words joined by a
+// space. N-grams run across line breaks; with Sentences they restart after every sentence
+// terminator and blank line.
+func countFileNGrams(ctx context.Context, path string, tokenizer Tokenizer, q NGramQuery,
+	counts map[string]int) error {
+
+	if text, err := isTextFile(path); err != nil || !text {
+		return err
+	}
+	file, err := openDecoded(path)
+	if err != nil {
+		return err
+	}
+	defer CloseFile(file)
+
+	window := make([]string, 0, q.N)
+	add := func(word string) {
+		word = q.normalize(word)
+		if word == "" {
+			return
+		}
+		if len(window) == q.N {
+			copy(window, window[1:])
+			window = window[:q.N-1]
+		}
+		window = append(window, word)
+		if len(window) < q.N {
+			return
+		}
+		for _, word := range window {
+			if !q.keepWord(word) {
+				return
+			}
+		}
+		ngram := strings.Join(window, " ")
+		if q.matchesPatterns(ngram) {
+			counts[ngram]++
+		}
+	}
+
+	scanner := newLineScanner(file)
+	for n := 1; scanner.Scan(); n++ {
+		if n%cancelCheckInterval == 0 && ctx.Err() != nil {
+			return ctx.Err()
+		}
+		line := scanner.Text()
+		if !q.Sentences {
+			for _, word := range tokenizer.Tokens(line) {
+				add(word)
+			}
+			continue
+		}
+		if strings.TrimSpace(line) == "" {
+			window = window[:0]
+		}
+		for _, part := range splitSentences(line) {
+			for _, word := range tokenizer.Tokens(part.text) {
+				add(word)
+			}
+			if part.end {
+				window = window[:0]
+			}
+		}
+	}
+	return scanner.Err()
+}
+
+// sentencePart is a piece of a line; end is set if it closes a sentence.
+type sentencePart struct {
+	text string
+	end  bool
+}
+
+// splitSentences splits a line after every '.', '!' or '?' that is followed by white space or ends
+// the line, so that decimals such as 3.14 do not end a sentence.
+func splitSentences(line string) []sentencePart {
+	var parts []sentencePart
+	start := 0
+	runes := []rune(line)
+	for i, r := range runes {
+		if !strings.ContainsRune(".!?", r) {
+			continue
+		}
+		if i+1 < len(runes) && !unicode.IsSpace(runes[i+1]) {
+			continue
+		}
+		parts = append(parts, sentencePart{string(runes[start : i+1]), true})
+		start = i + 1
+	}
+	if start < len(runes) {
+		parts = append(parts, sentencePart{string(runes[start:]), false})
+	}
+	return parts
+}
+
+func ngramFrequencyHandler(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		log.Println("Error parsing the form:", err)
+		respondError(w, http.StatusBadRequest, ErrCodeInvalidRequest, "Error parsing the form")
+		return
+	}
+
+	query, err := parseNGramQuery(r.Form)
+	if err != nil {
+		log.Println("Error parsing the n-gram query:", err)
+		respondError(w, http.StatusBadRequest, ErrCodeInvalidRequest, err.Error())
+		return
+	}
+	var ok bool
+	if query.Readable, ok = readableFiles(w, r); !ok {
+		return
+	}
+
+	result, err := scanNGramFrequencies(r.Context(), query)
+	if err != nil {
+		log.Println("Error counting n-gram frequencies:", err)
+		respondError(w, http.StatusInternalServerError, ErrCodeInternal, "Error counting n-gram frequencies")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(result)
+	if err != nil {
+		log.Println("Error writing response:", err)
+	}
+}
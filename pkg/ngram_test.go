@@ -0,0 +1,91 @@
+package pkg
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func runNGrams(t *testing.T, query string) map[string]int {
+	values, err := url.ParseQuery(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q, err := parseNGramQuery(values)
+	if err != nil {
+		t.Fatalf("%s: %v", query, err)
+	}
+	result, err := scanNGramFrequencies(context.Background(), q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return frequencyMap(result)
+}
+
+func TestNGramFrequencies(t *testing.T) {
+	teardown := searchSetup(t)
+	defer teardown()
+
+	bigrams := runNGrams(t, "noOfWords=100&mostFrequent=true")
+	if bigrams["lazy dog"] != 2 || bigrams["the lazy"] != 2 || bigrams["quick brown"] != 1 {
+		t.Errorf("Unexpected bigrams: %v", bigrams)
+	}
+	// "dog. A" and "sleeps. The" cross a sentence boundary
+	if bigrams["dog a"] != 1 || bigrams["sleeps the"] != 1 {
+		t.Errorf("Expected bigrams across sentences without the option, got %v", bigrams)
+	}
+
+	sentences := runNGrams(t, "noOfWords=100&mostFrequent=true&sentences=true")
+	if sentences["dog a"] != 0 || sentences["sleeps the"] != 0 || sentences["lazy dog"] != 2 {
+		t.Errorf("Expected no bigram across sentences, got %v", sentences)
+	}
+
+	trigrams := runNGrams(t, "n=3&noOfWords=1&mostFrequent=true&filename=fox.txt&filename=dog.txt")
+	if len(trigrams) != 1 || trigrams["the lazy dog"] != 2 {
+		t.Errorf("Expected the lazy dog as the most frequent trigram, got %v", trigrams)
+	}
+
+	filtered := runNGrams(t, "noOfWords=100&mostFrequent=true&stopwords=english&prefix=dog")
+	if filtered["lazy dog"] != 1 || filtered["the lazy"] != 0 || filtered["dog is"] != 0 {
+		t.Errorf("Expected bigrams without stopwords in dog.txt, got %v", filtered)
+	}
+
+	for _, query := range []string{"n=1&noOfWords=1&mostFrequent=true", "n=4&noOfWords=1&mostFrequent=true",
+		"noOfWords=1&mostFrequent=true&sentences=maybe", "n=2&mostFrequent=true"} {
+		values, _ := url.ParseQuery(query)
+		if _, err := parseNGramQuery(values); err == nil {
+			t.Errorf("%q: expected an error", query)
+		}
+	}
+}
+
+func TestSplitSentences(t *testing.T) {
+	parts := splitSentences("Pi is 3.14. Really? yes")
+	if len(parts) != 3 || parts[0].text != "Pi is 3.14." || !parts[1].end || parts[2].end {
+		t.Errorf("Unexpected sentence parts: %+v", parts)
+	}
+}
+
+func TestNGramFrequencyHandler(t *testing.T) {
+	teardown := searchSetup(t)
+	defer teardown()
+
+	req := httptest.NewRequest("GET", "/api/v1/frequency/ngrams?noOfWords=2&mostFrequent=false&n=3", nil)
+	rr := httptest.NewRecorder()
+	ngramFrequencyHandler(rr, req)
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+	var result Frequencies
+	err := json.Unmarshal(rr.Body.Bytes(), &result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result) != 2 || result[0].Count != 1 || result[1].Count != 1 {
+		t.Errorf("Expected the 2 least frequent trigrams, got %v", result)
+	}
+}
@@ -0,0 +1,268 @@
+package pkg
+
+import (
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Endpoint classes a rate limit can be configured for. Analytics covers the endpoints that read
+// many files per request, such as the frequencies, search, grep and zip downloads. Auth limits the
+// failed authentications per IP address, whatever the endpoint, before credentials are verified.
+const (
+	RateClassRead      = "read"
+	RateClassAnalytics = "analytics"
+	RateClassWrite     = "write"
+	RateClassAdmin     = "admin"
+	RateClassAuth      = "auth"
+)
+
+var rateClasses = []string{RateClassRead, RateClassAnalytics, RateClassWrite, RateClassAdmin, RateClassAuth}
+
+// defaultAuthLimit applies to failed authentications unless the auth class is configured.
+var defaultAuthLimit = RateLimit{RequestsPerSecond: 1, Burst: 10}
+
+// bucketSweepInterval is how often the buckets that have refilled completely are dropped; a full
+// bucket behaves exactly like a missing one.
+const bucketSweepInterval = time.Minute
+
+// rateLimits is the configured limiter, nil when no endpoint class is limited.
+var rateLimits *rateLimiter
+
+// uploadSlots holds a token for every upload in progress, nil when uploads are not bounded.
+var uploadSlots chan struct{}
+
+// trustProxy identifies clients by the address the reverse proxy appended to X-Forwarded-For.
+var trustProxy bool
+
+// configureRateLimits sets up the rate limits and the concurrent upload bound of the configuration.
+func configureRateLimits(config Config) {
+	trustProxy = config.TrustProxy
+	rateLimits = newRateLimiter(config.RateLimits.Classes)
+	if rateLimits != nil && len(rateLimits.limits) > 1 {
+		log.Println("Rate limits enabled for", len(rateLimits.limits), "endpoint classes")
+	}
+	uploadSlots = nil
+	if config.RateLimits.MaxConcurrentUploads > 0 {
+		uploadSlots = make(chan struct{}, config.RateLimits.MaxConcurrentUploads)
+		log.Println("Concurrent uploads limited to", config.RateLimits.MaxConcurrentUploads)
+	}
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+	// full is when the bucket will have refilled completely.
+	full time.Time
+}
+
+// rateLimiter keeps a token bucket per endpoint class and client. A bucket holds up to Burst
+// tokens and refills at RequestsPerSecond; every request takes one token.
+type rateLimiter struct {
+	limits map[string]RateLimit
+	now    func() time.Time
+
+	mutex     sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+// newRateLimiter returns a limiter for the valid limits, which always limits failed
+// authentications.
+func newRateLimiter(classes map[string]RateLimit) *rateLimiter {
+	limits := map[string]RateLimit{RateClassAuth: defaultAuthLimit}
+	for class, limit := range classes {
+		if !containsString(rateClasses, class) {
+			log.Println("Ignoring the rate limit of unknown endpoint class", class)
+			continue
+		}
+		if limit.RequestsPerSecond <= 0 || limit.Burst < 0 {
+			log.Println("Ignoring the invalid rate limit of", class)
+			continue
+		}
+		if limit.Burst == 0 {
+			limit.Burst = max(1, int(math.Ceil(limit.RequestsPerSecond)))
+		}
+		limits[class] = limit
+	}
+	return &rateLimiter{limits: limits, now: time.Now, buckets: make(map[string]*tokenBucket)}
+}
+
+// take takes a token of the bucket of client for class. It returns zero if it succeeded, or else
+// how long the client has to wait for the next token.
+func (l *rateLimiter) take(class, client string) time.Duration {
+	limit, ok := l.limits[class]
+	if !ok {
+		return 0
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	now := l.now()
+	bucket := l.bucket(class, client, limit, now)
+	if bucket.tokens < 1 {
+		return time.Duration((1 - bucket.tokens) / limit.RequestsPerSecond * float64(time.Second))
+	}
+	bucket.tokens--
+	bucket.full = now.Add(time.Duration((float64(limit.Burst) - bucket.tokens) / limit.RequestsPerSecond * float64(time.Second)))
+	return 0
+}
+
+// wait returns how long client has to wait for a token of class, without taking it.
+func (l *rateLimiter) wait(class, client string) time.Duration {
+	limit, ok := l.limits[class]
+	if !ok {
+		return 0
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	bucket := l.bucket(class, client, limit, l.now())
+	if bucket.tokens < 1 {
+		return time.Duration((1 - bucket.tokens) / limit.RequestsPerSecond * float64(time.Second))
+	}
+	return 0
+}
+
+// bucket returns the bucket of client for class, refilled up to now. The mutex must be held.
+func (l *rateLimiter) bucket(class, client string, limit RateLimit, now time.Time) *tokenBucket {
+	l.sweep(now)
+	key := class + " " + client
+	bucket := l.buckets[key]
+	if bucket == nil {
+		bucket = &tokenBucket{tokens: float64(limit.Burst), last: now}
+		l.buckets[key] = bucket
+	}
+	if elapsed := now.Sub(bucket.last); elapsed > 0 {
+		bucket.tokens = math.Min(float64(limit.Burst), bucket.tokens+elapsed.Seconds()*limit.RequestsPerSecond)
+		bucket.last = now
+	}
+	return bucket
+}
+
+// sweep drops the buckets that are full again, so that the map does not grow with every client
+// ever seen. The mutex must be held.
+func (l *rateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < bucketSweepInterval {
+		return
+	}
+	l.lastSweep = now
+	for key, bucket := range l.buckets {
+		if !bucket.full.After(now) {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// clientOf identifies who sent r for rate limiting: the authenticated caller, or else its address.
+func clientOf(r *http.Request) string {
+	if caller := callerFrom(r.Context()); caller != nil {
+		return "caller:" + caller.Subject
+	}
+	return "ip:" + clientAddress(r)
+}
+
+// clientAddress returns the IP address r was sent from. Behind a trusted reverse proxy this is the
+// last address of X-Forwarded-For, the one appended by the proxy; earlier ones can be forged.
+func clientAddress(r *http.Request) string {
+	if trustProxy {
+		forwarded := r.Header.Values("X-Forwarded-For")
+		if len(forwarded) > 0 {
+			addresses := strings.Split(forwarded[len(forwarded)-1], ",")
+			if address := strings.TrimSpace(addresses[len(addresses)-1]); address != "" {
+				return address
+			}
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// respondRateLimited answers 429 with a Retry-After header of at least one second.
+func respondRateLimited(w http.ResponseWriter, retryAfter time.Duration, message string) {
+	seconds := max(1, int(math.Ceil(retryAfter.Seconds())))
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	respondError(w, http.StatusTooManyRequests, ErrCodeRateLimited, message)
+}
+
+// rateLimit takes a token of the client's bucket for the endpoint class before calling next, and
+// answers 429 when the bucket is empty. Wrapped by requireScope, it limits authenticated callers by
+// their subject wherever they connect from.
+func rateLimit(class string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		limiter := rateLimits
+		if limiter == nil {
+			next(w, r)
+			return
+		}
+		client := clientOf(r)
+		if wait := limiter.take(class, client); wait > 0 {
+			log.Println("Rate limit of", class, "requests exceeded by", client)
+			respondRateLimited(w, wait, "Too many requests, retry later")
+			return
+		}
+		next(w, r)
+	}
+}
+
+// authThrottled answers 429 and returns true if the address of r failed to authenticate too
+// often; it is checked before the credentials are verified, so that guessing tokens and making the
+// server verify forged JWTs are limited too.
+func authThrottled(w http.ResponseWriter, r *http.Request) bool {
+	limiter := rateLimits
+	if limiter == nil {
+		return false
+	}
+	client := "ip:" + clientAddress(r)
+	if wait := limiter.wait(RateClassAuth, client); wait > 0 {
+		log.Println("Too many failed authentications from", client)
+		respondRateLimited(w, wait, "Too many failed authentications, retry later")
+		return true
+	}
+	return false
+}
+
+// recordAuthFailure charges a failed authentication to the address of r.
+func recordAuthFailure(r *http.Request) {
+	if limiter := rateLimits; limiter != nil {
+		limiter.take(RateClassAuth, "ip:"+clientAddress(r))
+	}
+}
+
+// rateLimitMethods limits GET and HEAD requests as reads and all other methods as writes.
+func rateLimitMethods(next http.HandlerFunc) http.HandlerFunc {
+	read, write := rateLimit(RateClassRead, next), rateLimit(RateClassWrite, next)
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			read(w, r)
+			return
+		}
+		write(w, r)
+	}
+}
+
+// limitUploads holds an upload slot while next handles a POST or PUT, which carry the uploaded
+// content, and answers 429 when all slots are taken.
+func limitUploads(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		slots := uploadSlots
+		if slots == nil || (r.Method != http.MethodPost && r.Method != http.MethodPut) {
+			next(w, r)
+			return
+		}
+		select {
+		case slots <- struct{}{}:
+			defer func() { <-slots }()
+			next(w, r)
+		default:
+			log.Println("Upload refused, all", cap(slots), "upload slots are in use")
+			respondRateLimited(w, time.Second, "Too many concurrent uploads, retry later")
+		}
+	}
+}
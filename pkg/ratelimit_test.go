@@ -0,0 +1,168 @@
+package pkg
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterTake(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	limiter := newRateLimiter(map[string]RateLimit{
+		RateClassAnalytics: {RequestsPerSecond: 0.5, Burst: 2},
+		"unknown":          {RequestsPerSecond: 1},
+		RateClassWrite:     {RequestsPerSecond: 0},
+	})
+	limiter.now = func() time.Time { return now }
+	if len(limiter.limits) != 2 || limiter.limits[RateClassAuth] != defaultAuthLimit {
+		t.Fatalf("Expected only the valid limit and the default auth limit to be kept, got %v", limiter.limits)
+	}
+
+	for i := 0; i < 2; i++ {
+		if wait := limiter.take(RateClassAnalytics, "ip:192.0.2.1"); wait != 0 {
+			t.Fatalf("Expected request %d to be within the burst, got a wait of %v", i+1, wait)
+		}
+	}
+	if wait := limiter.take(RateClassAnalytics, "ip:192.0.2.1"); wait != 2*time.Second {
+		t.Errorf("Expected a wait of 2s for the next token, got %v", wait)
+	}
+	if wait := limiter.take(RateClassAnalytics, "ip:192.0.2.2"); wait != 0 {
+		t.Errorf("Expected another client to have its own bucket, got a wait of %v", wait)
+	}
+	if wait := limiter.take(RateClassRead, "ip:192.0.2.1"); wait != 0 {
+		t.Errorf("Expected an unlimited class not to wait, got %v", wait)
+	}
+
+	now = now.Add(1500 * time.Millisecond)
+	if wait := limiter.take(RateClassAnalytics, "ip:192.0.2.1"); wait != 500*time.Millisecond {
+		t.Errorf("Expected a wait of 500ms after a partial refill, got %v", wait)
+	}
+	now = now.Add(500 * time.Millisecond)
+	if wait := limiter.take(RateClassAnalytics, "ip:192.0.2.1"); wait != 0 {
+		t.Errorf("Expected the refilled token to be taken, got a wait of %v", wait)
+	}
+
+	now = now.Add(bucketSweepInterval)
+	limiter.take(RateClassAnalytics, "ip:192.0.2.3")
+	if len(limiter.buckets) != 1 {
+		t.Errorf("Expected the full buckets to be swept, got %d buckets", len(limiter.buckets))
+	}
+}
+
+func TestRateLimitMiddleware(t *testing.T) {
+	previousLimits, previousTrust := rateLimits, trustProxy
+	defer func() { rateLimits, trustProxy = previousLimits, previousTrust }()
+	rateLimits = newRateLimiter(map[string]RateLimit{RateClassAnalytics: {RequestsPerSecond: 1}})
+
+	handler := rateLimit(RateClassAnalytics, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	request := func(forwardedFor string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/api/v1/frequency", nil)
+		if forwardedFor != "" {
+			req.Header.Set("X-Forwarded-For", forwardedFor)
+		}
+		rr := httptest.NewRecorder()
+		handler(rr, req)
+		return rr
+	}
+
+	if rr := request(""); rr.Code != http.StatusOK {
+		t.Fatalf("Expected the first request to pass, got %d", rr.Code)
+	}
+	rr := request("198.51.100.7")
+	if rr.Code != http.StatusTooManyRequests || rr.Header().Get("Retry-After") != "1" {
+		t.Fatalf("Expected 429 with Retry-After 1, got %d %q", rr.Code, rr.Header().Get("Retry-After"))
+	}
+	var apiError APIError
+	if err := json.Unmarshal(rr.Body.Bytes(), &apiError); err != nil || apiError.Code != ErrCodeRateLimited {
+		t.Errorf("Expected the %s error code, got %s", ErrCodeRateLimited, rr.Body.String())
+	}
+
+	// behind a proxy the address it appended identifies the client, not the forged first one
+	trustProxy = true
+	if rr := request("203.0.113.1, 198.51.100.7"); rr.Code != http.StatusOK {
+		t.Errorf("Expected a forwarded client to have its own bucket, got %d", rr.Code)
+	}
+	if rr := request("203.0.113.2, 198.51.100.7"); rr.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected the forged address to be ignored, got %d", rr.Code)
+	}
+}
+
+func TestFailedAuthenticationsThrottled(t *testing.T) {
+	previousLimits, previousAuthenticators := rateLimits, authenticators
+	defer func() { rateLimits, authenticators = previousLimits, previousAuthenticators }()
+	rateLimits = newRateLimiter(map[string]RateLimit{RateClassAuth: {RequestsPerSecond: 0.1, Burst: 3}})
+	authenticators = []Authenticator{staticCallers{"alice": {Subject: "alice", Scopes: []string{ScopeRead}}}}
+
+	handler := requireScope(ScopeRead, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	request := func(token, address string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/api/v1/list", nil)
+		req.RemoteAddr = address + ":1234"
+		req.Header.Set("Authorization", "Bearer "+token)
+		rr := httptest.NewRecorder()
+		handler(rr, req)
+		return rr
+	}
+
+	if rr := request("alice", "192.0.2.1"); rr.Code != http.StatusOK {
+		t.Fatalf("Expected a valid token to pass, got %d", rr.Code)
+	}
+	for i := 0; i < 3; i++ {
+		if rr := request("guess", "192.0.2.1"); rr.Code != http.StatusUnauthorized {
+			t.Fatalf("Expected guess %d to be refused with 401, got %d", i+1, rr.Code)
+		}
+	}
+	rr := request("guess", "192.0.2.1")
+	if rr.Code != http.StatusTooManyRequests || rr.Header().Get("Retry-After") != "10" {
+		t.Fatalf("Expected 429 with Retry-After 10 once the guesses are used up, got %d %q", rr.Code, rr.Header().Get("Retry-After"))
+	}
+	if rr := request("alice", "192.0.2.1"); rr.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected the address to be throttled before its credentials are verified, got %d", rr.Code)
+	}
+	if rr := request("alice", "192.0.2.2"); rr.Code != http.StatusOK {
+		t.Errorf("Expected another address not to be throttled, got %d", rr.Code)
+	}
+}
+
+func TestLimitUploads(t *testing.T) {
+	previousSlots := uploadSlots
+	defer func() { uploadSlots = previousSlots }()
+	uploadSlots = make(chan struct{}, 1)
+
+	started, release := make(chan struct{}), make(chan struct{})
+	handler := limitUploads(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPut {
+			close(started)
+			<-release
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+	request := func(method string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		handler(rr, httptest.NewRequest(method, FilesV2Prefix+"fox.txt", nil))
+		return rr
+	}
+
+	done := make(chan int)
+	go func() { done <- request("PUT").Code }()
+	<-started
+	rr := request("POST")
+	if rr.Code != http.StatusTooManyRequests || rr.Header().Get("Retry-After") == "" {
+		t.Errorf("Expected a second upload to be refused with Retry-After, got %d", rr.Code)
+	}
+	if rr := request("GET"); rr.Code != http.StatusOK {
+		t.Errorf("Expected downloads not to take an upload slot, got %d", rr.Code)
+	}
+	close(release)
+	if code := <-done; code != http.StatusOK {
+		t.Errorf("Expected the first upload to complete, got %d", code)
+	}
+	if rr := request("POST"); rr.Code != http.StatusOK {
+		t.Errorf("Expected the released slot to be reused, got %d", rr.Code)
+	}
+}
@@ -0,0 +1,410 @@
+package pkg
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	defaultSearchLimit = 20
+	maxSnippets        = 3
+	maxSnippetLength   = 200
+)
+
+// SearchResult is a file matching a search query. Hits counts the occurrences of the matched terms
+// and phrases; files only selected through NOT have no hits.
+type SearchResult struct {
+	Filename string   `json:"filename"`
+	Hits     int      `json:"hits"`
+	Snippets []string `json:"snippets"`
+}
+
+// SearchResponse is the JSON body returned by searchHandler.
+type SearchResponse struct {
+	Query   string         `json:"query"`
+	Total   int            `json:"total"`
+	Results []SearchResult `json:"results"`
+}
+
+// searchNode is a node of a parsed query. eval returns the matching files and their hit counts.
+type searchNode interface {
+	eval(idx *InvertedIndex) map[string]int
+	// terms returns the terms that make a file match, i.e. everything outside NOT, for snippets.
+	terms() []string
+}
+
+type termNode struct{ term string }
+type phraseNode struct{ words []string }
+type andNode struct{ left, right searchNode }
+type orNode struct{ left, right searchNode }
+type notNode struct{ child searchNode }
+
+func (n termNode) eval(idx *InvertedIndex) map[string]int {
+	result := make(map[string]int)
+	for file, positions := range idx.Postings[n.term] {
+		result[file] = len(positions)
+	}
+	return result
+}
+
+func (n termNode) terms() []string { return []string{n.term} }
+
+// eval counts the positions at which every word of the phrase follows its predecessor.
+func (n phraseNode) eval(idx *InvertedIndex) map[string]int {
+	result := make(map[string]int)
+	for file, starts := range idx.Postings[n.words[0]] {
+		hits := 0
+		for _, start := range starts {
+			match := true
+			for i, word := range n.words[1:] {
+				positions := idx.Postings[word][file]
+				j := sort.SearchInts(positions, start+i+1)
+				if j == len(positions) || positions[j] != start+i+1 {
+					match = false
+					break
+				}
+			}
+			if match {
+				hits++
+			}
+		}
+		if hits > 0 {
+			result[file] = hits
+		}
+	}
+	return result
+}
+
+func (n phraseNode) terms() []string { return n.words }
+
+func (n andNode) eval(idx *InvertedIndex) map[string]int {
+	left, right := n.left.eval(idx), n.right.eval(idx)
+	result := make(map[string]int)
+	for file, hits := range left {
+		if other, ok := right[file]; ok {
+			result[file] = hits + other
+		}
+	}
+	return result
+}
+
+func (n andNode) terms() []string { return append(n.left.terms(), n.right.terms()...) }
+
+func (n orNode) eval(idx *InvertedIndex) map[string]int {
+	result := n.left.eval(idx)
+	for file, hits := range n.right.eval(idx) {
+		result[file] += hits
+	}
+	return result
+}
+
+func (n orNode) terms() []string { return append(n.left.terms(), n.right.terms()...) }
+
+func (n notNode) eval(idx *InvertedIndex) map[string]int {
+	excluded := n.child.eval(idx)
+	result := make(map[string]int)
+	for file := range idx.Files {
+		if _, ok := excluded[file]; !ok {
+			result[file] = 0
+		}
+	}
+	return result
+}
+
+func (n notNode) terms() []string { return nil }
+
+// searchParser is a recursive descent parser for the query language:
+//
+//	query  := and ("OR" and)*
+//	and    := unary (["AND"] unary)*
+//	unary  := "NOT" unary | "(" query ")" | "\"phrase\"" | term
+//
+// The operators must be written in upper case; in lower case they are ordinary terms.
+type searchParser struct {
+	tokens []string
+	pos    int
+	// tokenizer splits the words of the query the way the indexed files were split
+	tokenizer Tokenizer
+}
+
+var errEmptyQuery = errors.New("query is empty")
+
+// parseSearchQuery parses a query into a tree of searchNodes.
+func parseSearchQuery(query string) (searchNode, error) {
+	tokens, err := lexSearchQuery(query)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, errEmptyQuery
+	}
+	parser := &searchParser{tokens: tokens, tokenizer: configuredTokenizer()}
+	node, err := parser.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if parser.pos < len(parser.tokens) {
+		return nil, fmt.Errorf("unexpected %s", parser.tokens[parser.pos])
+	}
+	return node, nil
+}
+
+// lexSearchQuery splits a query into parentheses, quoted phrases (kept with their quotes) and words.
+func lexSearchQuery(query string) ([]string, error) {
+	var tokens []string
+	runes := []rune(query)
+	for i := 0; i < len(runes); {
+		switch r := runes[i]; {
+		case unicode.IsSpace(r):
+			i++
+		case r == '(' || r == ')':
+			tokens = append(tokens, string(r))
+			i++
+		case r == '"':
+			end := i + 1
+			for end < len(runes) && runes[end] != '"' {
+				end++
+			}
+			if end == len(runes) {
+				return nil, errors.New("unterminated phrase")
+			}
+			tokens = append(tokens, string(runes[i:end+1]))
+			i = end + 1
+		default:
+			end := i
+			for end < len(runes) && !unicode.IsSpace(runes[end]) && !strings.ContainsRune(`()"`, runes[end]) {
+				end++
+			}
+			tokens = append(tokens, string(runes[i:end]))
+			i = end
+		}
+	}
+	return tokens, nil
+}
+
+func (p *searchParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+func (p *searchParser) parseOr() (searchNode, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "OR" {
+		p.pos++
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = orNode{left, right}
+	}
+	return left, nil
+}
+
+func (p *searchParser) parseAnd() (searchNode, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		next := p.peek()
+		if next == "" || next == "OR" || next == ")" {
+			return left, nil
+		}
+		if next == "AND" {
+			p.pos++
+		}
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = andNode{left, right}
+	}
+}
+
+func (p *searchParser) parseUnary() (searchNode, error) {
+	token := p.peek()
+	p.pos++
+	switch {
+	case token == "":
+		return nil, errors.New("unexpected end of query")
+	case token == "NOT":
+		child, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return notNode{child}, nil
+	case token == "(":
+		node, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != ")" {
+			return nil, errors.New("missing closing parenthesis")
+		}
+		p.pos++
+		return node, nil
+	case token == ")" || token == "AND" || token == "OR":
+		return nil, fmt.Errorf("unexpected %s", token)
+	}
+
+	words := p.tokenizer.Tokens(strings.Trim(token, `"`))
+	switch len(words) {
+	case 0:
+		return nil, fmt.Errorf("%s contains no searchable word", token)
+	case 1:
+		return termNode{words[0]}, nil
+	}
+	// a quoted phrase, or a single word that splits into several terms such as "don't"
+	return phraseNode{words}, nil
+}
+
+// searchFiles evaluates a parsed query and returns the matching files ordered by hits, then name.
+func searchFiles(node searchNode) []SearchResult {
+	searchIndex.mu.Lock()
+	searchIndex.ensureLoaded()
+	searchIndex.mu.Unlock()
+
+	searchIndex.mu.RLock()
+	matches := node.eval(searchIndex)
+	searchIndex.mu.RUnlock()
+
+	results := make([]SearchResult, 0, len(matches))
+	for file, hits := range matches {
+		results = append(results, SearchResult{Filename: file, Hits: hits})
+	}
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Hits != results[j].Hits {
+			return results[i].Hits > results[j].Hits
+		}
+		return results[i].Filename < results[j].Filename
+	})
+	return results
+}
+
+// findSnippets returns up to maxSnippets lines of a stored file containing any of the terms.
+func findSnippets(filename string, terms []string) []string {
+	snippets := make([]string, 0)
+	if len(terms) == 0 {
+		return snippets
+	}
+	wanted := make(map[string]bool, len(terms))
+	for _, term := range terms {
+		wanted[term] = true
+	}
+
+	filePath, err := getFileStorePath(filename)
+	if err != nil {
+		return snippets
+	}
+	file, err := openDecoded(filePath)
+	if err != nil {
+		log.Println("Error opening the file for snippets:", err)
+		return snippets
+	}
+	defer CloseFile(file)
+
+	tokenizer := configuredTokenizer()
+	scanner := newLineScanner(file)
+	for scanner.Scan() && len(snippets) < maxSnippets {
+		line := scanner.Text()
+		for _, token := range tokenizer.Tokens(line) {
+			if wanted[token] {
+				snippets = append(snippets, trimSnippet(line, token))
+				break
+			}
+		}
+	}
+	return snippets
+}
+
+// trimSnippet shortens a long line to a window around the first occurrence of term.
+func trimSnippet(line string, term string) string {
+	line = strings.TrimSpace(line)
+	runes := []rune(line)
+	if len(runes) <= maxSnippetLength {
+		return line
+	}
+	at := 0
+	lower := strings.ToLower(line)
+	if i := strings.Index(lower, term); i >= 0 {
+		at = utf8.RuneCountInString(lower[:i])
+	}
+	start := max(at-maxSnippetLength/2, 0)
+	end := min(start+maxSnippetLength, len(runes))
+	start = max(end-maxSnippetLength, 0)
+	snippet := string(runes[start:end])
+	if start > 0 {
+		snippet = "…" + snippet
+	}
+	if end < len(runes) {
+		snippet += "…"
+	}
+	return snippet
+}
+
+// searchHandler answers full-text queries over the stored files. The "q" parameter supports terms,
+// "quoted phrases", AND (also implied between terms), OR, NOT and parentheses.
+func searchHandler(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		log.Println("Error parsing the form:", err)
+		respondError(w, http.StatusBadRequest, ErrCodeInvalidRequest, "Error parsing the form")
+		return
+	}
+
+	query := r.FormValue("q")
+	if query == "" {
+		respondError(w, http.StatusBadRequest, ErrCodeMissingField, "field q is missing")
+		return
+	}
+
+	limit := defaultSearchLimit
+	if value := r.FormValue("limit"); value != "" {
+		limit, err = strconv.Atoi(value)
+		if err != nil || limit < 1 {
+			respondError(w, http.StatusBadRequest, ErrCodeInvalidRequest, "Invalid limit value")
+			return
+		}
+	}
+
+	node, err := parseSearchQuery(query)
+	if err != nil {
+		respondErrorDetails(w, http.StatusBadRequest, ErrCodeInvalidRequest, "Invalid query", err.Error())
+		return
+	}
+
+	readable, ok := readableFiles(w, r)
+	if !ok {
+		return
+	}
+	results := make([]SearchResult, 0)
+	for _, result := range searchFiles(node) {
+		if readable.contains(result.Filename) {
+			results = append(results, result)
+		}
+	}
+	response := SearchResponse{Query: query, Total: len(results), Results: results[:min(limit, len(results))]}
+	terms := node.terms()
+	for i := range response.Results {
+		response.Results[i].Snippets = findSnippets(response.Results[i].Filename, terms)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(response)
+	if err != nil {
+		log.Println("Error encoding search results to JSON:", err)
+	}
+}
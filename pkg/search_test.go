@@ -0,0 +1,137 @@
+package pkg
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+)
+
+// searchSetup stores three small files through the regular store path so that the index follows.
+func searchSetup(t *testing.T) func() {
+	TestCleanCSV(t)
+	for name, content := range map[string]string{
+		"fox.txt":   "The quick brown fox jumps over the lazy dog.\nA fox is quick.",
+		"dog.txt":   "The lazy dog sleeps. The dog is brown.",
+		"other.txt": "Nothing to see here, quick as it is.",
+	} {
+		_, err := storeFile(name, strings.NewReader(content), StoreOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return func() {
+		teardown()
+	}
+}
+
+func runSearch(t *testing.T, query string) map[string]int {
+	node, err := parseSearchQuery(query)
+	if err != nil {
+		t.Fatalf("%s: %v", query, err)
+	}
+	hits := make(map[string]int)
+	for _, result := range searchFiles(node) {
+		hits[result.Filename] = result.Hits
+	}
+	return hits
+}
+
+func TestSearchQueries(t *testing.T) {
+	teardown := searchSetup(t)
+	defer teardown()
+
+	for query, expected := range map[string]map[string]int{
+		"fox":                               {"fox.txt": 2},
+		"FOX":                               {"fox.txt": 2},
+		"quick AND brown":                   {"fox.txt": 3},
+		"quick brown":                       {"fox.txt": 3},
+		"fox OR sleeps":                     {"fox.txt": 2, "dog.txt": 1},
+		"quick NOT fox":                     {"other.txt": 1},
+		`"lazy dog"`:                        {"fox.txt": 1, "dog.txt": 1},
+		`"dog lazy"`:                        {},
+		`(fox OR sleeps) NOT "quick brown"`: {"dog.txt": 1},
+	} {
+		hits := runSearch(t, query)
+		if len(hits) != len(expected) {
+			t.Errorf("%s: expected %v, got %v", query, expected, hits)
+			continue
+		}
+		for file, count := range expected {
+			if hits[file] != count {
+				t.Errorf("%s: expected %v, got %v", query, expected, hits)
+				break
+			}
+		}
+	}
+
+	for _, query := range []string{"", "fox AND", "(fox", `"fox`, "OR fox", "..."} {
+		if _, err := parseSearchQuery(query); err == nil {
+			t.Errorf("%q: expected a parse error", query)
+		}
+	}
+}
+
+func TestSearchIndexFollowsUpdates(t *testing.T) {
+	teardown := searchSetup(t)
+	defer teardown()
+
+	record, err := findByName("fox.txt")
+	if err != nil || record == nil {
+		t.Fatalf("Expected a record for fox.txt: %v", err)
+	}
+	err = ManageFileUpdate(false, "renamed.txt", *record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hits := runSearch(t, "fox"); hits["renamed.txt"] != 2 || len(hits) != 1 {
+		t.Errorf("Expected the renamed file to be found, got %v", hits)
+	}
+
+	err = removeStoredFile("renamed.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hits := runSearch(t, "fox"); len(hits) != 0 {
+		t.Errorf("Expected no result after the delete, got %v", hits)
+	}
+
+	// the persisted index must match the in-memory one after a reload
+	flushIndexes()
+	searchIndex.mu.Lock()
+	searchIndex.loaded = false
+	searchIndex.mu.Unlock()
+	if _, err := os.Stat(SearchIndexLocation); err != nil {
+		t.Fatalf("Expected the index to be persisted: %v", err)
+	}
+	if hits := runSearch(t, "sleeps"); hits["dog.txt"] != 1 {
+		t.Errorf("Expected dog.txt after reloading the index, got %v", hits)
+	}
+}
+
+func TestSearchHandler(t *testing.T) {
+	teardown := searchSetup(t)
+	defer teardown()
+
+	req := httptest.NewRequest("GET", "/api/v1/search?"+url.Values{"q": {`"lazy dog"`}, "limit": {"1"}}.Encode(), nil)
+	rr := httptest.NewRecorder()
+	searchHandler(rr, req)
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+	var response SearchResponse
+	err := json.Unmarshal(rr.Body.Bytes(), &response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.Total != 2 || len(response.Results) != 1 {
+		t.Fatalf("Unexpected response: %+v", response)
+	}
+	if len(response.Results[0].Snippets) == 0 || !strings.Contains(response.Results[0].Snippets[0], "lazy dog") {
+		t.Errorf("Expected a snippet containing the phrase, got %v", response.Results[0].Snippets)
+	}
+}
@@ -0,0 +1,182 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"log"
+	"sync"
+)
+
+var SearchIndexLocation string = func() string {
+	path, err := RecordStorePath("searchIndex.json")
+	if err != nil {
+		log.Fatal(err)
+	}
+	return path
+}()
+
+// searchIndex is the inverted index of every stored file. It is kept in sync with the record store
+// through the RecordListener hooks and persisted next to the CSV records.
+var searchIndex = &InvertedIndex{}
+
+func init() {
+	searchIndex.saver = newDeferredSave(SearchIndexLocation, searchIndex, &searchIndex.mu)
+	registerRecordListener(searchIndex)
+}
+
+// InvertedIndex maps every term to the files containing it and the token positions of each
+// occurrence, which is what phrase queries need.
+type InvertedIndex struct {
+	mu     sync.RWMutex
+	loaded bool
+	saver  *deferredSave
+
+	// Postings maps term -> filename -> positions of the term in the file.
+	Postings map[string]map[string][]int `json:"postings"`
+	// Files maps every indexed file to its distinct terms, so a file can be removed without
+	// scanning the whole vocabulary.
+	Files map[string][]string `json:"files"`
+	// Tokenizer is the name of the tokenizer the index was built with.
+	Tokenizer string `json:"tokenizer"`
+}
+
+// tokenizeStoredFile returns the positions of every term of a stored file; files that do not hold
+// text have none.
+func tokenizeStoredFile(filename string) (map[string][]int, error) {
+	filePath, err := getFileStorePath(filename)
+	if err != nil {
+		return nil, err
+	}
+	positions := make(map[string][]int)
+	if text, err := isTextFile(filePath); err != nil || !text {
+		return positions, err
+	}
+	file, err := openDecoded(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer CloseFile(file)
+
+	position := 0
+	err = scanTokens(context.Background(), file, configuredTokenizer(), func(term string) {
+		positions[term] = append(positions[term], position)
+		position++
+	})
+	return positions, err
+}
+
+// ensureLoaded loads the persisted index, or rebuilds it from the stored files if there is none or
+// if it was built with another tokenizer than the configured one. The caller must hold the write lock.
+func (idx *InvertedIndex) ensureLoaded() {
+	tokenizer := configuredTokenizer().Name()
+	if idx.loaded && idx.Tokenizer == tokenizer {
+		return
+	}
+	reload := !idx.loaded
+	idx.loaded = true
+	idx.Postings = make(map[string]map[string][]int)
+	idx.Files = make(map[string][]string)
+
+	if reload {
+		err := loadJSON(SearchIndexLocation, idx)
+		if err == nil && idx.Tokenizer == tokenizer {
+			return
+		}
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			log.Println("Error reading the search index, rebuilding it:", err)
+		}
+	}
+
+	idx.Postings = make(map[string]map[string][]int)
+	idx.Files = make(map[string][]string)
+	idx.Tokenizer = tokenizer
+	entries, err := getAllEntries()
+	if err != nil {
+		log.Println("Error getting all entries to rebuild the search index:", err)
+		return
+	}
+	for _, entry := range entries {
+		idx.add(entry.Filename)
+	}
+	idx.save()
+}
+
+// add (re-)indexes a stored file. The caller must hold the write lock.
+func (idx *InvertedIndex) add(filename string) {
+	positions, err := tokenizeStoredFile(filename)
+	if err != nil {
+		log.Println("Error indexing the file", filename, err)
+		return
+	}
+	idx.remove(filename)
+
+	terms := make([]string, 0, len(positions))
+	for term, termPositions := range positions {
+		if idx.Postings[term] == nil {
+			idx.Postings[term] = make(map[string][]int)
+		}
+		idx.Postings[term][filename] = termPositions
+		terms = append(terms, term)
+	}
+	idx.Files[filename] = terms
+}
+
+// remove drops a file from the index. The caller must hold the write lock.
+func (idx *InvertedIndex) remove(filename string) {
+	for _, term := range idx.Files[filename] {
+		delete(idx.Postings[term], filename)
+		if len(idx.Postings[term]) == 0 {
+			delete(idx.Postings, term)
+		}
+	}
+	delete(idx.Files, filename)
+}
+
+// save persists the index in the background. The caller must hold the write lock.
+func (idx *InvertedIndex) save() {
+	idx.saver.schedule()
+}
+
+func (idx *InvertedIndex) RecordStored(details FileDetails) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.ensureLoaded()
+	idx.add(details.Filename)
+	idx.save()
+}
+
+func (idx *InvertedIndex) RecordDeleted(filename string) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.ensureLoaded()
+	idx.remove(filename)
+	idx.save()
+}
+
+func (idx *InvertedIndex) RecordRenamed(oldName string, details FileDetails) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.ensureLoaded()
+	terms, ok := idx.Files[oldName]
+	if !ok || oldName == details.Filename {
+		return
+	}
+	for _, term := range terms {
+		idx.Postings[term][details.Filename] = idx.Postings[term][oldName]
+		delete(idx.Postings[term], oldName)
+	}
+	idx.Files[details.Filename] = terms
+	delete(idx.Files, oldName)
+	idx.save()
+}
+
+func (idx *InvertedIndex) RecordsCleared() {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.loaded = true
+	idx.Postings = make(map[string]map[string][]int)
+	idx.Files = make(map[string][]string)
+	idx.Tokenizer = configuredTokenizer().Name()
+	idx.save()
+}
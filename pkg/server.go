@@ -1,37 +1,89 @@
 package pkg
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
 	"strconv"
+	"syscall"
 )
 
-func Serve(port string) {
-	http.HandleFunc("/", rootHandler)
-	http.HandleFunc("/api/v1/store", storeHandler)
-	http.HandleFunc("/api/v1/update", updateHandler)
-	http.HandleFunc("/api/v1/exists", existenceCheckHandler)
-	http.HandleFunc("/api/v1/list", listHandler)
-	http.HandleFunc("/api/v1/delete", deleteHandler)
-	http.HandleFunc("/api/v1/frequency", wordFrequencyHandler)
+// Serve serves the API on the listen address, or the one of the environment or the config when
+// empty, until SIGINT or SIGTERM; it then drains the requests in progress before returning.
+func Serve(listen string) {
+	config, err := GetConfig()
+	if err != nil {
+		log.Fatal("Error reading the configuration: ", err)
+	}
+	configureAuth(config)
+	configureRateLimits(config)
+	removeStaleUploads()
+
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/", rootHandler)
+	// v1 keeps its form based interface; only the methods documented in api-specs.yaml are accepted
+	mux.HandleFunc("/api/v1/store", requireScope(ScopeWrite, rateLimit(RateClassWrite, limitUploads(allowMethods(storeHandler, http.MethodPost)))))
+	mux.HandleFunc("/api/v1/store/batch", requireScope(ScopeWrite, rateLimit(RateClassWrite, limitUploads(allowMethods(batchStoreHandler, http.MethodPost)))))
+	mux.HandleFunc("/api/v1/store/archive", requireScope(ScopeWrite, rateLimit(RateClassWrite, limitUploads(allowMethods(archiveStoreHandler, http.MethodPost)))))
+	mux.HandleFunc("/api/v1/update", requireScope(ScopeWrite, rateLimit(RateClassWrite, limitUploads(allowMethods(updateHandler, http.MethodPost)))))
+	mux.HandleFunc("/api/v1/exists", requireScope(ScopeRead, rateLimit(RateClassRead, allowMethods(existenceCheckHandler, http.MethodGet, http.MethodHead))))
+	mux.HandleFunc("/api/v1/list", requireScope(ScopeRead, rateLimit(RateClassRead, allowMethods(listHandler, http.MethodGet, http.MethodHead))))
+	mux.HandleFunc("/api/v1/delete", requireScope(ScopeWrite, rateLimit(RateClassWrite, allowMethods(deleteHandler, http.MethodPost, http.MethodDelete))))
+	mux.HandleFunc("/api/v1/frequency", requireScope(ScopeRead, rateLimit(RateClassAnalytics, allowMethods(wordFrequencyHandler, http.MethodGet, http.MethodPost))))
+	mux.HandleFunc("/api/v1/frequency/ngrams", requireScope(ScopeRead, rateLimit(RateClassAnalytics, allowMethods(ngramFrequencyHandler, http.MethodGet, http.MethodPost))))
+	mux.HandleFunc("/api/v1/keywords", requireScope(ScopeRead, rateLimit(RateClassAnalytics, allowMethods(keywordsHandler, http.MethodGet))))
+	mux.HandleFunc("/api/v1/similar", requireScope(ScopeRead, rateLimit(RateClassAnalytics, allowMethods(similarHandler, http.MethodGet))))
+	mux.HandleFunc("/api/v1/duplicates", requireScope(ScopeRead, rateLimit(RateClassAnalytics, allowMethods(duplicatesHandler, http.MethodGet))))
+	mux.HandleFunc("/api/v1/search", requireScope(ScopeRead, rateLimit(RateClassAnalytics, allowMethods(searchHandler, http.MethodGet, http.MethodPost))))
+	mux.HandleFunc("/api/v1/grep", requireScope(ScopeRead, rateLimit(RateClassAnalytics, allowMethods(grepHandler, http.MethodGet, http.MethodPost))))
+	mux.HandleFunc("/api/v1/diff", requireScope(ScopeRead, rateLimit(RateClassAnalytics, allowMethods(diffHandler, http.MethodGet, http.MethodPost))))
+	mux.HandleFunc("/api/v1/download/zip", requireScope(ScopeRead, rateLimit(RateClassAnalytics, allowMethods(bulkDownloadHandler, http.MethodGet, http.MethodPost))))
+	mux.HandleFunc("/api/v1/share", requireScope(ScopeRead, rateLimit(RateClassWrite, allowMethods(shareHandler, http.MethodPost))))
+	// share links carry their own authorization
+	mux.HandleFunc(SharedPrefix, rateLimitMethods(limitUploads(allowMethods(sharedHandler, http.MethodGet, http.MethodHead, http.MethodPut))))
+	mux.HandleFunc("/api/v1/admin/tokens", requireScope(ScopeAdmin, rateLimit(RateClassAdmin, allowMethods(tokensHandler, http.MethodGet, http.MethodPost, http.MethodDelete))))
+	mux.HandleFunc("/api/v1/admin/acls", requireScope(ScopeAdmin, rateLimit(RateClassAdmin, allowMethods(aclHandler, http.MethodGet, http.MethodPost, http.MethodDelete))))
+	mux.HandleFunc(FilesV2Collection, requireScope(ScopeRead, rateLimit(RateClassRead, allowMethods(listFilesV2Handler, http.MethodGet, http.MethodHead))))
+	mux.HandleFunc(FilesV2Prefix, requireMethodScope(rateLimitMethods(limitUploads(filesV2Handler))))
 	// Add more handlers for other operations
 
-	log.Println(fmt.Sprintf("Server is starting on port %s...", port))
-	err := http.ListenAndServe(port, nil)
+	address := listenAddress(listen, config.Server)
+	server := newHTTPServer(address, config.Server, withRequestID(mux))
+	if config.TLS != nil {
+		reloader, err := newTLSReloader(*config.TLS)
+		if err != nil {
+			log.Fatal("Error loading the TLS configuration: ", err)
+		}
+		server.TLSConfig = reloader.serverConfig()
+	}
+	listener, err := net.Listen("tcp", address)
 	if err != nil {
-		log.Fatal("ListenAndServe: ", err)
+		log.Fatal("Error listening on ", address, ": ", err)
 	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	log.Println(fmt.Sprintf("Server is starting on %s (TLS: %v)...", address, server.TLSConfig != nil))
+	err = runServer(ctx, server, listener, timeout(config.Server.ShutdownTimeoutSeconds, defaultShutdownTimeout))
+	flushIndexes()
+	if err != nil {
+		log.Fatal("Error serving: ", err)
+	}
+	log.Println("Server stopped")
 }
 
 func rootHandler(w http.ResponseWriter, r *http.Request) {
 	data, err := os.ReadFile("api-specs.yaml")
 	if err != nil {
-		http.Error(w, "File reading error", http.StatusInternalServerError)
+		respondError(w, http.StatusInternalServerError, ErrCodeInternal, "File reading error")
 		return
 	}
 	_, err = w.Write(data)
@@ -45,96 +97,59 @@ func storeHandler(w http.ResponseWriter, r *http.Request) {
 	err := r.ParseMultipartForm(50 << 20) // limit your maxMemory here
 	if err != nil {
 		log.Println("Error parsing the form:", err)
-		http.Error(w, "Error parsing the file", http.StatusInternalServerError)
+		respondError(w, http.StatusBadRequest, ErrCodeInvalidRequest, "Error parsing the form")
 		return
 	}
 
 	fileName := r.FormValue("filename")
 	err = validateRequiredField("filename", fileName)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		respondError(w, http.StatusBadRequest, ErrCodeMissingField, err.Error())
 		return
 	}
-
-	// Get the file from the form
-	// todo use the fileHeader for accurate file size information `fileHeader.Size`
-	file, _, err := r.FormFile("file") // retrieve the file from form data
+	fileName, err = cleanStoreName(fileName)
 	if err != nil {
-		log.Println("Error retrieving the file:", err)
-		http.Error(w, "Error retrieving the file", http.StatusInternalServerError)
+		respondError(w, http.StatusBadRequest, ErrCodeInvalidRequest, err.Error())
 		return
 	}
-	if file == nil {
-		log.Println("No file was uploaded")
-		http.Error(w, "No file was uploaded", http.StatusBadRequest)
+	if !authorizeFile(w, r, fileName, PermissionWrite) {
 		return
 	}
-	defer CloseMultipartFile(file)
 
-	filePath, err := getFileStorePath(fileName)
-	if err != nil {
-		log.Println("Error getting file path:", err)
-		http.Error(w, "Error getting file path from config", http.StatusInternalServerError)
-		return
-	}
-
-	// Create a new file in the files directory
-	dst, err := os.Create(filePath) // create a new file with the same name
-	if err != nil {
-		log.Println("Error creating the file:", err)
-		http.Error(w, "Error creating the file", http.StatusInternalServerError)
+	// Get the file from the form
+	file, _, err := r.FormFile("file") // retrieve the file from form data
+	if errors.Is(err, http.ErrMissingFile) {
+		log.Println("No file was uploaded")
+		respondError(w, http.StatusBadRequest, ErrCodeMissingField, "No file was uploaded")
 		return
 	}
-	defer CloseFile(dst)
-
-	// Write the contents of the uploaded file to the new file
-	// todo mitigate <cc1> if the same file already exists in the directory or same hash exists then copying file would be an issue
-	_, err = io.Copy(dst, file)
 	if err != nil {
-		log.Println("Error copying the file:", err)
-		http.Error(w, "Error writing to the file", http.StatusInternalServerError)
+		log.Println("Error retrieving the file:", err)
+		respondError(w, http.StatusInternalServerError, ErrCodeInternal, "Error retrieving the file")
 		return
 	}
-
-	// Compute the MD5 hash of the uploaded file
-	md5Hash, err := ComputeMD5Hash(filePath)
-	if err != nil {
-		log.Println("Error computing the MD5 hash:", err)
-		http.Error(w, "Error computing the MD5 hash", http.StatusInternalServerError)
+	if file == nil {
+		log.Println("No file was uploaded")
+		respondError(w, http.StatusBadRequest, ErrCodeMissingField, "No file was uploaded")
 		return
 	}
+	defer CloseMultipartFile(file)
 
-	//check if the file already exists
-	// todo mitigate breaks the logic as mentioned in <cc1>; mandate the pre-flight checking find by name or hash
-	entry, err := findByHash(md5Hash)
-	if err != nil {
-		log.Println("Error finding file hash:", err)
-		// todo read this message from a config file
-		http.Error(w, "There was a problem verifying existing hashes. "+
-			"Please try the following:\n\n    Refresh the page and try again.\n\nIf the error persists, "+
-			"contact an administrator for assistance.", http.StatusInternalServerError)
+	opts, ok := requestStoreOptions(w, r, r.Form)
+	if !ok {
 		return
 	}
 
-	if entry != nil {
+	// Write the file to the store and record its details; duplicates by name or hash are rejected
+	_, err = storeFile(fileName, file, opts)
+	if errors.Is(err, ErrFileExists) {
 		log.Println("File already exists")
-		http.Error(w, "File already exists", http.StatusConflict)
+		respondError(w, http.StatusConflict, ErrCodeAlreadyExists, "File already exists")
 		return
 	}
-
-	wordCount, err := countWordsInFile(fileName)
 	if err != nil {
-		log.Println("Error counting words in the file:", err)
-		http.Error(w, "Error counting words in the file", http.StatusInternalServerError)
-		return
-	}
-
-	// store the file details in the csv file
-	fileDetails := FileDetails{Filename: fileName, FileSize: r.ContentLength, FileHash: md5Hash, WordCount: wordCount}
-	err = storeInCSV(fileDetails)
-	if err != nil {
-		log.Println("Error storing file details:", err)
-		http.Error(w, "Error storing file details", http.StatusInternalServerError)
+		log.Println("Error storing the file:", err)
+		respondError(w, http.StatusInternalServerError, ErrCodeInternal, "Error storing the file")
 		return
 	}
 
@@ -149,7 +164,7 @@ func updateHandler(w http.ResponseWriter, r *http.Request) {
 	err := r.ParseMultipartForm(50 << 20) // limit your maxMemory here
 	if err != nil {
 		log.Println("Error parsing the form:", err)
-		http.Error(w, "Error parsing the file", http.StatusInternalServerError)
+		respondError(w, http.StatusBadRequest, ErrCodeInvalidRequest, "Error parsing the form")
 		return
 	}
 
@@ -157,25 +172,45 @@ func updateHandler(w http.ResponseWriter, r *http.Request) {
 	prevFilename := r.FormValue("prevFilename")
 	if prevFilename == "" {
 		log.Println("Previous file name is required")
-		http.Error(w, "Previous file name is required", http.StatusBadRequest)
+		respondError(w, http.StatusBadRequest, ErrCodeMissingField, "Previous file name is required")
 		return
 	}
 
 	newFileName := r.FormValue("filename")
+	err = validateRequiredField("filename", newFileName)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, ErrCodeMissingField, err.Error())
+		return
+	}
+	newFileName, err = cleanStoreName(newFileName)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, ErrCodeInvalidRequest, err.Error())
+		return
+	}
+	noteRename(r, prevFilename, newFileName)
+	if !authorizeFile(w, r, prevFilename, PermissionWrite) {
+		return
+	}
+	if newFileName != prevFilename && !authorizeFile(w, r, newFileName, PermissionWrite) {
+		return
+	}
 
 	// Get the duplicate flag from the form
 	duplicate, err := strconv.ParseBool(r.FormValue("duplicate"))
 	if err != nil {
 		log.Println("Error parsing duplicate value:", err)
-		http.Error(w, "Invalid duplicate value", http.StatusBadRequest)
+		respondError(w, http.StatusBadRequest, ErrCodeInvalidRequest, "Invalid duplicate value")
 		return
 	}
 
+	// With diff=true a replaced file is answered with a unified diff of the old and new content
+	showDiff, _ := strconv.ParseBool(r.FormValue("diff"))
+
 	// Get the new file from the form
 	file, _, err := r.FormFile("file") // retrieve the file from form data
 	if err != nil && !errors.Is(err, http.ErrMissingFile) {
 		log.Println("Error retrieving the file:", err)
-		http.Error(w, "Error retrieving the file", http.StatusInternalServerError)
+		respondError(w, http.StatusInternalServerError, ErrCodeInternal, "Error retrieving the file")
 		return
 	}
 	if file != nil {
@@ -183,16 +218,12 @@ func updateHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	record, err := findByName(prevFilename)
-	// todo use the helper-function to reduce the code duplication of error handling
-	if err != nil {
-		log.Println("Error finding file name:", err)
-		http.Error(w, "Error finding file name", http.StatusInternalServerError)
+	if checkErrorAndRespond(err, "Error finding file name", http.StatusInternalServerError, ErrCodeInternal, w) {
 		return
 	}
 	if record == nil {
 		log.Println("File does not exist")
-		http.Error(w, "Record does not exists",
-			http.StatusNotFound)
+		respondError(w, http.StatusNotFound, ErrCodeNotFound, "record does not exist")
 		return
 	}
 
@@ -201,58 +232,64 @@ func updateHandler(w http.ResponseWriter, r *http.Request) {
 		// a duplicate of the existing file with new record.
 		// todo case to handle when duplicate is true and file name is also changed but content is not changed
 		err := ManageFileUpdate(duplicate, newFileName, *record)
-		if err != nil {
-			http.Error(w, "Error updating the file", http.StatusInternalServerError)
+		if errors.Is(err, ErrFileExists) {
+			respondError(w, http.StatusConflict, ErrCodeAlreadyExists, "File already exists")
 			return
 		}
-	} else {
-		// If a new file is provided, validate the new file name
-		err := validateRequiredField("filename", newFileName)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
+			respondError(w, http.StatusInternalServerError, ErrCodeInternal, "Error updating the file")
 			return
 		}
-
-		newFilePath, err := getFileStorePath(newFileName)
-		if err != nil {
-			log.Println("Error getting file path:", err)
-			http.Error(w, "Error getting file path from config", http.StatusInternalServerError)
+	} else {
+		opts, ok := requestStoreOptions(w, r, r.Form)
+		if !ok {
 			return
 		}
 
-		// Create a new file in the files directory
-		dst, err := os.Create(newFilePath)
-		if err != nil {
-			log.Println("Error creating the file:", err)
-			http.Error(w, "Error creating the file", http.StatusInternalServerError)
-			return
+		// Keep the old content for the diff before it is overwritten or deleted
+		var oldContent string
+		var diffErr error
+		if showDiff {
+			oldContent, diffErr = readDiffable(prevFilename)
 		}
-		defer CloseFile(dst)
 
-		// Write the contents of the uploaded file to the new file
-		_, err = io.Copy(dst, file)
-		if err != nil {
-			log.Println("Error copying the file:", err)
-			http.Error(w, "Error writing to the file", http.StatusInternalServerError)
-			return
+		// The new content goes through a temporary file, so an interrupted upload leaves the
+		// previous file and record untouched; the previous file is removed when renamed
+		if newFileName == prevFilename {
+			_, err = replaceFile(*record, file, opts)
+		} else {
+			_, err = replaceFileAs(*record, newFileName, file, opts)
 		}
-		// Compute the MD5 hash of the new file
-		md5Hash, err := ComputeMD5Hash(newFilePath)
-		wordCount, err := countWordsInFile(newFileName)
-		if err != nil {
-			log.Println("Error counting words in the file:", err)
-			http.Error(w, "Error counting words in the file", http.StatusInternalServerError)
+		if errors.Is(err, ErrFileExists) {
+			log.Println("File already exists")
+			respondError(w, http.StatusConflict, ErrCodeAlreadyExists, "File already exists")
 			return
 		}
-		newRecord := FileDetails{Filename: newFileName, FileSize: r.ContentLength,
-			FileHash: md5Hash, WordCount: wordCount}
-		// Update the old record with the new record and delete the old file
-		err = modifyRecordAndFile(*record, newRecord)
 		if err != nil {
-			http.Error(w, "Error updating the old record and deleting the old file: "+err.Error(),
-				http.StatusInternalServerError)
+			log.Println("Error updating the file:", err)
+			respondError(w, http.StatusInternalServerError, ErrCodeInternal,
+				"Error updating the old record and deleting the old file")
 			return
 		}
+
+		if showDiff {
+			var newContent string
+			if diffErr == nil {
+				newContent, diffErr = readDiffable(newFileName)
+			}
+			if diffErr != nil {
+				log.Println("Not diffing the update:", diffErr)
+				w.Header().Set("X-Diff-Skipped", diffErr.Error())
+			} else {
+				w.Header().Set("Content-Type", "text/x-diff; charset=utf-8")
+				changes := unifiedDiff("a/"+prevFilename, "b/"+newFileName, oldContent, newContent, defaultDiffContext)
+				_, err = w.Write([]byte(changes))
+				if err != nil {
+					log.Println("Error writing response:", err)
+				}
+				return
+			}
+		}
 	}
 	_, err = w.Write([]byte("successfully updated the file"))
 	if err != nil {
@@ -266,7 +303,7 @@ func existenceCheckHandler(w http.ResponseWriter, r *http.Request) {
 	err := r.ParseForm()
 	if err != nil {
 		log.Println("Error parsing the form:", err)
-		http.Error(w, "Error parsing the form", http.StatusInternalServerError)
+		respondError(w, http.StatusBadRequest, ErrCodeInvalidRequest, "Error parsing the form")
 		return
 	}
 
@@ -280,7 +317,7 @@ func existenceCheckHandler(w http.ResponseWriter, r *http.Request) {
 		}
 		return nil
 	}(hash, name) != nil {
-		http.Error(w, "either hash or name is required", http.StatusBadRequest)
+		respondError(w, http.StatusBadRequest, ErrCodeMissingField, "either hash or name is required")
 		return
 	}
 
@@ -288,13 +325,21 @@ func existenceCheckHandler(w http.ResponseWriter, r *http.Request) {
 	record, err := findByHashOrName(hash, name)
 	if err != nil {
 		log.Println("Error executing findByHashOrName:", err)
-		http.Error(w, "Error in finding record by hash or name", http.StatusInternalServerError)
+		respondError(w, http.StatusInternalServerError, ErrCodeInternal, "Error in finding record by hash or name")
 		return
 	}
 
-	// If the file does not exist, respond with an appropriate message
-	if record == nil {
-		http.Error(w, "record does not exist", http.StatusNotFound)
+	access, err := accessOf(r)
+	if err != nil {
+		log.Println("Error checking the permissions:", err)
+		respondError(w, http.StatusInternalServerError, ErrCodeInternal, "Error checking the permissions")
+		return
+	}
+
+	// If the file does not exist, or the caller may not read it, respond with the same message so
+	// that the existence of unreadable files is not revealed
+	if record == nil || !access.allows(*record, PermissionRead) {
+		respondError(w, http.StatusNotFound, ErrCodeNotFound, "record does not exist")
 		return // return here to prevent further execution
 	}
 
@@ -302,7 +347,7 @@ func existenceCheckHandler(w http.ResponseWriter, r *http.Request) {
 	recordJson, err := json.Marshal(record)
 	if err != nil {
 		log.Println("Error marshalling the record:", err)
-		http.Error(w, "Error marshalling the record", http.StatusInternalServerError)
+		respondError(w, http.StatusInternalServerError, ErrCodeInternal, "Error marshalling the record")
 		return
 	}
 	// Set the content type to application/json
@@ -315,22 +360,64 @@ func existenceCheckHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// listHandler lists the stored files as a JSON array. The listing can be filtered, sorted and
+// paginated with the parameters described by parseListQuery; the total number of matching files and
+// the cursor of the next page are returned in the X-Total-Count and X-Next-Cursor headers.
 func listHandler(w http.ResponseWriter, r *http.Request) {
-
-	entries, err := getAllEntries()
+	err := r.ParseForm()
 	if err != nil {
-		log.Println("Error getting all entries:", err)
-		http.Error(w, "Error getting all entries", http.StatusInternalServerError)
+		log.Println("Error parsing the form:", err)
+		respondError(w, http.StatusBadRequest, ErrCodeInvalidRequest, "Error parsing the form")
 		return
 	}
+
+	// v1 returns everything unless a limit is asked for
+	page, ok := queryEntries(w, r, r.Form, 0)
+	if !ok {
+		return
+	}
+	w.Header().Set("X-Total-Count", strconv.Itoa(page.Total))
+	if page.NextCursor != "" {
+		w.Header().Set("X-Next-Cursor", page.NextCursor)
+	}
+
 	// Set the content type to application/json
 	w.Header().Set("Content-Type", "application/json")
 	// Use json.NewEncoder to write entries as a JSON array to writer
-	err = json.NewEncoder(w).Encode(entries)
+	err = json.NewEncoder(w).Encode(page.Items)
 	if err != nil {
 		log.Println("Error encoding entries to JSON:", err)
-		http.Error(w, "Error encoding entries to JSON", http.StatusInternalServerError)
+		respondError(w, http.StatusInternalServerError, ErrCodeInternal, "Error encoding entries to JSON")
+	}
+}
+
+// queryEntries runs the listing query described by values against the records the caller of r may
+// read. It responds with an error and returns false if the query is invalid or the records cannot be
+// read.
+func queryEntries(w http.ResponseWriter, r *http.Request, values url.Values, defaultLimit int) (ListPage, bool) {
+	query, err := parseListQuery(values, defaultLimit)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, ErrCodeInvalidRequest, err.Error())
+		return ListPage{}, false
+	}
+	readable, ok := readableFiles(w, r)
+	if !ok {
+		return ListPage{}, false
 	}
+
+	entries, err := getAllEntries()
+	if err != nil {
+		log.Println("Error getting all entries:", err)
+		respondError(w, http.StatusInternalServerError, ErrCodeInternal, "Error getting all entries")
+		return ListPage{}, false
+	}
+
+	page, err := query.apply(readable.filter(entries))
+	if err != nil {
+		respondError(w, http.StatusBadRequest, ErrCodeInvalidRequest, err.Error())
+		return ListPage{}, false
+	}
+	return page, true
 }
 
 func deleteHandler(w http.ResponseWriter, r *http.Request) {
@@ -339,23 +426,29 @@ func deleteHandler(w http.ResponseWriter, r *http.Request) {
 	err := r.ParseForm()
 	if err != nil {
 		log.Println("Error parsing the form:", err)
-		http.Error(w, "Error parsing the form", http.StatusInternalServerError)
+		respondError(w, http.StatusBadRequest, ErrCodeInvalidRequest, "Error parsing the form")
 		return
 	}
 
 	filename := r.FormValue("filename")
+	if !authorizeFile(w, r, filename, PermissionDelete) {
+		return
+	}
+
+	storeMutex.Lock()
+	defer storeMutex.Unlock()
 
 	// Use the findByName function to check if a file with the given name exists
 	record, err := findByName(filename)
 	if err != nil {
 		log.Println("Error executing findByName:", err)
-		http.Error(w, "Error in finding record by name", http.StatusInternalServerError)
+		respondError(w, http.StatusInternalServerError, ErrCodeInternal, "Error in finding record by name")
 		return
 	}
 
 	// If the file does not exist, respond with an appropriate message
 	if record == nil {
-		http.Error(w, "record does not exist", http.StatusNotFound)
+		respondError(w, http.StatusNotFound, ErrCodeNotFound, "record does not exist")
 		return
 	}
 
@@ -363,14 +456,14 @@ func deleteHandler(w http.ResponseWriter, r *http.Request) {
 	err = deleteFromCSV(filename)
 	if err != nil {
 		log.Println("Error deleting record from CSV:", err)
-		http.Error(w, "Error deleting record from CSV", http.StatusInternalServerError)
+		respondError(w, http.StatusInternalServerError, ErrCodeInternal, "Error deleting record from CSV")
 		return
 	}
 
 	filePath, err := getFileStorePath(filename)
 	if err != nil {
 		log.Println("Error finding the path of the file:", err)
-		http.Error(w, "Error finding the path of the file", http.StatusInternalServerError)
+		respondError(w, http.StatusInternalServerError, ErrCodeInternal, "Error finding the path of the file")
 		return
 
 	}
@@ -379,7 +472,7 @@ func deleteHandler(w http.ResponseWriter, r *http.Request) {
 	err = os.Remove(filePath)
 	if err != nil {
 		log.Println("Error deleting the file:", err)
-		http.Error(w, "Error deleting the file", http.StatusInternalServerError)
+		respondError(w, http.StatusInternalServerError, ErrCodeInternal, "Error deleting the file")
 		return
 	}
 
@@ -394,42 +487,40 @@ func wordFrequencyHandler(w http.ResponseWriter, r *http.Request) {
 	err := r.ParseForm()
 	if err != nil {
 		log.Println("Error parsing the form:", err)
-		http.Error(w, "Error parsing the form", http.StatusInternalServerError)
+		respondError(w, http.StatusBadRequest, ErrCodeInvalidRequest, "Error parsing the form")
 		return
 	}
 
-	// Get the noOfWords parameter from the form and convert it to an integer
-	noOfWords, err := strconv.Atoi(r.FormValue("noOfWords"))
+	query, err := parseFrequencyQuery(r.Form)
 	if err != nil {
-		log.Println("Error parsing noOfWords:", err)
-		http.Error(w, "Invalid noOfWords value", http.StatusBadRequest)
+		log.Println("Error parsing the frequency query:", err)
+		respondError(w, http.StatusBadRequest, ErrCodeInvalidRequest, err.Error())
 		return
 	}
-
-	// Get the mostFrequent parameter from the form and convert it to a boolean
-	mostFrequent, err := strconv.ParseBool(r.FormValue("mostFrequent"))
-	if err != nil {
-		log.Println("Error parsing mostFrequent:", err)
-		http.Error(w, "Invalid mostFrequent value", http.StatusBadRequest)
+	var ok bool
+	if query.Readable, ok = readableFiles(w, r); !ok {
 		return
 	}
 
-	directory, err := getFileStoreDir()
-	if err != nil {
-		log.Println("Error getting file-store directory:", err)
-		http.Error(w, "Error getting file store directory", http.StatusInternalServerError)
-		return
-
+	// The totals are maintained at ingest time, so the store does not have to be read again;
+	// source=scan recounts the stored files instead, e.g. to verify the index
+	var result Frequencies
+	if r.FormValue("source") == "scan" {
+		result, err = scanWordFrequencies(r.Context(), query)
+		if err != nil {
+			log.Println("Error counting word frequencies:", err)
+			respondError(w, http.StatusInternalServerError, ErrCodeInternal, "Error counting word frequencies")
+			return
+		}
+	} else {
+		result = frequencyIndex.Query(query)
 	}
 
-	// Call the CountWordsFrequencyParallel function with the directory set as "test-resources"
-	result := CountWordsFrequencyParallel(directory, noOfWords, mostFrequent)
-
 	// Convert the result to JSON and write it to the response
 	resultJson, err := json.Marshal(result)
 	if err != nil {
 		log.Println("Error marshalling the result:", err)
-		http.Error(w, "Error marshalling the result", http.StatusInternalServerError)
+		respondError(w, http.StatusInternalServerError, ErrCodeInternal, "Error marshalling the result")
 		return
 	}
 
@@ -214,9 +214,14 @@ func TestUpdateHandlerCaseNewFile(t *testing.T) {
 	}
 
 	// Check the HTTP response body
-	expected := "Record does not exists"
-	if strings.TrimSpace(rr.Body.String()) != expected {
-		t.Errorf("handler returned unexpected body: got %v want %v", rr.Body.String(), expected)
+	var apiError APIError
+	err = json.Unmarshal(rr.Body.Bytes(), &apiError)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := APIError{Code: ErrCodeNotFound, Message: "record does not exist"}
+	if apiError != expected {
+		t.Errorf("handler returned unexpected body: got %v want %v", apiError, expected)
 	}
 }
 func TestUpdateHandlerCaseUpdateName(t *testing.T) {
@@ -472,10 +477,15 @@ func TestNonExistentRecordInExistenceCheckHandler(t *testing.T) {
 	}
 
 	// Check the response body is what we expect
-	expected := `record does not exist`
-	if strings.TrimSpace(rr.Body.String()) != expected {
+	var apiError APIError
+	err = json.Unmarshal(rr.Body.Bytes(), &apiError)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := APIError{Code: ErrCodeNotFound, Message: "record does not exist"}
+	if apiError != expected {
 		t.Errorf("handler returned unexpected body: got %v want %v",
-			rr.Body.String(), expected)
+			apiError, expected)
 	}
 }
 
@@ -594,3 +604,61 @@ func TestWordFrequencyHandler(t *testing.T) {
 		}
 	}
 }
+
+func TestUpdateHandlerReplacesThroughTheStore(t *testing.T) {
+	teardown := searchSetup(t)
+	defer teardown()
+
+	update := func(fields map[string]string, content string) *httptest.ResponseRecorder {
+		body := &bytes.Buffer{}
+		writer := multipart.NewWriter(body)
+		for field, value := range fields {
+			if err := writer.WriteField(field, value); err != nil {
+				t.Fatal(err)
+			}
+		}
+		part, err := writer.CreateFormFile("file", "upload.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := part.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+		if err := writer.Close(); err != nil {
+			t.Fatal(err)
+		}
+		req := httptest.NewRequest("POST", "/api/v1/update", body)
+		req.Header.Set("Content-Type", writer.FormDataContentType())
+		rr := httptest.NewRecorder()
+		updateHandler(rr, req)
+		return rr
+	}
+
+	rr := update(map[string]string{"prevFilename": "dog.txt", "filename": "fox.txt", "duplicate": "false"}, "A new dog.")
+	if rr.Code != http.StatusConflict {
+		t.Errorf("Expected renaming onto a stored file to be refused, got %d", rr.Code)
+	}
+	rr = update(map[string]string{"prevFilename": "dog.txt", "filename": "../dog.txt", "duplicate": "false"}, "A new dog.")
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected a name outside the store to be refused, got %d", rr.Code)
+	}
+
+	rr = update(map[string]string{"prevFilename": "dog.txt", "filename": "puppy.txt", "duplicate": "false"}, "A new dog.")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected the update to succeed, got %d %s", rr.Code, rr.Body.String())
+	}
+	record, err := findByName("puppy.txt")
+	if err != nil || record == nil || record.FileSize != int64(len("A new dog.")) || record.WordCount != 3 {
+		t.Errorf("Expected the record of the new content, got %+v %v", record, err)
+	}
+	if old, err := findByName("dog.txt"); err != nil || old != nil {
+		t.Errorf("Expected the previous record to be removed, got %+v %v", old, err)
+	}
+	filePath, err := getFileStorePath("dog.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filePath); !os.IsNotExist(err) {
+		t.Errorf("Expected the previous file to be removed, got %v", err)
+	}
+}
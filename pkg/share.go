@@ -0,0 +1,452 @@
+package pkg
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SharedPrefix is the path under which share links expose their file.
+const SharedPrefix = "/api/v1/shared/"
+
+// The modes of a share link.
+const (
+	ShareDownload = "download"
+	ShareUpload   = "upload"
+)
+
+const (
+	defaultShareTTL = 24 * time.Hour
+	maxShareTTL     = 30 * 24 * time.Hour
+)
+
+// ShareLink is the response to minting a share link.
+type ShareLink struct {
+	URL          string    `json:"url"`
+	Filename     string    `json:"filename"`
+	Mode         string    `json:"mode"`
+	ExpiresAt    time.Time `json:"expires_at"`
+	MaxDownloads int       `json:"max_downloads,omitempty"`
+	IP           string    `json:"ip,omitempty"`
+}
+
+// shareGrant is what a share link allows; every field is covered by the signature of the link.
+type shareGrant struct {
+	ID           string
+	Filename     string
+	Mode         string
+	Expires      int64
+	MaxDownloads int
+	// IP is the address or CIDR range the link may be used from, any when empty.
+	IP string
+	// By is the caller that minted the link, recorded as owner of uploaded files.
+	By string
+}
+
+// signingInput is the canonical form of the grant the signature is computed over. Every field is
+// prefixed with its length, so that no file name or subject can shift text into the next field.
+func (g shareGrant) signingInput() string {
+	var input strings.Builder
+	for _, field := range []string{"v2", g.ID, g.Filename, g.Mode, strconv.FormatInt(g.Expires, 10),
+		strconv.Itoa(g.MaxDownloads), g.IP, g.By} {
+		input.WriteString(strconv.Itoa(len(field)))
+		input.WriteByte(':')
+		input.WriteString(field)
+	}
+	return input.String()
+}
+
+// shareSecretPath is the configured secret file, shareKey in the record store when empty.
+var shareSecretPath string
+
+var shareSecret struct {
+	sync.Mutex
+	key []byte
+}
+
+// shareKey returns the HMAC key of the share links, creating a random one on first use so links
+// stay valid across restarts.
+func shareKey() ([]byte, error) {
+	shareSecret.Lock()
+	defer shareSecret.Unlock()
+	if shareSecret.key != nil {
+		return shareSecret.key, nil
+	}
+	path := shareSecretPath
+	if path == "" {
+		var err error
+		path, err = RecordStorePath("shareKey")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	key, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		key = make([]byte, 32)
+		if _, err = rand.Read(key); err != nil {
+			return nil, err
+		}
+		err = os.WriteFile(path, key, 0600)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(key) < 16 {
+		return nil, fmt.Errorf("the share secret %s is shorter than 16 bytes", path)
+	}
+	shareSecret.key = key
+	return key, nil
+}
+
+func signShareGrant(g shareGrant) (string, error) {
+	key, err := shareKey()
+	if err != nil {
+		return "", err
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(g.signingInput()))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil)), nil
+}
+
+// query returns the query string of the link of the grant.
+func (g shareGrant) query(signature string) string {
+	values := url.Values{"id": {g.ID}, "mode": {g.Mode}, "exp": {strconv.FormatInt(g.Expires, 10)}, "sig": {signature}}
+	if g.MaxDownloads > 0 {
+		values.Set("max", strconv.Itoa(g.MaxDownloads))
+	}
+	if g.IP != "" {
+		values.Set("ip", g.IP)
+	}
+	if g.By != "" {
+		values.Set("by", g.By)
+	}
+	return values.Encode()
+}
+
+// parseShareGrant reads the grant of a share link request and checks its signature.
+func parseShareGrant(r *http.Request) (shareGrant, error) {
+	query := r.URL.Query()
+	g := shareGrant{ID: query.Get("id"), Filename: strings.TrimPrefix(r.URL.Path, SharedPrefix),
+		Mode: query.Get("mode"), IP: query.Get("ip"), By: query.Get("by")}
+	var err error
+	g.Expires, err = strconv.ParseInt(query.Get("exp"), 10, 64)
+	if err != nil {
+		return g, errors.New("invalid share link")
+	}
+	if query.Get("max") != "" {
+		g.MaxDownloads, err = strconv.Atoi(query.Get("max"))
+		if err != nil {
+			return g, errors.New("invalid share link")
+		}
+	}
+
+	expected, err := signShareGrant(g)
+	if err != nil {
+		return g, err
+	}
+	if !hmac.Equal([]byte(expected), []byte(query.Get("sig"))) {
+		return g, errors.New("invalid share link signature")
+	}
+	return g, nil
+}
+
+// allowsAddress reports whether the link may be used from the client address of r.
+func (g shareGrant) allowsAddress(r *http.Request) bool {
+	if g.IP == "" {
+		return true
+	}
+	ip := net.ParseIP(clientAddress(r))
+	if ip == nil {
+		return false
+	}
+	if _, network, err := net.ParseCIDR(g.IP); err == nil {
+		return network.Contains(ip)
+	}
+	return ip.Equal(net.ParseIP(g.IP))
+}
+
+// shareDownloadCount is the number of complete downloads of a share link, kept until it expires.
+type shareDownloadCount struct {
+	Count   int   `json:"count"`
+	Expires int64 `json:"expires"`
+}
+
+// shareDownloads counts the downloads of the share links with a download limit. The counts are
+// kept in the record store so that limits survive restarts; pending are the downloads in progress,
+// which count against the limit until they end.
+var shareDownloads = struct {
+	sync.Mutex
+	counts  map[string]shareDownloadCount
+	pending map[string]int
+}{pending: make(map[string]int)}
+
+// loadShareDownloads reads the persisted counts once. The caller must hold the lock.
+func loadShareDownloads(path string) error {
+	if shareDownloads.counts != nil {
+		return nil
+	}
+	var persisted map[string]json.RawMessage
+	err := loadJSON(path, &persisted)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	counts := make(map[string]shareDownloadCount, len(persisted))
+	for id, value := range persisted {
+		var count shareDownloadCount
+		if err := json.Unmarshal(value, &count); err != nil {
+			// counts persisted without their expiry are kept as long as a link can live
+			if err := json.Unmarshal(value, &count.Count); err != nil {
+				return err
+			}
+			count.Expires = time.Now().Add(maxShareTTL).Unix()
+		}
+		counts[id] = count
+	}
+	shareDownloads.counts = counts
+	return nil
+}
+
+// reserveShareDownload starts a download of the link of grant, unless its complete and pending
+// downloads already reached its limit. Every reserved download must be ended with
+// endShareDownload.
+func reserveShareDownload(grant shareGrant) (bool, error) {
+	shareDownloads.Lock()
+	defer shareDownloads.Unlock()
+	path, err := RecordStorePath("shareDownloads.json")
+	if err != nil {
+		return false, err
+	}
+	if err := loadShareDownloads(path); err != nil {
+		return false, err
+	}
+	if shareDownloads.counts[grant.ID].Count+shareDownloads.pending[grant.ID] >= grant.MaxDownloads {
+		return false, nil
+	}
+	shareDownloads.pending[grant.ID]++
+	return true, nil
+}
+
+// endShareDownload ends a download reserved with reserveShareDownload, counting it if complete. The
+// counts of expired links are dropped as the counts are saved.
+func endShareDownload(grant shareGrant, complete bool) error {
+	shareDownloads.Lock()
+	defer shareDownloads.Unlock()
+	if shareDownloads.pending[grant.ID]--; shareDownloads.pending[grant.ID] <= 0 {
+		delete(shareDownloads.pending, grant.ID)
+	}
+	if !complete {
+		return nil
+	}
+	path, err := RecordStorePath("shareDownloads.json")
+	if err != nil {
+		return err
+	}
+	count := shareDownloads.counts[grant.ID]
+	shareDownloads.counts[grant.ID] = shareDownloadCount{Count: count.Count + 1, Expires: grant.Expires}
+	now := time.Now().Unix()
+	for id, count := range shareDownloads.counts {
+		if count.Expires < now {
+			delete(shareDownloads.counts, id)
+		}
+	}
+	return saveJSON(path, shareDownloads.counts)
+}
+
+// downloadRecorder records the status of a download and whether its body could be sent.
+type downloadRecorder struct {
+	statusRecorder
+	failed bool
+}
+
+func (r *downloadRecorder) Write(data []byte) (int, error) {
+	n, err := r.statusRecorder.Write(data)
+	if err != nil {
+		r.failed = true
+	}
+	return n, err
+}
+
+// shareHandler mints a share link for the file "filename": mode=download (the default) lets the
+// holder download the stored file, mode=upload store or replace it. The link expires after "ttl"
+// (default 24h, at most 30 days) and can be limited to "maxDownloads" downloads and to the address
+// or CIDR range "ip".
+func shareHandler(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		log.Println("Error parsing the form:", err)
+		respondError(w, http.StatusBadRequest, ErrCodeInvalidRequest, "Error parsing the form")
+		return
+	}
+
+	err = validateRequiredField("filename", r.FormValue("filename"))
+	if err != nil {
+		respondError(w, http.StatusBadRequest, ErrCodeMissingField, err.Error())
+		return
+	}
+	fileName, err := cleanStoreName(r.FormValue("filename"))
+	if err != nil {
+		respondError(w, http.StatusBadRequest, ErrCodeInvalidRequest, err.Error())
+		return
+	}
+	grant := shareGrant{Filename: fileName, Mode: r.FormValue("mode"), IP: r.FormValue("ip"), By: ownerOf(r)}
+	if grant.Mode == "" {
+		grant.Mode = ShareDownload
+	}
+	if grant.Mode != ShareDownload && grant.Mode != ShareUpload {
+		respondError(w, http.StatusBadRequest, ErrCodeInvalidRequest, "Invalid mode value, expected download or upload")
+		return
+	}
+	ttl := defaultShareTTL
+	if r.FormValue("ttl") != "" {
+		ttl, err = time.ParseDuration(r.FormValue("ttl"))
+		if err != nil || ttl <= 0 || ttl > maxShareTTL {
+			respondError(w, http.StatusBadRequest, ErrCodeInvalidRequest, "Invalid ttl value, expected a duration of at most 720h")
+			return
+		}
+	}
+	if r.FormValue("maxDownloads") != "" {
+		grant.MaxDownloads, err = strconv.Atoi(r.FormValue("maxDownloads"))
+		if err != nil || grant.MaxDownloads < 1 || grant.Mode != ShareDownload {
+			respondError(w, http.StatusBadRequest, ErrCodeInvalidRequest, "Invalid maxDownloads value, expected a positive number for a download link")
+			return
+		}
+	}
+	if grant.IP != "" {
+		if _, _, err := net.ParseCIDR(grant.IP); err != nil && net.ParseIP(grant.IP) == nil {
+			respondError(w, http.StatusBadRequest, ErrCodeInvalidRequest, "Invalid ip value, expected an address or a CIDR range")
+			return
+		}
+	}
+
+	// the link can only hand out what its creator may do
+	if grant.Mode == ShareUpload {
+		if caller := callerFrom(r.Context()); caller != nil && !caller.HasScope(ScopeWrite) {
+			respondError(w, http.StatusForbidden, ErrCodeForbidden, "The write scope is required for upload links")
+			return
+		}
+		if !authorizeFile(w, r, fileName, PermissionWrite) {
+			return
+		}
+	} else {
+		record, err := findByName(fileName)
+		if checkErrorAndRespond(err, "Error finding file name", http.StatusInternalServerError, ErrCodeInternal, w) {
+			return
+		}
+		if record == nil {
+			respondError(w, http.StatusNotFound, ErrCodeNotFound, "record does not exist")
+			return
+		}
+		if !authorizeFile(w, r, fileName, PermissionRead) {
+			return
+		}
+	}
+
+	grant.ID = newRequestID()[:16]
+	grant.Expires = time.Now().Add(ttl).Unix()
+	signature, err := signShareGrant(grant)
+	if err != nil {
+		log.Println("Error signing the share link:", err)
+		respondError(w, http.StatusInternalServerError, ErrCodeInternal, "Error signing the share link")
+		return
+	}
+
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	link := ShareLink{
+		URL:          scheme + "://" + r.Host + SharedPrefix + (&url.URL{Path: fileName}).EscapedPath() + "?" + grant.query(signature),
+		Filename:     fileName,
+		Mode:         grant.Mode,
+		ExpiresAt:    time.Unix(grant.Expires, 0).UTC(),
+		MaxDownloads: grant.MaxDownloads,
+		IP:           grant.IP,
+	}
+	log.Println("Share link", grant.ID, "for", grant.Mode, "of", fileName, "minted by", callerSubject(r))
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusCreated)
+	err = json.NewEncoder(w).Encode(link)
+	if err != nil {
+		log.Println("Error writing response:", err)
+	}
+}
+
+// sharedHandler serves the file of a share link: GET and HEAD download it with a download link,
+// PUT stores the request body with an upload link. It needs no credentials besides the link.
+func sharedHandler(w http.ResponseWriter, r *http.Request) {
+	grant, err := parseShareGrant(r)
+	if err != nil {
+		log.Println("Rejected share link:", err)
+		respondError(w, http.StatusForbidden, ErrCodeForbidden, "Invalid share link")
+		return
+	}
+	if time.Now().Unix() > grant.Expires {
+		respondError(w, http.StatusForbidden, ErrCodeForbidden, "The share link expired")
+		return
+	}
+	if !grant.allowsAddress(r) {
+		log.Println("Share link", grant.ID, "used from", r.RemoteAddr)
+		respondError(w, http.StatusForbidden, ErrCodeForbidden, "The share link may not be used from this address")
+		return
+	}
+
+	if grant.Mode == ShareUpload {
+		if r.Method != http.MethodPut {
+			methodNotAllowed(w, http.MethodPut)
+			return
+		}
+		log.Println("Share link", grant.ID, "upload of", grant.Filename, "from", r.RemoteAddr)
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		putFile(recorder, grant.Filename, r.Body, StoreOptions{Owner: grant.By})
+		recordShareUpload(r, grant, recorder.status)
+		return
+	}
+
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		methodNotAllowed(w, http.MethodGet, http.MethodHead)
+		return
+	}
+	log.Println("Share link", grant.ID, "download of", grant.Filename, "from", r.RemoteAddr)
+	if grant.MaxDownloads == 0 || r.Method != http.MethodGet {
+		getFileV2(w, r, grant.Filename)
+		return
+	}
+	record := findRecordV2(w, grant.Filename)
+	if record == nil {
+		return
+	}
+	allowed, err := reserveShareDownload(grant)
+	if err != nil {
+		log.Println("Error counting the share link download:", err)
+		respondError(w, http.StatusInternalServerError, ErrCodeInternal, "Error counting the download")
+		return
+	}
+	if !allowed {
+		respondError(w, http.StatusForbidden, ErrCodeForbidden, "The share link reached its download limit")
+		return
+	}
+	recorder := &downloadRecorder{statusRecorder: statusRecorder{ResponseWriter: w, status: http.StatusOK}}
+	getFileV2(recorder, r, grant.Filename)
+	// only a complete download of the whole file counts, not a range, an unchanged file or an error
+	complete := recorder.status == http.StatusOK && !recorder.failed
+	if err := endShareDownload(grant, complete); err != nil {
+		log.Println("Error counting the share link download:", err)
+	}
+}
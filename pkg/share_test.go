@@ -0,0 +1,172 @@
+package pkg
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// mintShareLink mints a share link with the given parameters and returns the request URI of the link.
+func mintShareLink(t *testing.T, handler http.HandlerFunc, token string, params string) string {
+	rr := aclRequest(handler, "POST", "/api/v1/share?"+params, token, "")
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("%s: expected %d, got %d %s", params, http.StatusCreated, rr.Code, rr.Body.String())
+	}
+	var link ShareLink
+	err := json.Unmarshal(rr.Body.Bytes(), &link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := url.Parse(link.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u.RequestURI()
+}
+
+func useShareLink(method, target, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	rr := httptest.NewRecorder()
+	sharedHandler(rr, req)
+	return rr
+}
+
+func TestShareDownloadLink(t *testing.T) {
+	teardown := searchSetup(t)
+	defer teardown()
+	share := allowMethods(shareHandler, http.MethodPost)
+
+	// httptest requests come from 192.0.2.1
+	link := mintShareLink(t, share, "", "filename=fox.txt&maxDownloads=2&ip=192.0.2.0/24&ttl=1h")
+	if rr := useShareLink("HEAD", link, ""); rr.Code != http.StatusOK {
+		t.Errorf("Expected HEAD not to count as a download, got %d", rr.Code)
+	}
+	ranged := httptest.NewRequest("GET", link, nil)
+	ranged.Header.Set("Range", "bytes=0-2")
+	rr := httptest.NewRecorder()
+	sharedHandler(rr, ranged)
+	if rr.Code != http.StatusPartialContent {
+		t.Errorf("Expected a range not to count as a download, got %d", rr.Code)
+	}
+	for i := 0; i < 2; i++ {
+		if rr := useShareLink("GET", link, ""); rr.Code != http.StatusOK || !strings.HasPrefix(rr.Body.String(), "The quick brown fox") {
+			t.Fatalf("Expected download %d to succeed, got %d %s", i+1, rr.Code, rr.Body.String())
+		}
+	}
+	if rr := useShareLink("GET", link, ""); rr.Code != http.StatusForbidden {
+		t.Errorf("Expected the download limit to be enforced, got %d", rr.Code)
+	}
+	if rr := useShareLink("PUT", link, "overwritten"); rr.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected a download link not to upload, got %d", rr.Code)
+	}
+
+	link = mintShareLink(t, share, "", "filename=fox.txt")
+	for name, tampered := range map[string]string{
+		"other file":  strings.Replace(link, "fox.txt", "dog.txt", 1),
+		"more uses":   link + "&max=100",
+		"upload mode": strings.Replace(link, "mode=download", "mode=upload", 1),
+		"no sig":      strings.Replace(link, "sig=", "signature=", 1),
+	} {
+		if rr := useShareLink("GET", tampered, ""); rr.Code != http.StatusForbidden {
+			t.Errorf("%s: expected the tampered link to be rejected, got %d", name, rr.Code)
+		}
+	}
+
+	elsewhere := mintShareLink(t, share, "", "filename=fox.txt&ip=10.0.0.1")
+	if rr := useShareLink("GET", elsewhere, ""); rr.Code != http.StatusForbidden {
+		t.Errorf("Expected the IP restriction to be enforced, got %d", rr.Code)
+	}
+
+	expired := shareGrant{ID: "expired", Filename: "fox.txt", Mode: ShareDownload, Expires: time.Now().Add(-time.Minute).Unix()}
+	signature, err := signShareGrant(expired)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rr := useShareLink("GET", SharedPrefix+"fox.txt?"+expired.query(signature), ""); rr.Code != http.StatusForbidden {
+		t.Errorf("Expected the expired link to be rejected, got %d", rr.Code)
+	}
+}
+
+func TestShareDownloadCountsExpire(t *testing.T) {
+	teardown := searchSetup(t)
+	defer teardown()
+	share := allowMethods(shareHandler, http.MethodPost)
+
+	shareDownloads.Lock()
+	shareDownloads.counts = map[string]shareDownloadCount{
+		"expired": {Count: 3, Expires: time.Now().Add(-time.Hour).Unix()},
+	}
+	shareDownloads.Unlock()
+
+	link := mintShareLink(t, share, "", "filename=fox.txt&maxDownloads=1")
+	if rr := useShareLink("GET", link, ""); rr.Code != http.StatusOK {
+		t.Fatalf("Expected the download to succeed, got %d", rr.Code)
+	}
+	path, err := RecordStorePath("shareDownloads.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var counts map[string]shareDownloadCount
+	if err := loadJSON(path, &counts); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := counts["expired"]; ok || len(counts) != 1 {
+		t.Errorf("Expected only the count of the live link to be kept, got %v", counts)
+	}
+	for _, count := range counts {
+		if count.Count != 1 || count.Expires <= time.Now().Unix() {
+			t.Errorf("Expected one download with the expiry of the link, got %+v", count)
+		}
+	}
+}
+
+func TestShareUploadLink(t *testing.T) {
+	teardown := aclSetup(t)
+	defer teardown()
+	share := requireScope(ScopeRead, allowMethods(shareHandler, http.MethodPost))
+
+	for params, status := range map[string]int{
+		"filename=fox.txt&mode=edit":                   http.StatusBadRequest,
+		"filename=fox.txt&mode=upload&maxDownloads=1":  http.StatusBadRequest,
+		"filename=fox.txt&ttl=9000h":                   http.StatusBadRequest,
+		"filename=fox.txt&ip=somewhere":                http.StatusBadRequest,
+		"filename=missing.txt":                         http.StatusNotFound,
+		"filename=dog.txt":                             http.StatusForbidden,
+		"filename=fox.txt&mode=upload":                 http.StatusForbidden,
+		"filename=partner/report.txt&mode=upload&ip=1": http.StatusBadRequest,
+	} {
+		if rr := aclRequest(share, "POST", "/api/v1/share?"+params, "carol", ""); rr.Code != status {
+			t.Errorf("%s: expected %d, got %d %s", params, status, rr.Code, rr.Body.String())
+		}
+	}
+
+	_, err := accessControl.add(ACLEntry{Principal: "user:alice", Prefix: "partner/", Permissions: []string{PermissionWrite}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	link := mintShareLink(t, share, "alice", "filename=partner/report.txt&mode=upload")
+	if rr := useShareLink("GET", link, ""); rr.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected an upload link not to download, got %d", rr.Code)
+	}
+	if rr := useShareLink("PUT", link, "quarterly report"); rr.Code != http.StatusCreated {
+		t.Fatalf("Expected the upload to be stored, got %d %s", rr.Code, rr.Body.String())
+	}
+	record, err := findByName("partner/report.txt")
+	if err != nil || record == nil || record.Owner != "alice" || record.WordCount != 2 {
+		t.Errorf("Expected the upload to be owned by the creator of the link, got %+v %v", record, err)
+	}
+}
+
+func TestShareSigningInputSeparatesFields(t *testing.T) {
+	// with the fields merely joined, shifting text between the file name and the mode signed both
+	// grants the same
+	first := shareGrant{ID: "1", Filename: "a.txt\nupload", Mode: "download", Expires: 1}
+	second := shareGrant{ID: "1", Filename: "a.txt", Mode: "upload\ndownload", Expires: 1}
+	if first.signingInput() == second.signingInput() {
+		t.Errorf("Expected different grants to have different signing inputs, both are %q", first.signingInput())
+	}
+}
@@ -0,0 +1,531 @@
+package pkg
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"math"
+	"math/bits"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	SimilarityCosine  = "cosine"
+	SimilarityMinHash = "minhash"
+	SimilaritySimHash = "simhash"
+)
+
+const (
+	defaultSimilarLimit = 10
+	maxSimilarLimit     = 100
+	// defaultDuplicateThreshold is the similarity from which the report considers two files near
+	// duplicates.
+	defaultDuplicateThreshold = 0.8
+
+	// minHashShingle is the number of consecutive words hashed together by MinHash.
+	minHashShingle = 3
+	// minHashFunctions is the length of a MinHash signature; the duplicate report splits it into
+	// minHashBands bands and only compares files that agree on a whole band (locality sensitive
+	// hashing), which finds pairs above a similarity of about (1/bands)^(1/rows) = 0.42.
+	minHashFunctions = 128
+	minHashBands     = 32
+)
+
+// minHashSeeds are the parameters of the MinHash functions h(x) = a*x + b; a fixed seed keeps the
+// signatures comparable across restarts.
+var minHashSeeds = func() [minHashFunctions][2]uint64 {
+	var seeds [minHashFunctions][2]uint64
+	random := rand.New(rand.NewSource(1))
+	for i := range seeds {
+		seeds[i] = [2]uint64{random.Uint64() | 1, random.Uint64()}
+	}
+	return seeds
+}()
+
+// minHashCache keeps the MinHash signature of each stored content by tokenizer and MD5 hash, so files
+// are only read again when their content or the tokenizer changes.
+var minHashCache = struct {
+	mu         sync.Mutex
+	signatures map[string][]uint64
+}{signatures: make(map[string][]uint64)}
+
+// SimilarFile is a stored file with its similarity to another one, between 0 and 1.
+type SimilarFile struct {
+	Filename   string  `json:"filename"`
+	Similarity float64 `json:"similarity"`
+}
+
+// SimilarResponse is the body returned by /api/v1/similar.
+type SimilarResponse struct {
+	Filename string        `json:"filename"`
+	Method   string        `json:"method"`
+	Results  []SimilarFile `json:"results"`
+}
+
+// DuplicatePair is a pair of stored files whose similarity reaches the report threshold.
+type DuplicatePair struct {
+	First      string  `json:"first"`
+	Second     string  `json:"second"`
+	Similarity float64 `json:"similarity"`
+}
+
+// DuplicatesResponse is the body returned by /api/v1/duplicates.
+type DuplicatesResponse struct {
+	Method    string          `json:"method"`
+	Threshold float64         `json:"threshold"`
+	Pairs     []DuplicatePair `json:"pairs"`
+}
+
+// similarityFunc returns the similarity of two stored files, between 0 and 1.
+type similarityFunc func(a, b string) float64
+
+// prepareSimilarity computes what method needs to compare the given files.
+func prepareSimilarity(method string, entries []FileDetails) (similarityFunc, map[string][]uint64, error) {
+	switch method {
+	case SimilarityCosine:
+		vectors, norms := termVectors(entries)
+		return func(a, b string) float64 {
+			if norms[a] == 0 || norms[b] == 0 {
+				return 0
+			}
+			small, large := vectors[a], vectors[b]
+			if len(small) > len(large) {
+				small, large = large, small
+			}
+			dot := 0.0
+			for term, count := range small {
+				dot += float64(count) * float64(large[term])
+			}
+			return dot / (norms[a] * norms[b])
+		}, nil, nil
+	case SimilaritySimHash:
+		fingerprints := simHashes(entries)
+		return func(a, b string) float64 {
+			fa, okA := fingerprints[a]
+			fb, okB := fingerprints[b]
+			if !okA || !okB {
+				return 0
+			}
+			return 1 - float64(bits.OnesCount64(fa^fb))/64
+		}, nil, nil
+	case SimilarityMinHash:
+		signatures := minHashSignatures(entries)
+		return func(a, b string) float64 {
+			if signatures[a] == nil || signatures[b] == nil {
+				return 0
+			}
+			equal := 0
+			for i := range signatures[a] {
+				if signatures[a][i] == signatures[b][i] {
+					equal++
+				}
+			}
+			return float64(equal) / minHashFunctions
+		}, signatures, nil
+	}
+	return nil, nil, validateSimilarityMethod(method)
+}
+
+// validateSimilarityMethod returns an error for an unknown similarity method.
+func validateSimilarityMethod(method string) error {
+	switch method {
+	case SimilarityCosine, SimilarityMinHash, SimilaritySimHash:
+		return nil
+	}
+	return fmt.Errorf("Invalid method value, expected %s, %s or %s",
+		SimilarityCosine, SimilarityMinHash, SimilaritySimHash)
+}
+
+// termVectors returns the word counts of the files from the frequency index, with their norms. The
+// count maps of the index are replaced, never modified, so they can be read after the lock is released.
+func termVectors(entries []FileDetails) (map[string]map[string]int, map[string]float64) {
+	frequencyIndex.mu.Lock()
+	frequencyIndex.ensureLoaded()
+	frequencyIndex.mu.Unlock()
+
+	frequencyIndex.mu.RLock()
+	vectors := make(map[string]map[string]int, len(entries))
+	for _, entry := range entries {
+		vectors[entry.Filename] = frequencyIndex.Files[entry.Filename]
+	}
+	frequencyIndex.mu.RUnlock()
+
+	norms := make(map[string]float64, len(vectors))
+	for filename, counts := range vectors {
+		sum := 0.0
+		for _, count := range counts {
+			sum += float64(count) * float64(count)
+		}
+		norms[filename] = math.Sqrt(sum)
+	}
+	return vectors, norms
+}
+
+// simHashes returns the 64-bit SimHash fingerprint of each file, weighting every word by its count.
+// Files without words have no fingerprint, as they would all share the zero one.
+func simHashes(entries []FileDetails) map[string]uint64 {
+	vectors, norms := termVectors(entries)
+	fingerprints := make(map[string]uint64, len(vectors))
+	for filename, counts := range vectors {
+		if norms[filename] == 0 {
+			continue
+		}
+		var weights [64]int
+		for term, count := range counts {
+			h := hashString(term)
+			for bit := 0; bit < 64; bit++ {
+				if h&(1<<bit) != 0 {
+					weights[bit] += count
+				} else {
+					weights[bit] -= count
+				}
+			}
+		}
+		var fingerprint uint64
+		for bit, weight := range weights {
+			if weight > 0 {
+				fingerprint |= 1 << bit
+			}
+		}
+		fingerprints[filename] = fingerprint
+	}
+	return fingerprints
+}
+
+func hashString(s string) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(s))
+	return h.Sum64()
+}
+
+// minHashSignatures returns the MinHash signature of each file, reusing the cached signatures of
+// unchanged contents. Binary files and files without words have a nil signature, and files that
+// cannot be read have none. The missing signatures are computed outside the cache lock, so that
+// concurrent requests only wait for each other's files if they compute the same ones.
+func minHashSignatures(entries []FileDetails) map[string][]uint64 {
+	tokenizer := configuredTokenizer().Name()
+	keyOf := func(entry FileDetails) string { return tokenizer + "/" + entry.FileHash }
+
+	signatures := make(map[string][]uint64, len(entries))
+	var missing []FileDetails
+	minHashCache.mu.Lock()
+	for _, entry := range entries {
+		if signature, ok := minHashCache.signatures[keyOf(entry)]; ok {
+			signatures[entry.Filename] = signature
+		} else {
+			missing = append(missing, entry)
+		}
+	}
+	minHashCache.mu.Unlock()
+	if len(missing) == 0 {
+		return signatures
+	}
+
+	computed := make(map[string][]uint64, len(missing))
+	for _, entry := range missing {
+		signature, err := minHashOfStoredFile(entry.Filename)
+		if err != nil {
+			log.Println("Error computing the MinHash signature of", entry.Filename, err)
+			continue
+		}
+		computed[keyOf(entry)] = signature
+		signatures[entry.Filename] = signature
+	}
+
+	// keep the signatures of every stored content, also those other callers may read
+	current := make(map[string]bool)
+	stored, err := getAllEntries()
+	if err != nil {
+		log.Println("Error getting all entries to prune the MinHash cache:", err)
+	}
+	for _, entry := range stored {
+		current[keyOf(entry)] = true
+	}
+	minHashCache.mu.Lock()
+	defer minHashCache.mu.Unlock()
+	for key, signature := range computed {
+		minHashCache.signatures[key] = signature
+	}
+	if err == nil {
+		for key := range minHashCache.signatures {
+			if !current[key] {
+				delete(minHashCache.signatures, key)
+			}
+		}
+	}
+	return signatures
+}
+
+// minHashOfStoredFile computes the MinHash signature of the word shingles of a stored file. A file
+// shorter than a shingle is hashed as a single shingle, and a binary file has no signature.
+func minHashOfStoredFile(filename string) ([]uint64, error) {
+	filePath, err := getFileStorePath(filename)
+	if err != nil {
+		return nil, err
+	}
+	if text, err := isTextFile(filePath); err != nil || !text {
+		return nil, err
+	}
+	file, err := openDecoded(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer CloseFile(file)
+
+	var signature []uint64
+	addShingle := func(shingle []string) {
+		if signature == nil {
+			signature = make([]uint64, minHashFunctions)
+			for i := range signature {
+				signature[i] = math.MaxUint64
+			}
+		}
+		x := hashString(strings.Join(shingle, " "))
+		for i, seed := range minHashSeeds {
+			if h := seed[0]*x + seed[1]; h < signature[i] {
+				signature[i] = h
+			}
+		}
+	}
+
+	window := make([]string, 0, minHashShingle)
+	err = scanTokens(context.Background(), file, configuredTokenizer(), func(word string) {
+		if len(window) == minHashShingle {
+			copy(window, window[1:])
+			window = window[:minHashShingle-1]
+		}
+		window = append(window, word)
+		if len(window) == minHashShingle {
+			addShingle(window)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if signature == nil && len(window) > 0 {
+		addShingle(window)
+	}
+	return signature, nil
+}
+
+// similarFiles returns the limit files of readable most similar to filename, most similar first.
+func similarFiles(filename string, method string, limit int, readable fileSet) ([]SimilarFile, error) {
+	entries, err := getAllEntries()
+	if err != nil {
+		return nil, err
+	}
+	entries = readable.filter(entries)
+	similarity, _, err := prepareSimilarity(method, entries)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]SimilarFile, 0, len(entries))
+	for _, entry := range entries {
+		if entry.Filename == filename {
+			continue
+		}
+		results = append(results, SimilarFile{entry.Filename, similarity(filename, entry.Filename)})
+	}
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Similarity != results[j].Similarity {
+			return results[i].Similarity > results[j].Similarity
+		}
+		return results[i].Filename < results[j].Filename
+	})
+	return results[:min(limit, len(results))], nil
+}
+
+// nearDuplicates returns every pair of stored files whose similarity is at least threshold, most
+// similar first. MinHash only compares the candidate pairs found by its bands; the other methods
+// compare every pair. Only the files of readable are compared.
+func nearDuplicates(method string, threshold float64, readable fileSet) ([]DuplicatePair, error) {
+	entries, err := getAllEntries()
+	if err != nil {
+		return nil, err
+	}
+	entries = readable.filter(entries)
+	similarity, signatures, err := prepareSimilarity(method, entries)
+	if err != nil {
+		return nil, err
+	}
+
+	var candidates [][2]string
+	if signatures != nil {
+		candidates = minHashCandidates(entries, signatures)
+	} else {
+		for i := range entries {
+			for j := i + 1; j < len(entries); j++ {
+				candidates = append(candidates, [2]string{entries[i].Filename, entries[j].Filename})
+			}
+		}
+	}
+
+	pairs := make([]DuplicatePair, 0)
+	for _, candidate := range candidates {
+		if s := similarity(candidate[0], candidate[1]); s >= threshold {
+			pairs = append(pairs, DuplicatePair{candidate[0], candidate[1], s})
+		}
+	}
+	sort.Slice(pairs, func(i, j int) bool {
+		if pairs[i].Similarity != pairs[j].Similarity {
+			return pairs[i].Similarity > pairs[j].Similarity
+		}
+		if pairs[i].First != pairs[j].First {
+			return pairs[i].First < pairs[j].First
+		}
+		return pairs[i].Second < pairs[j].Second
+	})
+	return pairs, nil
+}
+
+// minHashCandidates returns the pairs of files, in record order, that share at least one band of
+// their signatures.
+func minHashCandidates(entries []FileDetails, signatures map[string][]uint64) [][2]string {
+	rows := minHashFunctions / minHashBands
+	order := make(map[string]int, len(entries))
+	buckets := make(map[string][]string)
+	for i, entry := range entries {
+		order[entry.Filename] = i
+		signature := signatures[entry.Filename]
+		if signature == nil {
+			continue
+		}
+		for band := 0; band < minHashBands; band++ {
+			key := fmt.Sprint(band, signature[band*rows:(band+1)*rows])
+			buckets[key] = append(buckets[key], entry.Filename)
+		}
+	}
+
+	seen := make(map[[2]string]bool)
+	var candidates [][2]string
+	for _, files := range buckets {
+		for i := range files {
+			for j := i + 1; j < len(files); j++ {
+				pair := [2]string{files[i], files[j]}
+				if order[pair[0]] > order[pair[1]] {
+					pair[0], pair[1] = pair[1], pair[0]
+				}
+				if !seen[pair] {
+					seen[pair] = true
+					candidates = append(candidates, pair)
+				}
+			}
+		}
+	}
+	return candidates
+}
+
+func similarHandler(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		log.Println("Error parsing the form:", err)
+		respondError(w, http.StatusBadRequest, ErrCodeInvalidRequest, "Error parsing the form")
+		return
+	}
+
+	fileName := r.FormValue("filename")
+	err = validateRequiredField("filename", fileName)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, ErrCodeMissingField, err.Error())
+		return
+	}
+	if !authorizeFile(w, r, fileName, PermissionRead) {
+		return
+	}
+	readable, ok := readableFiles(w, r)
+	if !ok {
+		return
+	}
+	method := r.FormValue("method")
+	if method == "" {
+		method = SimilarityCosine
+	}
+	limit := defaultSimilarLimit
+	if r.FormValue("limit") != "" {
+		limit, err = strconv.Atoi(r.FormValue("limit"))
+		if err != nil || limit < 1 || limit > maxSimilarLimit {
+			respondError(w, http.StatusBadRequest, ErrCodeInvalidRequest,
+				fmt.Sprintf("Invalid limit value, expected 1 to %d", maxSimilarLimit))
+			return
+		}
+	}
+
+	record, err := findByName(fileName)
+	if err != nil {
+		log.Println("Error executing findByName:", err)
+		respondError(w, http.StatusInternalServerError, ErrCodeInternal, "Error in finding record by name")
+		return
+	}
+	if record == nil {
+		respondError(w, http.StatusNotFound, ErrCodeNotFound, "record does not exist")
+		return
+	}
+
+	if err := validateSimilarityMethod(method); err != nil {
+		respondError(w, http.StatusBadRequest, ErrCodeInvalidRequest, err.Error())
+		return
+	}
+	results, err := similarFiles(record.Filename, method, limit, readable)
+	if err != nil {
+		log.Println("Error finding similar files:", err)
+		respondError(w, http.StatusInternalServerError, ErrCodeInternal, "Error finding similar files")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(SimilarResponse{Filename: record.Filename, Method: method, Results: results})
+	if err != nil {
+		log.Println("Error writing response:", err)
+	}
+}
+
+func duplicatesHandler(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		log.Println("Error parsing the form:", err)
+		respondError(w, http.StatusBadRequest, ErrCodeInvalidRequest, "Error parsing the form")
+		return
+	}
+
+	method := r.FormValue("method")
+	if method == "" {
+		method = SimilarityMinHash
+	}
+	threshold := defaultDuplicateThreshold
+	if r.FormValue("threshold") != "" {
+		threshold, err = strconv.ParseFloat(r.FormValue("threshold"), 64)
+		if err != nil || threshold <= 0 || threshold > 1 {
+			respondError(w, http.StatusBadRequest, ErrCodeInvalidRequest, "Invalid threshold value, expected 0 < threshold <= 1")
+			return
+		}
+	}
+	if err := validateSimilarityMethod(method); err != nil {
+		respondError(w, http.StatusBadRequest, ErrCodeInvalidRequest, err.Error())
+		return
+	}
+
+	readable, ok := readableFiles(w, r)
+	if !ok {
+		return
+	}
+	pairs, err := nearDuplicates(method, threshold, readable)
+	if err != nil {
+		log.Println("Error finding near duplicates:", err)
+		respondError(w, http.StatusInternalServerError, ErrCodeInternal, "Error finding near duplicates")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(DuplicatesResponse{Method: method, Threshold: threshold, Pairs: pairs})
+	if err != nil {
+		log.Println("Error writing response:", err)
+	}
+}
@@ -0,0 +1,189 @@
+package pkg
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+const similarReport = `Quarterly report of the storage team.
+The cluster served every request within the agreed latency and no data was lost.
+Capacity grew by twelve percent, mostly from the analytics workloads, and the
+migration of the archive tier finished two weeks ahead of the plan.
+Next quarter we replace the remaining spinning disks and review the backup policy.
+`
+
+// similarSetup stores a report, the same report with another timestamp line, and two unrelated files.
+func similarSetup(t *testing.T) func() {
+	TestCleanCSV(t)
+	files := []struct{ name, content string }{
+		{"report.txt", "Generated 2024-01-01 10:00:00\n" + similarReport},
+		{"report-copy.txt", "Generated 2024-03-17 18:45:12\n" + similarReport},
+		{"recipe.txt", "Mix the flour with two eggs, add milk and bake for twenty minutes at high heat."},
+		{"poem.txt", "The fog comes on little cat feet. It sits looking over harbor and city."},
+	}
+	for _, file := range files {
+		_, err := storeFile(file.name, strings.NewReader(file.content), StoreOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return func() {
+		teardown()
+	}
+}
+
+func TestSimilarFiles(t *testing.T) {
+	teardown := similarSetup(t)
+	defer teardown()
+
+	for _, method := range []string{SimilarityCosine, SimilarityMinHash, SimilaritySimHash} {
+		results, err := similarFiles("report.txt", method, 2, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(results) != 2 || results[0].Filename != "report-copy.txt" {
+			t.Errorf("%s: expected the copy first, got %v", method, results)
+			continue
+		}
+		if results[0].Similarity < 0.8 || results[0].Similarity <= results[1].Similarity {
+			t.Errorf("%s: expected the copy to stand out, got %v", method, results)
+		}
+	}
+}
+
+func TestNearDuplicates(t *testing.T) {
+	teardown := similarSetup(t)
+	defer teardown()
+
+	for _, method := range []string{SimilarityCosine, SimilarityMinHash, SimilaritySimHash} {
+		pairs, err := nearDuplicates(method, 0.8, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(pairs) != 1 || pairs[0].First != "report.txt" || pairs[0].Second != "report-copy.txt" {
+			t.Errorf("%s: expected the report and its copy, got %v", method, pairs)
+		}
+	}
+}
+
+func TestNearDuplicatesIgnoresFilesWithoutWords(t *testing.T) {
+	teardown := similarSetup(t)
+	defer teardown()
+	// binary files do not count as words either
+	for name, content := range map[string]string{"dashes.txt": "--- ---", "stars.txt": "*** !!!",
+		"first.bin": "\x00\x01ab cd ef\x02", "second.bin": "\x00\x01ab cd ef\x03"} {
+		if _, err := storeFile(name, strings.NewReader(content), StoreOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, method := range []string{SimilarityCosine, SimilarityMinHash, SimilaritySimHash} {
+		pairs, err := nearDuplicates(method, 0.8, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(pairs) != 1 || pairs[0].First != "report.txt" {
+			t.Errorf("%s: expected files without words not to be duplicates, got %v", method, pairs)
+		}
+	}
+}
+
+func TestMinHashSignaturesCache(t *testing.T) {
+	teardown := similarSetup(t)
+	defer teardown()
+	entries, err := getAllEntries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cached := func() int {
+		minHashCache.mu.Lock()
+		defer minHashCache.mu.Unlock()
+		return len(minHashCache.signatures)
+	}
+	minHashCache.mu.Lock()
+	minHashCache.signatures = make(map[string][]uint64)
+	minHashCache.mu.Unlock()
+
+	// callers reading different files keep each other's signatures
+	minHashSignatures(entries[:2])
+	minHashSignatures(entries[2:])
+	if n := cached(); n != len(entries) {
+		t.Errorf("Expected %d cached signatures, got %d", len(entries), n)
+	}
+
+	// a deleted file is evicted, and a file that cannot be read is skipped
+	if err := removeStoredFile(entries[0].Filename); err != nil {
+		t.Fatal(err)
+	}
+	filePath, err := getFileStorePath(entries[1].Filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filePath); err != nil {
+		t.Fatal(err)
+	}
+	minHashCache.mu.Lock()
+	delete(minHashCache.signatures, configuredTokenizer().Name()+"/"+entries[1].FileHash)
+	minHashCache.mu.Unlock()
+	signatures := minHashSignatures(entries[1:])
+	if _, ok := signatures[entries[1].Filename]; ok || len(signatures) != len(entries)-2 {
+		t.Errorf("Expected the unreadable file to be skipped, got %d signatures", len(signatures))
+	}
+	if n := cached(); n != len(entries)-2 {
+		t.Errorf("Expected the deleted file to be evicted, got %d cached signatures", n)
+	}
+}
+
+func TestSimilarHandlers(t *testing.T) {
+	teardown := similarSetup(t)
+	defer teardown()
+
+	rr := httptest.NewRecorder()
+	similarHandler(rr, httptest.NewRequest("GET", "/api/v1/similar?filename=recipe.txt&method=minhash&limit=1", nil))
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+	var similar SimilarResponse
+	err := json.Unmarshal(rr.Body.Bytes(), &similar)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if similar.Filename != "recipe.txt" || similar.Method != SimilarityMinHash || len(similar.Results) != 1 {
+		t.Errorf("Unexpected response: %+v", similar)
+	}
+
+	rr = httptest.NewRecorder()
+	duplicatesHandler(rr, httptest.NewRequest("GET", "/api/v1/duplicates?threshold=0.5", nil))
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+	var duplicates DuplicatesResponse
+	err = json.Unmarshal(rr.Body.Bytes(), &duplicates)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if duplicates.Method != SimilarityMinHash || duplicates.Threshold != 0.5 || len(duplicates.Pairs) != 1 {
+		t.Errorf("Unexpected response: %+v", duplicates)
+	}
+
+	for target, status := range map[string]int{
+		"/api/v1/similar?filename=missing.txt":             http.StatusNotFound,
+		"/api/v1/similar":                                  http.StatusBadRequest,
+		"/api/v1/similar?filename=poem.txt&method=jaccard": http.StatusBadRequest,
+		"/api/v1/duplicates?threshold=2":                   http.StatusBadRequest,
+	} {
+		rr := httptest.NewRecorder()
+		if strings.HasPrefix(target, "/api/v1/similar") {
+			similarHandler(rr, httptest.NewRequest("GET", target, nil))
+		} else {
+			duplicatesHandler(rr, httptest.NewRequest("GET", target, nil))
+		}
+		if rr.Code != status {
+			t.Errorf("%s: expected %d, got %d", target, status, rr.Code)
+		}
+	}
+}
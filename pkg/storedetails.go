@@ -2,10 +2,14 @@ package pkg
 
 import (
 	"encoding/csv"
+	"fmt"
 	"io"
 	"log"
 	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
+	"sync"
 )
 
 var CsvFileLocation string = func() string {
@@ -16,22 +20,99 @@ var CsvFileLocation string = func() string {
 	return path
 }()
 
-var TempCsvFileLocation string = func() string {
-	path, err := RecordStorePath("fileDetailsTemp.csv")
-	if err != nil {
-		log.Fatal(err)
-	}
-	return path
-}()
+// csvMutex serializes the writes of the CSV, so that a record appended while the CSV is being
+// rewritten is not lost. Reads need no lock: a rewrite replaces the CSV in a single rename.
+var csvMutex sync.Mutex
 
 type FileDetails struct {
 	Filename  string
 	FileSize  int64
 	FileHash  string
 	WordCount int
+	// Tags are the keywords recorded for the file, see StoreOptions.
+	Tags []string `json:",omitempty"`
+	// ContentType is the media type sniffed from the content at ingest, e.g. "text/plain".
+	ContentType string `json:",omitempty"`
+	// Encoding is the character encoding detected for text files, e.g. "utf-8" or "utf-16le".
+	Encoding string `json:",omitempty"`
+	// Owner is the caller that stored the file, e.g. "jwt:alice" or "token:<id>"; empty without
+	// authentication. The owner holds every permission on the file.
+	Owner string `json:",omitempty"`
+}
+
+// detailsToRecord converts details into a CSV record. Columns after the word count were added later
+// and are optional when reading, so records written by older versions remain valid.
+func detailsToRecord(details FileDetails) []string {
+	return []string{details.Filename, strconv.FormatInt(details.FileSize, 10), details.FileHash,
+		strconv.Itoa(details.WordCount), strings.Join(details.Tags, " "), details.ContentType,
+		details.Encoding, details.Owner}
+}
+
+// recordToDetails parses a CSV record written by detailsToRecord.
+func recordToDetails(record []string) (FileDetails, error) {
+	if len(record) < 4 {
+		return FileDetails{}, fmt.Errorf("expected at least 4 fields, got %d", len(record))
+	}
+	fileSize, err := strconv.ParseInt(record[1], 10, 64)
+	if err != nil {
+		log.Println("Error parsing the file size:", err)
+		return FileDetails{}, err
+	}
+	wc, err := strconv.Atoi(record[3])
+	if err != nil {
+		log.Println("Error parsing the word count:", err)
+		return FileDetails{}, err
+	}
+
+	details := FileDetails{
+		Filename:  record[0],
+		FileSize:  fileSize,
+		FileHash:  record[2],
+		WordCount: wc,
+	}
+	if len(record) > 4 {
+		details.Tags = strings.Fields(record[4])
+	}
+	if len(record) > 5 {
+		details.ContentType = record[5]
+	}
+	if len(record) > 6 {
+		details.Encoding = record[6]
+	}
+	if len(record) > 7 {
+		details.Owner = record[7]
+	}
+	return details, nil
+}
+
+// newRecordReader returns a CSV reader that accepts records with and without the optional columns.
+func newRecordReader(r io.Reader) *csv.Reader {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	return reader
+}
+
+// RecordListener is notified after the record store changed, so that data derived from the stored
+// files (e.g. the search index) can follow every store, update and delete path.
+// Listeners are called synchronously and must not modify the record store themselves.
+type RecordListener interface {
+	RecordStored(details FileDetails)
+	RecordDeleted(filename string)
+	RecordRenamed(oldName string, details FileDetails)
+	RecordsCleared()
+}
+
+var recordListeners []RecordListener
+
+// registerRecordListener adds a listener to be notified of every change of the record store.
+func registerRecordListener(listener RecordListener) {
+	recordListeners = append(recordListeners, listener)
 }
 
 func storeInCSV(details FileDetails) error {
+	csvMutex.Lock()
+	defer csvMutex.Unlock()
+
 	file, err := os.OpenFile(CsvFileLocation, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
 	if err != nil {
 		log.Println("Error opening the file in storeInCSV method:", err)
@@ -42,35 +123,70 @@ func storeInCSV(details FileDetails) error {
 	writer := csv.NewWriter(file)
 	defer writer.Flush()
 
-	record := []string{details.Filename, strconv.FormatInt(details.FileSize, 10),
-		details.FileHash, strconv.Itoa(details.WordCount)}
-	err = writer.Write(record)
+	err = writer.Write(detailsToRecord(details))
 	if err != nil {
 		log.Println("Error writing record to the file:", err)
 		return err
 	}
 
+	// the listeners may read the records back, so flush before notifying them
+	writer.Flush()
+	err = writer.Error()
+	if err != nil {
+		log.Println("Error flushing the record to the file:", err)
+		return err
+	}
+	for _, listener := range recordListeners {
+		listener.RecordStored(details)
+	}
+
 	return nil
 }
 
 func deleteFromCSV(fileName string) error {
-	file, err := os.Open(CsvFileLocation)
+	err := rewriteCSV(func(record []string) []string {
+		if record[0] == fileName {
+			return nil
+		}
+		return record
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, listener := range recordListeners {
+		listener.RecordDeleted(fileName)
+	}
+
+	return nil
+}
+
+// rewriteCSV replaces every record of the CSV by the result of edit, dropping the records it
+// returns nil for. The records are written to a temporary file that then replaces the CSV in one
+// rename, so readers never see a partial file.
+func rewriteCSV(edit func(record []string) []string) error {
+	csvMutex.Lock()
+	defer csvMutex.Unlock()
+
+	file, err := os.OpenFile(CsvFileLocation, os.O_CREATE|os.O_RDONLY, 0644)
 	if err != nil {
 		log.Println("Error opening the file:", err)
 		return err
 	}
 	defer CloseFile(file)
 
-	temp, err := os.Create(TempCsvFileLocation)
+	temp, err := os.CreateTemp(filepath.Dir(CsvFileLocation), "fileDetails-*.csv")
 	if err != nil {
 		log.Println("Error creating the file:", err)
 		return err
 	}
+	tempPath := temp.Name()
+	// the temporary file is renamed on success, so removing it afterwards is a no-op
+	defer os.Remove(tempPath)
 	defer CloseFile(temp)
 
-	reader := csv.NewReader(file)
+	reader := newRecordReader(file)
 	writer := csv.NewWriter(temp)
-	defer writer.Flush()
 
 	for {
 		record, err := reader.Read()
@@ -82,27 +198,34 @@ func deleteFromCSV(fileName string) error {
 			return err
 		}
 
-		if record[0] != fileName {
-			err = writer.Write(record)
-			if err != nil {
-				log.Println("Error writing record to the file:", err)
-				return err
-			}
+		record = edit(record)
+		if record == nil {
+			continue
+		}
+		err = writer.Write(record)
+		if err != nil {
+			log.Println("Error writing record to the file:", err)
+			return err
 		}
 	}
 
-	err = os.Remove(CsvFileLocation)
+	writer.Flush()
+	err = writer.Error()
 	if err != nil {
-		log.Println("Error removing the file:", err)
+		log.Println("Error flushing the records to the file:", err)
+		return err
+	}
+	err = temp.Chmod(0644)
+	if err != nil {
+		log.Println("Error setting the mode of the file:", err)
 		return err
 	}
 
-	err = os.Rename(TempCsvFileLocation, CsvFileLocation)
+	err = os.Rename(tempPath, CsvFileLocation)
 	if err != nil {
 		log.Println("Error renaming the file:", err)
 		return err
 	}
-
 	return nil
 }
 
@@ -114,7 +237,7 @@ func getAllEntries() ([]FileDetails, error) {
 	}
 	defer CloseFile(file)
 
-	reader := csv.NewReader(file)
+	reader := newRecordReader(file)
 	var entries []FileDetails
 
 	for {
@@ -127,84 +250,50 @@ func getAllEntries() ([]FileDetails, error) {
 			return nil, err
 		}
 
-		fileSize, err := strconv.ParseInt(record[1], 10, 64)
+		details, err := recordToDetails(record)
 		if err != nil {
-			log.Println("Error parsing the file size:", err)
 			return nil, err
 		}
-		wc, err := strconv.Atoi(record[3])
-		if err != nil {
-			log.Println("Error parsing the word count:", err)
-			return nil, err
-		}
-
-		entries = append(entries, FileDetails{
-			Filename:  record[0],
-			FileSize:  fileSize,
-			FileHash:  record[2],
-			WordCount: wc,
-		})
+		entries = append(entries, details)
 	}
 
 	return entries, nil
 }
 func updateInCSV(fileName string, newDetails FileDetails) error {
-	file, err := os.OpenFile(CsvFileLocation, os.O_CREATE|os.O_RDONLY, 0644)
-	if err != nil {
-		log.Println("Error opening the file:", err)
-		return err
-	}
-	defer CloseFile(file)
-
-	temp, err := os.Create(TempCsvFileLocation)
-	if err != nil {
-		log.Println("Error creating the file:", err)
-		return err
-	}
-	defer CloseFile(temp)
-
-	reader := csv.NewReader(file)
-	writer := csv.NewWriter(temp)
-	defer writer.Flush()
-
-	for {
-		record, err := reader.Read()
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			log.Println("Error reading the file:", err)
-			return err
-		}
-
+	err := rewriteCSV(func(record []string) []string {
 		if record[0] == fileName {
 			record[0] = newDetails.Filename
 			record[1] = strconv.FormatInt(newDetails.FileSize, 10)
 			record[2] = newDetails.FileHash
 		}
-
-		err = writer.Write(record)
-		if err != nil {
-			log.Println("Error writing to the file:", err)
-			return err
-		}
-	}
-
-	err = os.Remove(CsvFileLocation)
+		return record
+	})
 	if err != nil {
-		log.Println("Error removing the file:", err)
 		return err
 	}
 
-	err = os.Rename(TempCsvFileLocation, CsvFileLocation)
-	if err != nil {
-		log.Println("Error renaming the file:", err)
-		return err
+	for _, listener := range recordListeners {
+		listener.RecordRenamed(fileName, newDetails)
 	}
 
 	return nil
 }
 
+// retagInCSV replaces the tags of the record of fileName.
+func retagInCSV(fileName string, tags []string) error {
+	return rewriteCSV(func(record []string) []string {
+		if record[0] != fileName {
+			return record
+		}
+		details, err := recordToDetails(record)
+		if err != nil {
+			return record
+		}
+		details.Tags = tags
+		return detailsToRecord(details)
+	})
+}
+
 // TODO: Improve the findByHash function by implementing a hashmap for O(1) lookup time.
 func findByHash(hash string) (*FileDetails, error) {
 	entries, err := getAllEntries()
@@ -264,6 +353,9 @@ func findByHashOrName(hash string, name string) (*FileDetails, error) {
 }
 
 func cleanCSV() error {
+	csvMutex.Lock()
+	defer csvMutex.Unlock()
+
 	file, err := os.Create(CsvFileLocation)
 	if err != nil {
 		log.Println("Error creating the file:", err)
@@ -271,5 +363,9 @@ func cleanCSV() error {
 	}
 	defer CloseFile(file)
 
+	for _, listener := range recordListeners {
+		listener.RecordsCleared()
+	}
+
 	return nil
 }
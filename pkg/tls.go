@@ -0,0 +1,201 @@
+package pkg
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// Client certificate modes of mutual TLS.
+const (
+	ClientAuthRequire  = "require"
+	ClientAuthOptional = "optional"
+)
+
+// TLSConfig serves HTTPS with the certificate and key read from CertFile and KeyFile. Setting
+// ClientCAFile enables mutual TLS: client certificates signed by one of its CAs authenticate the
+// caller by the common name of their subject.
+type TLSConfig struct {
+	CertFile     string `json:"cert_file"`
+	KeyFile      string `json:"key_file"`
+	ClientCAFile string `json:"client_ca_file"`
+	// ClientAuth is "require" (the default) to refuse connections without a valid client
+	// certificate, or "optional" to also accept callers presenting a bearer token instead.
+	ClientAuth string `json:"client_auth"`
+	// ClientScopes are the scopes of every client certificate, read when empty.
+	ClientScopes []string `json:"client_scopes"`
+	// RoleScopes grants scopes to the organizational units of the client certificates, which are
+	// also their roles and ACL groups.
+	RoleScopes map[string][]string `json:"role_scopes"`
+	// ImplicitRoleScopes lets a unit named after a scope grant that scope without being listed in
+	// RoleScopes.
+	ImplicitRoleScopes bool `json:"implicit_role_scopes"`
+}
+
+// tlsReloader holds the TLS configuration built from the files of a TLSConfig and builds it again
+// when any of them changes, so that renewed certificates are picked up without a restart.
+type tlsReloader struct {
+	config TLSConfig
+
+	mutex    sync.Mutex
+	modTimes []time.Time
+	current  *tls.Config
+}
+
+// newTLSReloader loads the certificate, key and client CAs, failing if any of them is not valid.
+func newTLSReloader(config TLSConfig) (*tlsReloader, error) {
+	if config.CertFile == "" || config.KeyFile == "" {
+		return nil, errors.New("tls needs both cert_file and key_file")
+	}
+	if config.ClientAuth != "" && config.ClientAuth != ClientAuthRequire && config.ClientAuth != ClientAuthOptional {
+		return nil, fmt.Errorf("unknown tls client_auth %q", config.ClientAuth)
+	}
+	reloader := &tlsReloader{config: config}
+	modTimes, err := reloader.stat()
+	if err != nil {
+		return nil, err
+	}
+	reloader.current, err = reloader.load()
+	if err != nil {
+		return nil, err
+	}
+	reloader.modTimes = modTimes
+	return reloader, nil
+}
+
+func (r *tlsReloader) files() []string {
+	files := []string{r.config.CertFile, r.config.KeyFile}
+	if r.config.ClientCAFile != "" {
+		files = append(files, r.config.ClientCAFile)
+	}
+	return files
+}
+
+func (r *tlsReloader) stat() ([]time.Time, error) {
+	var modTimes []time.Time
+	for _, file := range r.files() {
+		stat, err := os.Stat(file)
+		if err != nil {
+			return nil, err
+		}
+		modTimes = append(modTimes, stat.ModTime())
+	}
+	return modTimes, nil
+}
+
+// load builds the TLS configuration of a connection from the files.
+func (r *tlsReloader) load() (*tls.Config, error) {
+	certificate, err := tls.LoadX509KeyPair(r.config.CertFile, r.config.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("loading the TLS certificate: %w", err)
+	}
+	config := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{certificate},
+		NextProtos:   []string{"h2", "http/1.1"},
+	}
+	if r.config.ClientCAFile == "" {
+		return config, nil
+	}
+	pem, err := os.ReadFile(r.config.ClientCAFile)
+	if err != nil {
+		return nil, fmt.Errorf("reading the client CAs: %w", err)
+	}
+	config.ClientCAs = x509.NewCertPool()
+	if !config.ClientCAs.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificate found in %s", r.config.ClientCAFile)
+	}
+	config.ClientAuth = tls.RequireAndVerifyClientCert
+	if r.config.ClientAuth == ClientAuthOptional {
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return config, nil
+}
+
+// refresh returns the TLS configuration, loading it again first if a file changed. A change that
+// cannot be loaded, e.g. a certificate written before its key, keeps the previous configuration
+// until the next handshake.
+func (r *tlsReloader) refresh() *tls.Config {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	modTimes, err := r.stat()
+	if err != nil {
+		log.Println("Error checking the TLS files:", err)
+		return r.current
+	}
+	changed := false
+	for i := range modTimes {
+		changed = changed || !modTimes[i].Equal(r.modTimes[i])
+	}
+	if !changed {
+		return r.current
+	}
+	config, err := r.load()
+	if err != nil {
+		log.Println("Error reloading the TLS files, keeping the previous ones:", err)
+		return r.current
+	}
+	log.Println("TLS certificate reloaded")
+	r.current, r.modTimes = config, modTimes
+	return config
+}
+
+// serverConfig returns the configuration for an http.Server, which asks the reloader for the
+// current certificate and client CAs on every handshake.
+func (r *tlsReloader) serverConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return &r.refresh().Certificates[0], nil
+		},
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return r.refresh(), nil
+		},
+	}
+}
+
+// clientCertAuthenticator authenticates the callers presenting a verified client certificate.
+type clientCertAuthenticator struct {
+	config TLSConfig
+}
+
+func (a clientCertAuthenticator) Authenticate(r *http.Request) (*Caller, error) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return nil, nil
+	}
+	certificate := r.TLS.VerifiedChains[0][0]
+	subject := certificate.Subject.CommonName
+	if subject == "" {
+		subject = certificate.Subject.String()
+	}
+	units := certificate.Subject.OrganizationalUnit
+	caller := &Caller{Subject: certSubjectPrefix + subject, Roles: units, Groups: units}
+
+	grant := func(scope string) {
+		if scopeRank[scope] > 0 && !containsString(caller.Scopes, scope) {
+			caller.Scopes = append(caller.Scopes, scope)
+		}
+	}
+	scopes := a.config.ClientScopes
+	if len(scopes) == 0 {
+		scopes = []string{ScopeRead}
+	}
+	for _, scope := range scopes {
+		grant(scope)
+	}
+	for _, unit := range units {
+		if a.config.ImplicitRoleScopes {
+			grant(unit)
+		}
+		for _, scope := range a.config.RoleScopes[unit] {
+			grant(scope)
+		}
+	}
+	return caller, nil
+}
@@ -0,0 +1,165 @@
+package pkg
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testCertificate is a certificate and key signed by parent, or self-signed without one.
+type testCertificate struct {
+	certificate *x509.Certificate
+	key         *ecdsa.PrivateKey
+}
+
+func newTestCertificate(t *testing.T, template *x509.Certificate, parent *testCertificate) *testCertificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+	signer, signerKey := template, key
+	if parent != nil {
+		signer, signerKey = parent.certificate, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificate, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCertificate{certificate: certificate, key: key}
+}
+
+func (c *testCertificate) certPEM() []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.certificate.Raw})
+}
+
+func (c *testCertificate) keyPEM(t *testing.T) []byte {
+	der, err := x509.MarshalECPrivateKey(c.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+}
+
+func (c *testCertificate) tlsCertificate(t *testing.T) tls.Certificate {
+	certificate, err := tls.X509KeyPair(c.certPEM(), c.keyPEM(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return certificate
+}
+
+// writeTestFile writes a file and moves its modification time forward, so that a rewrite within
+// the resolution of the file system is still noticed.
+func writeTestFile(t *testing.T, path string, content []byte, modTime time.Time) {
+	if err := os.WriteFile(path, content, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMutualTLS(t *testing.T) {
+	ca := newTestCertificate(t, &x509.Certificate{SerialNumber: big.NewInt(1), Subject: pkix.Name{CommonName: "test CA"},
+		IsCA: true, BasicConstraintsValid: true, KeyUsage: x509.KeyUsageCertSign}, nil)
+	serverCertificate := func(serial int64) *testCertificate {
+		return newTestCertificate(t, &x509.Certificate{SerialNumber: big.NewInt(serial), Subject: pkix.Name{CommonName: "server"},
+			IPAddresses: []net.IP{net.IPv4(127, 0, 0, 1)}, ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}}, ca)
+	}
+	clientCertificate := func(name string, units ...string) tls.Certificate {
+		return newTestCertificate(t, &x509.Certificate{SerialNumber: big.NewInt(100), Subject: pkix.Name{CommonName: name, OrganizationalUnit: units},
+			ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}}, ca).tlsCertificate(t)
+	}
+
+	dir := t.TempDir()
+	config := TLSConfig{CertFile: filepath.Join(dir, "tls.crt"), KeyFile: filepath.Join(dir, "tls.key"),
+		ClientCAFile: filepath.Join(dir, "ca.crt"), RoleScopes: map[string][]string{"editors": {ScopeWrite}}}
+	modTime := time.Now().Add(-time.Minute)
+	server := serverCertificate(1)
+	writeTestFile(t, config.CertFile, server.certPEM(), modTime)
+	writeTestFile(t, config.KeyFile, server.keyPEM(t), modTime)
+	writeTestFile(t, config.ClientCAFile, ca.certPEM(), modTime)
+
+	if _, err := newTLSReloader(TLSConfig{CertFile: config.CertFile, KeyFile: config.KeyFile, ClientAuth: "sometimes"}); err == nil {
+		t.Error("Expected an unknown client_auth to be refused")
+	}
+	reloader, err := newTLSReloader(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	previousAuthenticators := authenticators
+	defer func() { authenticators = previousAuthenticators }()
+	authenticators = []Authenticator{clientCertAuthenticator{config: config}}
+	ts := httptest.NewUnstartedServer(requireScope(ScopeWrite, func(w http.ResponseWriter, r *http.Request) {
+		caller := callerFrom(r.Context())
+		_, _ = fmt.Fprint(w, caller.Subject, " ", strings.Join(caller.Groups, ","))
+	}))
+	ts.TLS = reloader.serverConfig()
+	ts.StartTLS()
+	defer ts.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.certificate)
+	get := func(certificates ...tls.Certificate) (*http.Response, string, error) {
+		client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true,
+			TLSClientConfig: &tls.Config{RootCAs: roots, Certificates: certificates}}}
+		resp, err := client.Get(ts.URL)
+		if err != nil {
+			return nil, "", err
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		return resp, string(body), err
+	}
+
+	if _, _, err := get(); err == nil {
+		t.Error("Expected a connection without a client certificate to be refused")
+	}
+	resp, body, err := get(clientCertificate("alice", "editors"))
+	if err != nil || resp.StatusCode != http.StatusOK || body != "cert:alice editors" {
+		t.Fatalf("Expected alice to be the caller, got %v %q", err, body)
+	}
+	for _, units := range [][]string{nil, {ScopeWrite}} {
+		if resp, _, err := get(clientCertificate("bob", units...)); err != nil || resp.StatusCode != http.StatusForbidden {
+			t.Errorf("Expected a certificate of the units %v without the write scope to be refused, got %v %v", units, resp, err)
+		}
+	}
+
+	// a renewed certificate is served from the next handshake on
+	server = serverCertificate(2)
+	writeTestFile(t, config.CertFile, server.certPEM(), modTime.Add(time.Second))
+	writeTestFile(t, config.KeyFile, server.keyPEM(t), modTime.Add(time.Second))
+	resp, _, err = get(clientCertificate("alice", "editors"))
+	if err != nil || resp.TLS.PeerCertificates[0].SerialNumber.Int64() != 2 {
+		t.Fatalf("Expected the renewed certificate, got %v", err)
+	}
+
+	// a broken key keeps the previous certificate
+	writeTestFile(t, config.KeyFile, []byte("not a key"), modTime.Add(2*time.Second))
+	resp, _, err = get(clientCertificate("alice", "editors"))
+	if err != nil || resp.TLS.PeerCertificates[0].SerialNumber.Int64() != 2 {
+		t.Errorf("Expected the previous certificate to be kept, got %v", err)
+	}
+}
@@ -0,0 +1,170 @@
+package pkg
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"log"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Tokenizer splits a line of text into the lower-cased terms that are counted, indexed and searched.
+// The word count of a file, the frequency index, the full scan and the search index all use the
+// tokenizer selected in the configuration, so that their numbers agree.
+type Tokenizer interface {
+	// Name identifies the tokenizer in the configuration and in the persisted indexes.
+	Name() string
+	Tokens(line string) []string
+}
+
+const (
+	TokenizerWhitespace = "whitespace"
+	TokenizerUnicode    = "unicode"
+	TokenizerStemming   = "stemming"
+)
+
+// DefaultTokenizer is used when the configuration does not select one.
+const DefaultTokenizer = TokenizerUnicode
+
+var tokenizers = map[string]Tokenizer{
+	TokenizerWhitespace: WhitespaceTokenizer{},
+	TokenizerUnicode:    UnicodeTokenizer{},
+	TokenizerStemming:   StemmingTokenizer{},
+}
+
+// WhitespaceTokenizer splits on white space only, so punctuation stays part of the words.
+type WhitespaceTokenizer struct{}
+
+func (WhitespaceTokenizer) Name() string { return TokenizerWhitespace }
+
+func (WhitespaceTokenizer) Tokens(line string) []string {
+	return strings.Fields(strings.ToLower(line))
+}
+
+// UnicodeTokenizer splits on every character that is neither a letter nor a number, dropping
+// punctuation, so "end." and "end" are the same word.
+type UnicodeTokenizer struct{}
+
+func (UnicodeTokenizer) Name() string { return TokenizerUnicode }
+
+func (UnicodeTokenizer) Tokens(line string) []string {
+	return strings.FieldsFunc(strings.ToLower(line), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
+
+// StemmingTokenizer splits like UnicodeTokenizer and reduces English words to their stem with the
+// Porter algorithm, so "connected", "connecting" and "connection" are counted as "connect".
+type StemmingTokenizer struct{}
+
+func (StemmingTokenizer) Name() string { return TokenizerStemming }
+
+func (StemmingTokenizer) Tokens(line string) []string {
+	tokens := UnicodeTokenizer{}.Tokens(line)
+	for i, token := range tokens {
+		tokens[i] = porterStem(token)
+	}
+	return tokens
+}
+
+// configuredTokenizer returns the tokenizer selected in the configuration.
+func configuredTokenizer() Tokenizer {
+	config, err := GetConfig()
+	if err != nil {
+		log.Println("Error reading the configuration, using the default tokenizer:", err)
+		return tokenizers[DefaultTokenizer]
+	}
+	if config.Tokenizer == "" {
+		return tokenizers[DefaultTokenizer]
+	}
+	tokenizer, ok := tokenizers[config.Tokenizer]
+	if !ok {
+		log.Println("Unknown tokenizer", config.Tokenizer, "using", DefaultTokenizer)
+		return tokenizers[DefaultTokenizer]
+	}
+	return tokenizer
+}
+
+// scanTokens reads r line by line and calls fn with every token, stopping as soon as ctx is
+// cancelled.
+func scanTokens(ctx context.Context, r io.Reader, tokenizer Tokenizer, fn func(token string)) error {
+	scanner := newLineScanner(r)
+	n := 0
+	for scanner.Scan() {
+		for _, token := range tokenizer.Tokens(scanner.Text()) {
+			n++
+			if n%cancelCheckInterval == 0 && ctx.Err() != nil {
+				return ctx.Err()
+			}
+			fn(token)
+		}
+	}
+	return scanner.Err()
+}
+
+// maxLineChunk is the longest piece of a line handed out by a lineScanner.
+const maxLineChunk = 1024 * 1024
+
+// lineScanner reads text line by line like a bufio.Scanner, but hands out a line longer than
+// maxLineChunk in several pieces instead of failing with bufio.ErrTooLong, so that minified JSON or
+// a log without newlines can still be read. A line is cut after whitespace where possible, else
+// between words, so that the pieces tokenize like the whole line.
+type lineScanner struct {
+	*bufio.Scanner
+	line int
+	next int
+}
+
+func newLineScanner(r io.Reader) *lineScanner {
+	s := &lineScanner{next: 1}
+	s.Scanner = bufio.NewScanner(r)
+	s.Scanner.Buffer(make([]byte, 64*1024), maxLineChunk)
+	s.Scanner.Split(s.split)
+	return s
+}
+
+// Line is the number of the line the current piece belongs to, starting at 1.
+func (s *lineScanner) Line() int {
+	return s.line
+}
+
+func (s *lineScanner) split(data []byte, atEOF bool) (int, []byte, error) {
+	advance, token, err := bufio.ScanLines(data, atEOF)
+	if err != nil || advance > 0 || token != nil {
+		s.line = s.next
+		s.next++
+		return advance, token, err
+	}
+	if len(data) < maxLineChunk {
+		return 0, nil, nil
+	}
+	s.line = s.next
+	cut := lineCut(data[:maxLineChunk])
+	return cut, data[:cut], nil
+}
+
+// lineCut is where a piece of a long line ends: after its last whitespace, else after its last
+// rune that is no letter or digit, else before a rune cut in half.
+func lineCut(data []byte) int {
+	complete, start := len(data), len(data)-1
+	for start > 0 && !utf8.RuneStart(data[start]) {
+		start--
+	}
+	if start > 0 && !utf8.FullRune(data[start:]) {
+		complete = start
+	}
+	for _, separator := range []func(rune) bool{unicode.IsSpace, isWordSeparator} {
+		if i := bytes.LastIndexFunc(data[:complete], separator); i >= 0 {
+			_, size := utf8.DecodeRune(data[i:])
+			return i + size
+		}
+	}
+	return complete
+}
+
+func isWordSeparator(r rune) bool {
+	return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+}
@@ -0,0 +1,104 @@
+package pkg
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestTokenizers(t *testing.T) {
+	line := "The end. Connected, connecting (connection) don't"
+	for tokenizer, expected := range map[Tokenizer][]string{
+		WhitespaceTokenizer{}: {"the", "end.", "connected,", "connecting", "(connection)", "don't"},
+		UnicodeTokenizer{}:    {"the", "end", "connected", "connecting", "connection", "don", "t"},
+		StemmingTokenizer{}:   {"the", "end", "connect", "connect", "connect", "don", "t"},
+	} {
+		if tokens := tokenizer.Tokens(line); !reflect.DeepEqual(tokens, expected) {
+			t.Errorf("%s: expected %v, got %v", tokenizer.Name(), expected, tokens)
+		}
+	}
+}
+
+func TestPorterStem(t *testing.T) {
+	for word, stem := range map[string]string{
+		"caresses": "caress", "ponies": "poni", "cats": "cat", "feed": "feed", "agreed": "agre",
+		"plastered": "plaster", "motoring": "motor", "sing": "sing", "hopping": "hop", "falling": "fall",
+		"filing": "file", "happy": "happi", "relational": "relat", "conditional": "condit",
+		"generalizations": "gener", "adjustable": "adjust", "running": "run", "effective": "effect",
+		"controlling": "control", "is": "is", "café": "café",
+	} {
+		if got := porterStem(word); got != stem {
+			t.Errorf("%s: expected %s, got %s", word, stem, got)
+		}
+	}
+}
+
+func TestWordCountAgreesWithFrequencies(t *testing.T) {
+	teardown := fileStoreSetup(t)
+	defer teardown()
+
+	record, err := findByName(TestFileName)
+	if err != nil || record == nil {
+		t.Fatalf("Expected a record for %s: %v", TestFileName, err)
+	}
+	frequencyIndex.mu.RLock()
+	total := 0
+	for _, count := range frequencyIndex.Files[TestFileName] {
+		total += count
+	}
+	frequencyIndex.mu.RUnlock()
+	if total != record.WordCount {
+		t.Errorf("Expected the word count %d to match the frequency index, got %d", record.WordCount, total)
+	}
+}
+
+func TestIndexesRebuiltForAnotherTokenizer(t *testing.T) {
+	teardown := searchSetup(t)
+	defer teardown()
+
+	// pretend both indexes were built with another tokenizer than the configured one
+	frequencyIndex.mu.Lock()
+	frequencyIndex.Tokenizer = TokenizerWhitespace
+	frequencyIndex.Totals = map[string]int{"dog.": 1}
+	frequencyIndex.mu.Unlock()
+	searchIndex.mu.Lock()
+	searchIndex.Tokenizer = TokenizerWhitespace
+	searchIndex.Postings = make(map[string]map[string][]int)
+	searchIndex.mu.Unlock()
+
+	if result := frequencyMap(frequencyIndex.Frequencies(100, true)); result["dog"] != 3 || result["dog."] != 0 {
+		t.Errorf("Expected the frequency index to be rebuilt, got %v", result)
+	}
+	if hits := runSearch(t, "sleeps"); hits["dog.txt"] != 1 {
+		t.Errorf("Expected the search index to be rebuilt, got %v", hits)
+	}
+}
+
+func TestLinesLongerThanTheScanBuffer(t *testing.T) {
+	teardown := fileStoreSetup(t)
+	defer teardown()
+
+	// one line of minified JSON well over maxLineChunk, followed by a short line
+	long := "[" + strings.Repeat(`{"word":"lazy"},`, maxLineChunk/8) + "]"
+	details, err := storeFile("minified.json", strings.NewReader(long+"\nlast line"), StoreOptions{})
+	if err != nil {
+		t.Fatalf("Expected a file with a long line to be stored, got %v", err)
+	}
+	if expected := 2*maxLineChunk/8 + 2; details.WordCount != expected {
+		t.Errorf("Expected %d words, got %d", expected, details.WordCount)
+	}
+
+	scanner := newLineScanner(strings.NewReader(long + "\nlast line"))
+	pieces := 0
+	var text strings.Builder
+	for scanner.Scan() && scanner.Line() == 1 {
+		pieces++
+		text.WriteString(scanner.Text())
+	}
+	if pieces < 2 || text.String() != long {
+		t.Errorf("Expected the long line in several pieces, got %d pieces", pieces)
+	}
+	if scanner.Line() != 2 || scanner.Text() != "last line" {
+		t.Errorf("Expected the short line as line 2, got %d %q", scanner.Line(), scanner.Text())
+	}
+}
@@ -0,0 +1,323 @@
+package pkg
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// APIToken is a bearer token as kept in the tokens file. Only the SHA-256 hash of the token is
+// stored; the token itself is shown once, when it is issued.
+type APIToken struct {
+	ID        string     `json:"id"`
+	Name      string     `json:"name,omitempty"`
+	Hash      string     `json:"hash"`
+	Scopes    []string   `json:"scopes"`
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+// TokenInfo describes a token in the responses of the admin API.
+type TokenInfo struct {
+	ID        string     `json:"id"`
+	Name      string     `json:"name,omitempty"`
+	Scopes    []string   `json:"scopes"`
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+// IssuedToken is the response to issuing a token, the only time the token is returned.
+type IssuedToken struct {
+	TokenInfo
+	Token string `json:"token"`
+}
+
+// TokensResponse lists the tokens of the tokens file.
+type TokensResponse struct {
+	Tokens []TokenInfo `json:"tokens"`
+}
+
+type tokensFile struct {
+	Tokens []APIToken `json:"tokens"`
+}
+
+// apiTokens is the token store of the server, nil unless a tokens file is configured.
+var apiTokens *tokenStore
+
+var errTokenNotFound = errors.New("token does not exist")
+
+// tokenStore authenticates API tokens against the tokens file. The file is read again whenever it
+// changed, so tokens added by hand take effect without a restart.
+type tokenStore struct {
+	mu      sync.Mutex
+	path    string
+	modTime time.Time
+	tokens  []APIToken
+}
+
+func newTokenStore(path string) *tokenStore {
+	return &tokenStore{path: path}
+}
+
+// hashToken returns the hex encoded SHA-256 hash of a token, the form it is kept in.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func (t APIToken) info() TokenInfo {
+	return TokenInfo{ID: t.ID, Name: t.Name, Scopes: t.Scopes, CreatedAt: t.CreatedAt, ExpiresAt: t.ExpiresAt}
+}
+
+// refresh reads the tokens file if it changed since it was last read. The caller must hold the lock.
+func (s *tokenStore) refresh() error {
+	stat, err := os.Stat(s.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		s.tokens, s.modTime = nil, time.Time{}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if stat.ModTime().Equal(s.modTime) {
+		return nil
+	}
+	var file tokensFile
+	err = loadJSON(s.path, &file)
+	if err != nil {
+		return fmt.Errorf("reading the tokens file: %w", err)
+	}
+	s.tokens, s.modTime = file.Tokens, stat.ModTime()
+	return nil
+}
+
+// save writes the tokens file readable by the owner only. The caller must hold the lock.
+func (s *tokenStore) save() error {
+	data, err := json.MarshalIndent(tokensFile{Tokens: s.tokens}, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	err = os.WriteFile(tmp, data, 0600)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmp, s.path)
+	if err != nil {
+		return err
+	}
+	if stat, err := os.Stat(s.path); err == nil {
+		s.modTime = stat.ModTime()
+	}
+	return nil
+}
+
+// Authenticate accepts the bearer tokens of the tokens file. Tokens it does not know are left to
+// the other authenticators; expired ones are rejected.
+func (s *tokenStore) Authenticate(r *http.Request) (*Caller, error) {
+	token := bearerToken(r)
+	if token == "" {
+		return nil, nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err := s.refresh()
+	if err != nil {
+		return nil, err
+	}
+
+	hash := hashToken(token)
+	for _, entry := range s.tokens {
+		if subtle.ConstantTimeCompare([]byte(entry.Hash), []byte(hash)) != 1 {
+			continue
+		}
+		if entry.ExpiresAt != nil && time.Now().After(*entry.ExpiresAt) {
+			return nil, fmt.Errorf("token %s expired", entry.ID)
+		}
+		return &Caller{Subject: tokenSubjectPrefix + entry.ID, Scopes: entry.Scopes}, nil
+	}
+	return nil, nil
+}
+
+// issue creates a token with the given scopes, valid for ttl unless ttl is zero.
+func (s *tokenStore) issue(name string, scopes []string, ttl time.Duration) (IssuedToken, error) {
+	secret := make([]byte, 32)
+	_, err := rand.Read(secret)
+	if err != nil {
+		return IssuedToken{}, err
+	}
+	token := "mfs_" + base64.RawURLEncoding.EncodeToString(secret)
+	entry := APIToken{ID: newRequestID()[:16], Name: name, Hash: hashToken(token), Scopes: scopes,
+		CreatedAt: time.Now().UTC().Truncate(time.Second)}
+	if ttl > 0 {
+		expires := entry.CreatedAt.Add(ttl)
+		entry.ExpiresAt = &expires
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err = s.refresh()
+	if err != nil {
+		return IssuedToken{}, err
+	}
+	s.tokens = append(s.tokens, entry)
+	err = s.save()
+	if err != nil {
+		return IssuedToken{}, err
+	}
+	return IssuedToken{TokenInfo: entry.info(), Token: token}, nil
+}
+
+// revoke removes the token with the given id.
+func (s *tokenStore) revoke(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err := s.refresh()
+	if err != nil {
+		return err
+	}
+	for i, entry := range s.tokens {
+		if entry.ID == id {
+			s.tokens = append(s.tokens[:i:i], s.tokens[i+1:]...)
+			return s.save()
+		}
+	}
+	return errTokenNotFound
+}
+
+// list returns the tokens ordered by creation.
+func (s *tokenStore) list() ([]TokenInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err := s.refresh()
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]TokenInfo, 0, len(s.tokens))
+	for _, entry := range s.tokens {
+		infos = append(infos, entry.info())
+	}
+	sort.SliceStable(infos, func(i, j int) bool { return infos[i].CreatedAt.Before(infos[j].CreatedAt) })
+	return infos, nil
+}
+
+// parseScopes reads the repeated or comma-separated "scope" values.
+func parseScopes(values []string) ([]string, error) {
+	var scopes []string
+	for _, value := range values {
+		for _, scope := range strings.Split(value, ",") {
+			scope = strings.TrimSpace(scope)
+			if scope == "" {
+				continue
+			}
+			if scopeRank[scope] == 0 {
+				return nil, fmt.Errorf("Invalid scope %q, expected read, write or admin", scope)
+			}
+			scopes = append(scopes, scope)
+		}
+	}
+	if len(scopes) == 0 {
+		return nil, errors.New("scope is required")
+	}
+	return scopes, nil
+}
+
+// tokensHandler is the admin API of the API tokens: GET lists them, POST issues one with the given
+// "name", "scope" values and optional "ttl", DELETE revokes the token "id".
+func tokensHandler(w http.ResponseWriter, r *http.Request) {
+	if apiTokens == nil {
+		respondError(w, http.StatusNotFound, ErrCodeNotFound, "API tokens are not configured")
+		return
+	}
+	err := r.ParseForm()
+	if err != nil {
+		log.Println("Error parsing the form:", err)
+		respondError(w, http.StatusBadRequest, ErrCodeInvalidRequest, "Error parsing the form")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		tokens, err := apiTokens.list()
+		if err != nil {
+			log.Println("Error listing the tokens:", err)
+			respondError(w, http.StatusInternalServerError, ErrCodeInternal, "Error reading the tokens")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(TokensResponse{Tokens: tokens})
+		if err != nil {
+			log.Println("Error writing response:", err)
+		}
+
+	case http.MethodPost:
+		scopes, err := parseScopes(r.Form["scope"])
+		if err != nil {
+			respondError(w, http.StatusBadRequest, ErrCodeInvalidRequest, err.Error())
+			return
+		}
+		var ttl time.Duration
+		if r.FormValue("ttl") != "" {
+			ttl, err = time.ParseDuration(r.FormValue("ttl"))
+			if err != nil || ttl <= 0 {
+				respondError(w, http.StatusBadRequest, ErrCodeInvalidRequest, "Invalid ttl value, expected a duration")
+				return
+			}
+		}
+		issued, err := apiTokens.issue(r.FormValue("name"), scopes, ttl)
+		if err != nil {
+			log.Println("Error issuing a token:", err)
+			respondError(w, http.StatusInternalServerError, ErrCodeInternal, "Error issuing the token")
+			return
+		}
+		log.Println("Token", issued.ID, "issued by", callerSubject(r))
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(http.StatusCreated)
+		err = json.NewEncoder(w).Encode(issued)
+		if err != nil {
+			log.Println("Error writing response:", err)
+		}
+
+	case http.MethodDelete:
+		id := r.FormValue("id")
+		err := validateRequiredField("id", id)
+		if err != nil {
+			respondError(w, http.StatusBadRequest, ErrCodeMissingField, err.Error())
+			return
+		}
+		err = apiTokens.revoke(id)
+		if errors.Is(err, errTokenNotFound) {
+			respondError(w, http.StatusNotFound, ErrCodeNotFound, err.Error())
+			return
+		}
+		if err != nil {
+			log.Println("Error revoking the token:", err)
+			respondError(w, http.StatusInternalServerError, ErrCodeInternal, "Error revoking the token")
+			return
+		}
+		log.Println("Token", id, "revoked by", callerSubject(r))
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// callerSubject names the caller of a request for the logs.
+func callerSubject(r *http.Request) string {
+	if caller := callerFrom(r.Context()); caller != nil {
+		return caller.Subject
+	}
+	return "anonymous"
+}
@@ -0,0 +1,340 @@
+package pkg
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// FilesV2Collection is the collection of stored files and FilesV2Prefix the path under which every
+// stored file is exposed as a resource.
+const (
+	FilesV2Collection = "/api/v2/files"
+	FilesV2Prefix     = FilesV2Collection + "/"
+)
+
+var filesV2Methods = []string{http.MethodGet, http.MethodHead, http.MethodPut, http.MethodPatch, http.MethodDelete}
+
+// FilePatch is the JSON body accepted by PATCH /api/v2/files/{name}. Only the name and the tags of
+// a file can be changed; any other field is refused.
+type FilePatch struct {
+	Filename string `json:"filename"`
+	// Tags, when present, replace the recorded tags; an empty list removes them.
+	Tags *[]string `json:"tags"`
+}
+
+// allowMethods wraps a handler so that requests with any other method are answered with 405.
+func allowMethods(handler http.HandlerFunc, methods ...string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		for _, method := range methods {
+			if r.Method == method {
+				handler(w, r)
+				return
+			}
+		}
+		methodNotAllowed(w, methods...)
+	}
+}
+
+func methodNotAllowed(w http.ResponseWriter, methods ...string) {
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	respondError(w, http.StatusMethodNotAllowed, ErrCodeMethodNotAllowed, "Method not allowed")
+}
+
+// filesV2Handler serves /api/v2/files/{name}; the name is the rest of the path and may contain slashes.
+func filesV2Handler(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, FilesV2Prefix)
+	if name == "" {
+		// "/api/v2/files/" is the collection itself
+		allowMethods(listFilesV2Handler, http.MethodGet, http.MethodHead)(w, r)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		if authorizeFile(w, r, name, PermissionRead) {
+			getFileV2(w, r, name)
+		}
+	case http.MethodPut:
+		putFileV2(w, r, name)
+	case http.MethodPatch:
+		if authorizeFile(w, r, name, PermissionWrite) {
+			patchFileV2(w, r, name)
+		}
+	case http.MethodDelete:
+		if authorizeFile(w, r, name, PermissionDelete) {
+			deleteFileV2(w, name)
+		}
+	default:
+		methodNotAllowed(w, filesV2Methods...)
+	}
+}
+
+// listFilesV2Handler returns one page of the filtered and sorted file listing together with the
+// total number of matching files and the cursor of the next page.
+func listFilesV2Handler(w http.ResponseWriter, r *http.Request) {
+	page, ok := queryEntries(w, r, r.URL.Query(), DefaultListLimit)
+	if !ok {
+		return
+	}
+	if page.Items == nil {
+		page.Items = []FileDetails{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(page)
+	if err != nil {
+		log.Println("Error encoding the page to JSON:", err)
+	}
+}
+
+// findRecordV2 looks up the record of name and responds with 404 or 500 if there is none.
+func findRecordV2(w http.ResponseWriter, name string) *FileDetails {
+	record, err := findByName(name)
+	if err != nil {
+		log.Println("Error executing findByName:", err)
+		respondError(w, http.StatusInternalServerError, ErrCodeInternal, "Error in finding record by name")
+		return nil
+	}
+	if record == nil {
+		respondError(w, http.StatusNotFound, ErrCodeNotFound, "record does not exist")
+		return nil
+	}
+	return record
+}
+
+// setMetadataHeaders exposes the FileDetails of a record as response headers.
+func setMetadataHeaders(w http.ResponseWriter, record *FileDetails) {
+	w.Header().Set("ETag", `"`+record.FileHash+`"`)
+	w.Header().Set("X-File-Hash", record.FileHash)
+	w.Header().Set("X-File-Size", strconv.FormatInt(record.FileSize, 10))
+	w.Header().Set("X-Word-Count", strconv.Itoa(record.WordCount))
+	if record.Encoding != "" {
+		w.Header().Set("X-File-Encoding", record.Encoding)
+	}
+}
+
+// getFileV2 downloads the file on GET and only sends its metadata headers on HEAD. With
+// encoding=utf-8 text stored in another encoding is sent as UTF-8, from its normalized copy if one
+// was kept.
+func getFileV2(w http.ResponseWriter, r *http.Request, name string) {
+	encoding := r.URL.Query().Get("encoding")
+	if encoding != "" && !strings.EqualFold(encoding, EncodingUTF8) {
+		respondError(w, http.StatusBadRequest, ErrCodeInvalidRequest, "Invalid encoding value, expected utf-8")
+		return
+	}
+	record := findRecordV2(w, name)
+	if record == nil {
+		return
+	}
+	convert := encoding != "" && record.Encoding != "" && record.Encoding != EncodingUTF8
+
+	filePath, err := getFileStorePath(name)
+	if err != nil {
+		log.Println("Error getting file path:", err)
+		respondError(w, http.StatusInternalServerError, ErrCodeInternal, "Error getting file path from config")
+		return
+	}
+	if convert {
+		if copyPath, err := normalizedCopyPath(name); err == nil {
+			if _, err := os.Stat(copyPath); err == nil {
+				filePath, convert = copyPath, false
+			}
+		}
+	}
+	file, err := os.Open(filePath)
+	if err != nil {
+		log.Println("Error opening the file:", err)
+		respondError(w, http.StatusInternalServerError, ErrCodeInternal, "Error opening the file")
+		return
+	}
+	defer CloseFile(file)
+
+	info, err := file.Stat()
+	if err != nil {
+		log.Println("Error reading the file info:", err)
+		respondError(w, http.StatusInternalServerError, ErrCodeInternal, "Error opening the file")
+		return
+	}
+
+	setMetadataHeaders(w, record)
+	contentType := "application/octet-stream"
+	if record.ContentType != "" {
+		contentType = record.ContentType
+	}
+	switch {
+	case encoding != "" && record.Encoding != "":
+		contentType += "; charset=" + EncodingUTF8
+		// the hash is the one of the stored content, not of the converted text
+		w.Header().Del("ETag")
+	case record.Encoding != "":
+		contentType += "; charset=" + record.Encoding
+	}
+	w.Header().Set("Content-Type", contentType)
+
+	if convert {
+		// without a normalized copy the text is converted while it is sent, so ranges are not supported
+		if r.Method == http.MethodHead {
+			return
+		}
+		_, err = io.Copy(w, newDecoder(file, record.Encoding))
+		if err != nil {
+			log.Println("Error writing response:", err)
+		}
+		return
+	}
+	// ServeContent takes care of HEAD, ranges and conditional requests against the ETag
+	http.ServeContent(w, r, "", info.ModTime(), file)
+}
+
+// putFileV2 stores the request body as the file name, creating the record or replacing its content.
+func putFileV2(w http.ResponseWriter, r *http.Request, name string) {
+	fileName, err := cleanStoreName(name)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, ErrCodeInvalidRequest, err.Error())
+		return
+	}
+	if !authorizeFile(w, r, fileName, PermissionWrite) {
+		return
+	}
+
+	opts, ok := requestStoreOptions(w, r, r.URL.Query())
+	if !ok {
+		return
+	}
+	putFile(w, fileName, r.Body, opts)
+}
+
+// putFile stores src as the file fileName, creating the record or replacing its content, and
+// responds with the FileDetails.
+func putFile(w http.ResponseWriter, fileName string, src io.Reader, opts StoreOptions) {
+	record, err := findByName(fileName)
+	if err != nil {
+		log.Println("Error executing findByName:", err)
+		respondError(w, http.StatusInternalServerError, ErrCodeInternal, "Error in finding record by name")
+		return
+	}
+
+	var details *FileDetails
+	code := http.StatusCreated
+	if record == nil {
+		details, err = storeFile(fileName, src, opts)
+	} else {
+		details, err = replaceFile(*record, src, opts)
+		code = http.StatusOK
+	}
+	if errors.Is(err, ErrFileExists) {
+		respondError(w, http.StatusConflict, ErrCodeAlreadyExists, "File already exists")
+		return
+	}
+	if err != nil {
+		log.Println("Error storing the file:", err)
+		respondError(w, http.StatusInternalServerError, ErrCodeInternal, "Error storing the file")
+		return
+	}
+
+	writeDetailsV2(w, code, details)
+}
+
+// patchFileV2 renames and retags a file according to the FilePatch in the request body.
+func patchFileV2(w http.ResponseWriter, r *http.Request, name string) {
+	var patch FilePatch
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(&patch)
+	if err != nil {
+		log.Println("Error decoding the patch:", err)
+		respondError(w, http.StatusBadRequest, ErrCodeInvalidRequest, "Invalid JSON body, expected filename and tags only")
+		return
+	}
+	if patch.Tags != nil {
+		for _, tag := range *patch.Tags {
+			if tag == "" || strings.ContainsFunc(tag, unicode.IsSpace) {
+				respondError(w, http.StatusBadRequest, ErrCodeInvalidRequest, fmt.Sprintf("Invalid tag %q, tags are single words", tag))
+				return
+			}
+		}
+	}
+
+	record := findRecordV2(w, name)
+	if record == nil {
+		return
+	}
+
+	if patch.Filename != "" && patch.Filename != record.Filename {
+		newName, err := cleanStoreName(patch.Filename)
+		if err != nil {
+			respondError(w, http.StatusBadRequest, ErrCodeInvalidRequest, err.Error())
+			return
+		}
+		noteRename(r, record.Filename, newName)
+		existing, err := findByName(newName)
+		if err != nil {
+			log.Println("Error executing findByName:", err)
+			respondError(w, http.StatusInternalServerError, ErrCodeInternal, "Error in finding record by name")
+			return
+		}
+		if existing != nil {
+			respondError(w, http.StatusConflict, ErrCodeAlreadyExists, "File already exists")
+			return
+		}
+		if !authorizeFile(w, r, newName, PermissionWrite) {
+			return
+		}
+
+		err = ManageFileUpdate(false, newName, *record)
+		if errors.Is(err, ErrFileExists) {
+			respondError(w, http.StatusConflict, ErrCodeAlreadyExists, "File already exists")
+			return
+		}
+		if err != nil {
+			respondError(w, http.StatusInternalServerError, ErrCodeInternal, "Error updating the file")
+			return
+		}
+		record.Filename = newName
+	}
+
+	if patch.Tags != nil {
+		err = retagInCSV(record.Filename, *patch.Tags)
+		if err != nil {
+			log.Println("Error updating the tags:", err)
+			respondError(w, http.StatusInternalServerError, ErrCodeInternal, "Error updating the tags")
+			return
+		}
+		record.Tags = *patch.Tags
+	}
+
+	writeDetailsV2(w, http.StatusOK, record)
+}
+
+func deleteFileV2(w http.ResponseWriter, name string) {
+	record := findRecordV2(w, name)
+	if record == nil {
+		return
+	}
+
+	err := removeStoredFile(name)
+	if err != nil {
+		log.Println("Error deleting the file:", err)
+		respondError(w, http.StatusInternalServerError, ErrCodeInternal, "Error deleting the file")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func writeDetailsV2(w http.ResponseWriter, code int, details *FileDetails) {
+	setMetadataHeaders(w, details)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	err := json.NewEncoder(w).Encode(details)
+	if err != nil {
+		log.Println("Error encoding the record to JSON:", err)
+	}
+}
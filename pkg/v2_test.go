@@ -0,0 +1,101 @@
+package pkg
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func serveV2(method string, name string, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, FilesV2Prefix+name, strings.NewReader(body))
+	rr := httptest.NewRecorder()
+	filesV2Handler(rr, req)
+	return rr
+}
+
+func TestFilesV2Lifecycle(t *testing.T) {
+	TestCleanCSV(t)
+	defer teardown()
+
+	rr := serveV2(http.MethodPut, "notes/a.txt", "one two three")
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("PUT returned wrong status code: got %v want %v", rr.Code, http.StatusCreated)
+	}
+
+	rr = serveV2(http.MethodPut, "notes/a.txt", "one two three four")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("PUT returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+	var details FileDetails
+	err := json.Unmarshal(rr.Body.Bytes(), &details)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if details.WordCount != 4 || details.FileSize != 18 {
+		t.Errorf("Unexpected details after replace: %+v", details)
+	}
+
+	rr = serveV2(http.MethodHead, "notes/a.txt", "")
+	if rr.Code != http.StatusOK || rr.Header().Get("X-Word-Count") != "4" || rr.Body.Len() != 0 {
+		t.Errorf("Unexpected HEAD response: %v %v %q", rr.Code, rr.Header(), rr.Body.String())
+	}
+
+	rr = serveV2(http.MethodPatch, "notes/a.txt", `{"filename":"notes/b.txt"}`)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("PATCH returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+
+	rr = serveV2(http.MethodGet, "notes/b.txt", "")
+	if rr.Code != http.StatusOK || rr.Body.String() != "one two three four" {
+		t.Errorf("Unexpected GET response: %v %q", rr.Code, rr.Body.String())
+	}
+
+	for _, body := range []string{`{"owner":"mallory"}`, `{"tags":["two words"]}`} {
+		if rr := serveV2(http.MethodPatch, "notes/b.txt", body); rr.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected an unsupported patch to be refused, got %v", body, rr.Code)
+		}
+	}
+	rr = serveV2(http.MethodPatch, "notes/b.txt", `{"tags":["draft","notes"]}`)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("PATCH of the tags returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+	record, err := findByName("notes/b.txt")
+	if err != nil || record == nil || strings.Join(record.Tags, ",") != "draft,notes" || record.WordCount != 4 {
+		t.Errorf("Expected the tags to be recorded, got %+v %v", record, err)
+	}
+
+	rr = serveV2(http.MethodDelete, "notes/b.txt", "")
+	if rr.Code != http.StatusNoContent {
+		t.Errorf("DELETE returned wrong status code: got %v want %v", rr.Code, http.StatusNoContent)
+	}
+
+	rr = serveV2(http.MethodGet, "notes/b.txt", "")
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("GET after DELETE returned wrong status code: got %v want %v", rr.Code, http.StatusNotFound)
+	}
+}
+
+func TestFilesV2MethodNotAllowed(t *testing.T) {
+	rr := serveV2(http.MethodPost, TestFileName, "")
+	if rr.Code != http.StatusMethodNotAllowed {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusMethodNotAllowed)
+	}
+	if allow := rr.Header().Get("Allow"); allow != "GET, HEAD, PUT, PATCH, DELETE" {
+		t.Errorf("Unexpected Allow header: %s", allow)
+	}
+}
+
+func TestAllowMethods(t *testing.T) {
+	handler := allowMethods(deleteHandler, http.MethodPost, http.MethodDelete)
+
+	rr := httptest.NewRecorder()
+	handler(rr, httptest.NewRequest(http.MethodGet, "/api/v1/delete?filename="+TestFileName, nil))
+	if rr.Code != http.StatusMethodNotAllowed {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusMethodNotAllowed)
+	}
+	if allow := rr.Header().Get("Allow"); allow != "POST, DELETE" {
+		t.Errorf("Unexpected Allow header: %s", allow)
+	}
+}
@@ -1,13 +1,12 @@
 package pkg
 
 import (
-	"bufio"
-	"fmt"
+	"context"
 	"io/fs"
+	"log"
 	"os"
 	"path/filepath"
-	"sort"
-	"strings"
+	"runtime"
 	"sync"
 )
 
@@ -18,76 +17,133 @@ type Frequency struct {
 
 type Frequencies []Frequency
 
-func (w Frequencies) Len() int           { return len(w) }
-func (w Frequencies) Swap(i, j int)      { w[i], w[j] = w[j], w[i] }
-func (w Frequencies) Less(i, j int) bool { return w[i].Count > w[j].Count } // Sort in descending order
+func (w Frequencies) Len() int      { return len(w) }
+func (w Frequencies) Swap(i, j int) { w[i], w[j] = w[j], w[i] }
+func (w Frequencies) Less(i, j int) bool {
+	// Sort in descending order; ties are ordered by word so that pages are stable
+	if w[i].Count != w[j].Count {
+		return w[i].Count > w[j].Count
+	}
+	return w[i].Word < w[j].Word
+}
 
-func CountWordsFrequencyParallel(directory string, no int, mostFrequent bool) Frequencies {
+// cancelCheckInterval is the number of words a worker counts between two checks of the context.
+const cancelCheckInterval = 4096
 
-	wordCounts := make(map[string]int)
-	var mutex sync.Mutex
-	var wg sync.WaitGroup
+// CountWordsFrequencyParallel counts the words of every file below directory and returns the no most
+// or least frequent ones. The files are processed by a bounded pool of workers (runtime.NumCPU()
+// when workers <= 0), each counting into its own map; the maps are merged once all files are read,
+// so the workers never contend on a lock. The walk stops as soon as ctx is cancelled.
+func CountWordsFrequencyParallel(ctx context.Context, directory string, no int, mostFrequent bool,
+	workers int) (Frequencies, error) {
 
-	// Walk the directory and process files concurrently
-	err := fs.WalkDir(os.DirFS(directory), ".", func(path string, d fs.DirEntry, err error) error {
-		if err != nil || d.IsDir() {
-			return err
-		}
+	wordCounts, err := countWordsInDirectory(ctx, directory, workers)
+	if err != nil {
+		return nil, err
+	}
+	return selectFrequencies(wordCounts, no, mostFrequent, 0), nil
+}
 
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
+func countWordsInDirectory(ctx context.Context, directory string, workers int) (map[string]int, error) {
+	return countWordsMatching(ctx, directory, workers, nil)
+}
 
-			// Join the directory path with the file path
-			filePath := filepath.Join(directory, path)
+// countWordsMatching counts the words of the files below directory whose slash-separated relative
+// path is accepted by match; a nil match accepts every file.
+func countWordsMatching(ctx context.Context, directory string, workers int,
+	match func(path string) bool) (map[string]int, error) {
 
-			file, err := os.Open(filePath)
-			if err != nil {
-				fmt.Println("Error opening file:", err)
-				return
-			}
-			defer CloseFile(file)
+	tokenizer := configuredTokenizer()
+	return countInDirectory(ctx, directory, workers, match, func(ctx context.Context, path string,
+		counts map[string]int) error {
+		return countFileWords(ctx, path, tokenizer, counts)
+	})
+}
 
-			scanner := bufio.NewScanner(file)
-			scanner.Split(bufio.ScanWords)
+// fileCounter adds the counts of the file at path to counts.
+type fileCounter func(ctx context.Context, path string, counts map[string]int) error
 
-			var lineWg sync.WaitGroup
+// countInDirectory runs count over the matching files below directory with a bounded pool of
+// workers and merges their counts.
+func countInDirectory(ctx context.Context, directory string, workers int, match func(path string) bool,
+	count fileCounter) (map[string]int, error) {
 
-			for scanner.Scan() {
-				lineWg.Add(1)
-				go func(word string) {
-					defer lineWg.Done()
-					word = strings.ToLower(word)
-					mutex.Lock()
-					wordCounts[word]++
-					mutex.Unlock()
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	paths := make(chan string, workers)
+	partials := make(chan map[string]int, workers)
+	var wg sync.WaitGroup
 
-				}(scanner.Text())
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			local := make(map[string]int)
+			for path := range paths {
+				err := count(ctx, path, local)
+				if err != nil && ctx.Err() == nil {
+					log.Println("Error counting words of", path, err)
+				}
 			}
-			lineWg.Wait() // Wait for all line-processing goroutines
+			partials <- local
 		}()
+	}
 
-		return nil
+	// Walk the directory and feed the workers; the walk blocks while every worker is busy
+	walkErr := fs.WalkDir(os.DirFS(directory), ".", func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		if match != nil && !match(path) {
+			return nil
+		}
+		select {
+		case paths <- filepath.Join(directory, path):
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
 	})
+	close(paths)
 
-	if err != nil {
-		fmt.Println("Error walking directory:", err)
-	}
+	go func() {
+		wg.Wait()
+		close(partials)
+	}()
 
-	wg.Wait() // Wait for all file-processing goroutines
+	wordCounts := make(map[string]int)
+	for local := range partials {
+		for word, count := range local {
+			wordCounts[word] += count
+		}
+	}
 
-	// Convert the map into a slice for sorting
-	result := make(Frequencies, 0, len(wordCounts))
-	for word, count := range wordCounts {
-		result = append(result, Frequency{word, count})
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if walkErr != nil {
+		log.Println("Error walking directory:", walkErr)
 	}
+	return wordCounts, nil
+}
 
-	sort.Sort(result)
-	if len(result) < 10 {
-		return result
+// countFileWords adds the words of the file at path, as split by tokenizer, to counts. Files that do
+// not hold text have no words.
+func countFileWords(ctx context.Context, path string, tokenizer Tokenizer, counts map[string]int) error {
+	if text, err := isTextFile(path); err != nil || !text {
+		return err
 	}
-	if mostFrequent {
-		return result[:no] // Return the top 10
+	file, err := openDecoded(path)
+	if err != nil {
+		return err
 	}
-	return result[len(result)-no:] // Return the top 10
+	defer CloseFile(file)
+
+	return scanTokens(ctx, file, tokenizer, func(word string) {
+		counts[word]++
+	})
 }
@@ -1,7 +1,15 @@
 package pkg
 
 import (
+	"bufio"
+	"context"
+	"errors"
 	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
 )
 
@@ -9,7 +17,10 @@ func TestCountWordsParallel(t *testing.T) {
 	directory := "test-resources"
 	no := 10
 
-	result := CountWordsFrequencyParallel(directory, no, true)
+	result, err := CountWordsFrequencyParallel(context.Background(), directory, no, true, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
 
 	if len(result) != no {
 		t.Errorf("Expected %d results, got %d", no, len(result))
@@ -19,3 +30,111 @@ func TestCountWordsParallel(t *testing.T) {
 		fmt.Println(wc.Word, ":", wc.Count)
 	}
 }
+
+func TestCountWordsParallelWorkerCountsAgree(t *testing.T) {
+	single, err := countWordsInDirectory(context.Background(), "test-resources", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	many, err := countWordsInDirectory(context.Background(), "test-resources", 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(single) != len(many) {
+		t.Fatalf("Expected the same vocabulary, got %d and %d words", len(single), len(many))
+	}
+	for word, count := range single {
+		if many[word] != count {
+			t.Errorf("Count of %q differs: %d vs %d", word, count, many[word])
+		}
+	}
+}
+
+func TestCountWordsParallelCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := CountWordsFrequencyParallel(ctx, "test-resources", 10, true, 2)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected context.Canceled, got %v", err)
+	}
+}
+
+// countWordsFrequencyUnbounded is the previous implementation, one goroutine per file and per word
+// behind a single mutex, kept to benchmark against the worker pool.
+func countWordsFrequencyUnbounded(directory string) map[string]int {
+	wordCounts := make(map[string]int)
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+
+	_ = fs.WalkDir(os.DirFS(directory), ".", func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			file, err := os.Open(filepath.Join(directory, path))
+			if err != nil {
+				return
+			}
+			defer CloseFile(file)
+
+			scanner := bufio.NewScanner(file)
+			scanner.Split(bufio.ScanWords)
+			var lineWg sync.WaitGroup
+			for scanner.Scan() {
+				lineWg.Add(1)
+				go func(word string) {
+					defer lineWg.Done()
+					word = strings.ToLower(word)
+					mutex.Lock()
+					wordCounts[word]++
+					mutex.Unlock()
+				}(scanner.Text())
+			}
+			lineWg.Wait()
+		}()
+		return nil
+	})
+	wg.Wait()
+	return wordCounts
+}
+
+// benchmarkDirectory fills a temporary directory with copies of the test files.
+func benchmarkDirectory(b *testing.B, copies int) string {
+	directory := b.TempDir()
+	data, err := os.ReadFile(TestFileLocation)
+	if err != nil {
+		b.Fatal(err)
+	}
+	for i := 0; i < copies; i++ {
+		err = os.WriteFile(filepath.Join(directory, fmt.Sprintf("file%d.txt", i)), data, 0644)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+	return directory
+}
+
+func BenchmarkCountWordsUnbounded(b *testing.B) {
+	directory := benchmarkDirectory(b, 50)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		countWordsFrequencyUnbounded(directory)
+	}
+}
+
+func BenchmarkCountWordsWorkerPool(b *testing.B) {
+	directory := benchmarkDirectory(b, 50)
+	for _, workers := range []int{1, 4, 0} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				_, err := countWordsInDirectory(context.Background(), directory, workers)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}